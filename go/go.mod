@@ -0,0 +1,14 @@
+module github.com/dotfob/sysadmin-tools/go
+
+go 1.21
+
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/term v0.27.0
+)
+
+require (
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
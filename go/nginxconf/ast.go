@@ -0,0 +1,280 @@
+// Package nginxconf parses Nginx configuration files into a syntax tree with source
+// positions and prints the tree back, keeping comments, so that tools can inspect and
+// edit existing configs.
+//
+// A config is a list of directives. Block directives such as http, server and location
+// hold child directives; comments are kept as directives named "#". Include directives
+// keep their place in the tree and, when a config is loaded with Load, point to the
+// files they include.
+package nginxconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pos is a position in a config file.
+type Pos struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// String formats the position as file:line.
+func (p Pos) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// Arg is a directive argument.
+type Arg struct {
+	Value string // unquoted and unescaped value
+	Raw   string // text as written in the file, including quotes; empty for new arguments
+}
+
+// String returns the argument as it is printed: the original text when the argument was
+// parsed, otherwise the value, quoted when needed.
+func (a Arg) String() string {
+	if a.Raw != "" {
+		return a.Raw
+	}
+	return Quote(a.Value)
+}
+
+// Quoted reports whether the argument was written between quotes.
+func (a Arg) Quoted() bool {
+	return strings.HasPrefix(a.Raw, `"`) || strings.HasPrefix(a.Raw, `'`)
+}
+
+// Quote returns a value as an argument, between double quotes when it is empty or
+// contains whitespace or characters with a meaning in the config syntax.
+func Quote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\r\n;{}#\"'") {
+		return value
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\t", `\t`, "\r", `\r`, "\n", `\n`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// Directive is a simple directive, a block directive or a comment.
+type Directive struct {
+	Name    string       // directive name, or "#" for comments
+	RawName string       // name as written when it was quoted, as map and types entries can be
+	Args    []Arg        // arguments
+	Block   []*Directive // children of block directives
+	IsBlock bool         // true for block directives, even when the block is empty
+	Comment string       // text after "#" for comments
+	Inline  bool         // comment written on the same line as the preceding code
+	Blank   bool         // preceded by an empty line
+	Pos     Pos          // position of the directive name
+	// Includes holds the files loaded for an include directive by Load.
+	Includes []*File
+}
+
+// New returns a directive with the given arguments.
+func New(name string, args ...string) *Directive {
+	d := &Directive{Name: name}
+	d.SetArgs(args...)
+	return d
+}
+
+// NewBlock returns a block directive with the given arguments and children.
+func NewBlock(name string, args []string, children ...*Directive) *Directive {
+	d := New(name, args...)
+	d.IsBlock = true
+	d.Block = children
+	return d
+}
+
+// NewComment returns a comment directive; text is written after "# ".
+func NewComment(text string) *Directive {
+	return &Directive{Name: "#", Comment: " " + text}
+}
+
+// IsComment reports whether the directive is a comment.
+func (d *Directive) IsComment() bool {
+	return d.Name == "#"
+}
+
+// Arg returns the value of the i-th argument, or "" when there is no such argument.
+func (d *Directive) Arg(i int) string {
+	if i < 0 || i >= len(d.Args) {
+		return ""
+	}
+	return d.Args[i].Value
+}
+
+// Values returns the values of all arguments.
+func (d *Directive) Values() []string {
+	values := make([]string, len(d.Args))
+	for i, a := range d.Args {
+		values[i] = a.Value
+	}
+	return values
+}
+
+// SetArgs replaces the arguments.
+func (d *Directive) SetArgs(args ...string) {
+	d.Args = make([]Arg, len(args))
+	for i, value := range args {
+		d.Args[i] = Arg{Value: value}
+	}
+}
+
+// HasArg reports whether one of the arguments has the given value.
+func (d *Directive) HasArg(value string) bool {
+	for _, a := range d.Args {
+		if a.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Children returns the children of a block directive, with comments left out and
+// include directives replaced by the directives of the included files.
+func (d *Directive) Children() []*Directive {
+	return Expand(d.Block)
+}
+
+// Find returns the children with the given name, looking through includes.
+func (d *Directive) Find(name string) []*Directive {
+	return Find(d.Block, name)
+}
+
+// First returns the first child with the given name, or nil.
+func (d *Directive) First(name string) *Directive {
+	if found := d.Find(name); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// String formats the directive header, e.g. "location = /health" or "listen 80".
+func (d *Directive) String() string {
+	if d.IsComment() {
+		return "#" + d.Comment
+	}
+	name := d.RawName
+	if name == "" {
+		name = Quote(d.Name)
+	}
+	parts := []string{name}
+	for i, a := range d.Args {
+		// A quoted string ends the token, so in if ($a = "b") the parenthesis is a
+		// separate argument; print it attached as it is usually written
+		if d.Name == "if" && i > 0 && i == len(d.Args)-1 && a.Raw == ")" {
+			parts[len(parts)-1] += ")"
+			continue
+		}
+		parts = append(parts, a.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// File is a parsed config file.
+type File struct {
+	Path       string
+	Directives []*Directive
+}
+
+// Find returns the top-level directives of the file with the given name, looking through includes.
+func (f *File) Find(name string) []*Directive {
+	return Find(f.Directives, name)
+}
+
+// Expand returns the directives with comments left out and include directives replaced
+// by the directives of the included files, recursively.
+func Expand(directives []*Directive) []*Directive {
+	var expanded []*Directive
+	for _, d := range directives {
+		switch {
+		case d.IsComment():
+		case d.Name == "include" && d.Includes != nil:
+			for _, f := range d.Includes {
+				expanded = append(expanded, Expand(f.Directives)...)
+			}
+		default:
+			expanded = append(expanded, d)
+		}
+	}
+	return expanded
+}
+
+// Find returns the directives with the given name, looking through includes.
+func Find(directives []*Directive, name string) []*Directive {
+	var found []*Directive
+	for _, d := range Expand(directives) {
+		if d.Name == name {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// Walk calls fn for each directive in depth-first order, looking through includes. The
+// parents of the directive, outermost first, are passed along; returning false skips
+// the children of the directive.
+func Walk(directives []*Directive, fn func(d *Directive, parents []*Directive) bool) {
+	walk(directives, nil, fn)
+}
+
+func walk(directives []*Directive, parents []*Directive, fn func(d *Directive, parents []*Directive) bool) {
+	for _, d := range Expand(directives) {
+		if fn(d, parents) && d.IsBlock {
+			walk(d.Block, append(parents[:len(parents):len(parents)], d), fn)
+		}
+	}
+}
+
+// Remove returns the directives without target, searching nested blocks too. It reports
+// whether the target was found. Directives of included files must be removed from the
+// included File.
+func Remove(directives []*Directive, target *Directive) ([]*Directive, bool) {
+	for i, d := range directives {
+		if d == target {
+			// Drop an inline comment attached to the removed directive
+			end := i + 1
+			if end < len(directives) && directives[end].IsComment() && directives[end].Inline {
+				end++
+			}
+			return append(directives[:i:i], directives[end:]...), true
+		}
+		if d.IsBlock {
+			if block, ok := Remove(d.Block, target); ok {
+				d.Block = block
+				return directives, true
+			}
+		}
+	}
+	return directives, false
+}
+
+// InsertAfter returns the directives with the new ones inserted after target, or appended
+// when target is nil or not found.
+func InsertAfter(directives []*Directive, target *Directive, added ...*Directive) []*Directive {
+	for i, d := range directives {
+		if d == target {
+			// Keep an inline comment next to the directive it belongs to
+			if i+1 < len(directives) && directives[i+1].IsComment() && directives[i+1].Inline {
+				i++
+			}
+			result := append(directives[:i+1:i+1], added...)
+			return append(result, directives[i+1:]...)
+		}
+	}
+	return append(directives, added...)
+}
+
+// InsertBefore returns the directives with the new ones inserted before target, or
+// prepended when target is nil or not found.
+func InsertBefore(directives []*Directive, target *Directive, added ...*Directive) []*Directive {
+	index := 0
+	for i, d := range directives {
+		if d == target {
+			index = i
+			break
+		}
+	}
+	result := append(added[:len(added):len(added)], directives[index:]...)
+	return append(directives[:index:index], result...)
+}
@@ -0,0 +1,190 @@
+package nginxconf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxIncludeDepth limits nested includes, which also stops include loops.
+const maxIncludeDepth = 16
+
+// LoadOptions controls how Load reads files.
+type LoadOptions struct {
+	// Prefix resolves relative include paths; it defaults to the directory of the loaded file.
+	Prefix string
+	// ReadFile reads a file; it defaults to os.ReadFile.
+	ReadFile func(path string) ([]byte, error)
+	// Glob returns the files matching an include pattern; it defaults to a sorted
+	// filepath.Glob that skips directories.
+	Glob func(pattern string) ([]string, error)
+}
+
+// Config is a loaded configuration: the main file and every file it includes.
+type Config struct {
+	Main  *File
+	Files []*File // every loaded file, the main file first
+}
+
+// Directives returns the directives of the main file.
+func (c *Config) Directives() []*Directive {
+	return c.Main.Directives
+}
+
+// loader reads a file and its includes.
+type loader struct {
+	opts   LoadOptions
+	config *Config
+}
+
+// globFiles returns the regular files matching a pattern in sorted order, as nginx does.
+func globFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			files = append(files, match)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Load parses a config file and the files it includes. Include directives stay in the
+// tree and list the included files in Includes. Glob patterns that match no file are left
+// with an empty Includes list; an include of a single file that does not exist is an
+// error, as it is for nginx -t.
+func Load(path string, opts LoadOptions) (*Config, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = filepath.Dir(path)
+	}
+	if opts.ReadFile == nil {
+		opts.ReadFile = os.ReadFile
+	}
+	if opts.Glob == nil {
+		opts.Glob = globFiles
+	}
+	l := &loader{opts: opts, config: &Config{}}
+	f, err := l.load(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	l.config.Main = f
+	return l.config, nil
+}
+
+func (l *loader) load(path string, depth int) (*File, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nested too deeply", path)
+	}
+	content, err := l.opts.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Parse(content, path)
+	if err != nil {
+		return nil, err
+	}
+	l.config.Files = append(l.config.Files, f)
+	if err := l.resolve(f.Directives, depth); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// resolve loads the files of include directives, including those in nested blocks.
+func (l *loader) resolve(directives []*Directive, depth int) error {
+	for _, d := range directives {
+		if d.IsBlock {
+			if err := l.resolve(d.Block, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		if d.Name != "include" || len(d.Args) != 1 {
+			continue
+		}
+
+		pattern := d.Arg(0)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(l.opts.Prefix, pattern)
+		}
+		files, err := l.opts.Glob(pattern)
+		if err != nil {
+			return &SyntaxError{d.Pos, fmt.Sprintf("invalid include pattern %s", d.Arg(0))}
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return &SyntaxError{d.Pos, fmt.Sprintf("included file %s not found", pattern)}
+		}
+		d.Includes = []*File{}
+		for _, file := range files {
+			included, err := l.load(file, depth+1)
+			if err != nil {
+				return err
+			}
+			d.Includes = append(d.Includes, included)
+		}
+	}
+	return nil
+}
+
+// LoadDump parses the output of nginx -T, which prints every loaded file after a
+// "# configuration file <path>:" line, starting from the main configuration file.
+// Includes are resolved against the files of the dump.
+func LoadDump(dump []byte) (*Config, error) {
+	files := map[string][]byte{}
+	var order []string
+	var current string
+	var content strings.Builder
+	flush := func() {
+		if current != "" {
+			files[current] = []byte(content.String())
+			order = append(order, current)
+		}
+		content.Reset()
+	}
+	for _, line := range strings.SplitAfter(string(dump), "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(trimmed, "# configuration file ") && strings.HasSuffix(trimmed, ":") {
+			flush()
+			current = strings.TrimSuffix(strings.TrimPrefix(trimmed, "# configuration file "), ":")
+			continue
+		}
+		if current != "" {
+			content.WriteString(line)
+		}
+	}
+	flush()
+
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no configuration files found in nginx -T output")
+	}
+	return Load(order[0], LoadOptions{
+		ReadFile: func(path string) ([]byte, error) {
+			content, ok := files[path]
+			if !ok {
+				return nil, fmt.Errorf("%s: not found in nginx -T output", path)
+			}
+			return content, nil
+		},
+		Glob: func(pattern string) ([]string, error) {
+			var matches []string
+			for _, file := range order {
+				matched, err := filepath.Match(pattern, file)
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					matches = append(matches, file)
+				}
+			}
+			sort.Strings(matches)
+			return matches, nil
+		},
+	})
+}
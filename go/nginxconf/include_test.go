@@ -0,0 +1,117 @@
+package nginxconf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates the files under dir, keyed by their relative path.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"nginx.conf":                 "http {\n    include conf.d/*.conf;\n    include sites-enabled/*;\n}\n",
+		"conf.d/zones.conf":          "limit_req_zone $binary_remote_addr zone=api:10m rate=10r/s;\n",
+		"sites-enabled/b.conf":       "server {\n    server_name b.example.com;\n    include snippets/acl.conf;\n}\n",
+		"sites-enabled/a.conf":       "server {\n    server_name a.example.com;\n}\n",
+		"snippets/acl.conf":          "allow 10.0.0.0/8;\ndeny all;\n",
+		"sites-enabled/subdir/x.txt": "ignored;\n",
+	})
+
+	config, err := Load(filepath.Join(dir, "nginx.conf"), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Files) != 5 {
+		t.Errorf("loaded %d files, want 5", len(config.Files))
+	}
+
+	// Includes are sorted like nginx does and walked as part of the block
+	var names []string
+	Walk(config.Directives(), func(d *Directive, parents []*Directive) bool {
+		switch d.Name {
+		case "server_name":
+			names = append(names, d.Arg(0))
+		case "deny":
+			if len(parents) != 2 || parents[1].Name != "server" {
+				t.Errorf("deny has parents %v, want http and server", parents)
+			}
+		}
+		return true
+	})
+	if got := strings.Join(names, " "); got != "a.example.com b.example.com" {
+		t.Errorf("server names %q, want a.example.com b.example.com", got)
+	}
+}
+
+func TestLoadMissingInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"nginx.conf": "http {\n    include conf.d/*.conf;\n    include snippets/nx2-acl-office.conf;\n}\n",
+	})
+
+	_, err := Load(filepath.Join(dir, "nginx.conf"), LoadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "nx2-acl-office.conf not found") {
+		t.Fatalf("Load returned %v, want an error for the missing snippet", err)
+	}
+	if !strings.HasPrefix(err.Error(), filepath.Join(dir, "nginx.conf")+":3:") {
+		t.Errorf("error %q does not point at the include line", err)
+	}
+}
+
+func TestLoadIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"nginx.conf": "include nginx.conf;\n",
+	})
+	if _, err := Load(filepath.Join(dir, "nginx.conf"), LoadOptions{}); err == nil {
+		t.Fatal("Load of a file including itself succeeded")
+	}
+}
+
+func TestLoadDump(t *testing.T) {
+	dump := "nginx: the configuration file /etc/nginx/nginx.conf syntax is ok\n" +
+		"nginx: configuration file /etc/nginx/nginx.conf test is successful\n" +
+		"# configuration file /etc/nginx/nginx.conf:\n" +
+		"http {\n    include /etc/nginx/sites-enabled/*;\n}\n\n" +
+		"# configuration file /etc/nginx/sites-enabled/b.conf:\n" +
+		"server {\n    server_name b.example.com;\n}\n\n" +
+		"# configuration file /etc/nginx/sites-enabled/a.conf:\n" +
+		"server {\n    server_name a.example.com;\n}\n"
+
+	config, err := LoadDump([]byte(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Files) != 3 || config.Files[0].Path != "/etc/nginx/nginx.conf" {
+		t.Fatalf("loaded %d files starting with %s, want 3 starting with nginx.conf", len(config.Files), config.Files[0].Path)
+	}
+	var names []string
+	Walk(config.Directives(), func(d *Directive, parents []*Directive) bool {
+		if d.Name == "server_name" {
+			names = append(names, d.Arg(0))
+		}
+		return true
+	})
+	if got := strings.Join(names, " "); got != "a.example.com b.example.com" {
+		t.Errorf("server names %q, want a.example.com b.example.com", got)
+	}
+
+	if _, err := LoadDump([]byte("nginx: configuration file test failed\n")); err == nil {
+		t.Error("LoadDump without files succeeded")
+	}
+}
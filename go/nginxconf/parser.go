@@ -0,0 +1,282 @@
+package nginxconf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SyntaxError is a parse error with its position.
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// tokenKind classifies tokens.
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenOpen
+	tokenClose
+	tokenSemicolon
+	tokenComment
+)
+
+// token is a lexical token. Words keep both the unescaped value and the raw text.
+type token struct {
+	kind    tokenKind
+	value   string
+	raw     string
+	pos     Pos
+	newline bool // the token is the first one on its line
+	blank   bool // an empty line precedes the token
+}
+
+// lexer splits a config into tokens.
+type lexer struct {
+	src    string
+	file   string
+	offset int
+	line   int
+	column int
+}
+
+func (l *lexer) peek() byte {
+	return l.src[l.offset]
+}
+
+func (l *lexer) advance() byte {
+	c := l.src[l.offset]
+	l.offset++
+	if c == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return c
+}
+
+// unescape applies the escapes nginx recognizes: \" \' \\ \t \r \n. Other backslashes,
+// as in regexes, are kept.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case '"', '\'', '\\':
+				i++
+			case 't':
+				b.WriteByte('\t')
+				i++
+				continue
+			case 'r':
+				b.WriteByte('\r')
+				i++
+				continue
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// tokens returns all tokens of the source.
+func (l *lexer) tokens() ([]token, error) {
+	var tokens []token
+	newlines := 1 // the first token starts a line
+	for l.offset < len(l.src) {
+		c := l.peek()
+		if c == '\n' {
+			newlines++
+			l.advance()
+			continue
+		}
+		if c == ' ' || c == '\t' || c == '\r' {
+			l.advance()
+			continue
+		}
+
+		t := token{pos: Pos{File: l.file, Line: l.line, Column: l.column}, newline: newlines > 0, blank: newlines > 1}
+		newlines = 0
+		start := l.offset
+		switch c {
+		case '#':
+			for l.offset < len(l.src) && l.peek() != '\n' {
+				l.advance()
+			}
+			t.kind = tokenComment
+			t.value = strings.TrimRight(l.src[start+1:l.offset], "\r")
+		case '{':
+			l.advance()
+			t.kind = tokenOpen
+		case '}':
+			l.advance()
+			t.kind = tokenClose
+		case ';':
+			l.advance()
+			t.kind = tokenSemicolon
+		case '"', '\'':
+			l.advance()
+			for {
+				if l.offset >= len(l.src) {
+					return nil, &SyntaxError{t.pos, "unterminated string"}
+				}
+				ch := l.advance()
+				if ch == '\\' && l.offset < len(l.src) {
+					l.advance()
+				} else if ch == c {
+					break
+				}
+			}
+			t.kind = tokenWord
+			t.raw = l.src[start:l.offset]
+			t.value = unescape(t.raw[1 : len(t.raw)-1])
+		default:
+			for l.offset < len(l.src) {
+				ch := l.peek()
+				if strings.IndexByte(" \t\r\n;\"'", ch) >= 0 {
+					break
+				}
+				// Braces belong to the word in variables such as ${host}
+				if ch == '{' && !(l.offset > start && l.src[l.offset-1] == '$') {
+					break
+				}
+				if ch == '}' && !strings.Contains(l.src[start:l.offset], "${") {
+					break
+				}
+				if ch == '\\' && l.offset+1 < len(l.src) {
+					l.advance()
+				}
+				l.advance()
+			}
+			t.kind = tokenWord
+			t.raw = l.src[start:l.offset]
+			t.value = unescape(t.raw)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// parser builds directives from tokens.
+type parser struct {
+	tokens []token
+	pos    int
+	file   string
+}
+
+// Parse parses the content of a config file. Include directives are not followed.
+func Parse(src []byte, path string) (*File, error) {
+	l := &lexer{src: string(src), file: path, line: 1, column: 1}
+	tokens, err := l.tokens()
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, file: path}
+	directives, err := p.block(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Path: path, Directives: directives}, nil
+}
+
+// ParseFile reads and parses a config file. Include directives are not followed.
+func ParseFile(path string) (*File, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content, path)
+}
+
+// block parses directives until the closing brace of the block opened by open, or until
+// the end of the file when open is nil.
+func (p *parser) block(open *token) ([]*Directive, error) {
+	var directives []*Directive
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		p.pos++
+		switch t.kind {
+		case tokenClose:
+			if open == nil {
+				return nil, &SyntaxError{t.pos, `unexpected "}"`}
+			}
+			return directives, nil
+		case tokenOpen, tokenSemicolon:
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("unexpected %q", p.text(t))}
+		case tokenComment:
+			directives = append(directives, &Directive{Name: "#", Comment: t.value, Inline: !t.newline, Blank: t.blank, Pos: t.pos})
+			continue
+		}
+
+		d := &Directive{Name: t.value, Blank: t.blank, Pos: t.pos}
+		if t.raw != t.value {
+			d.RawName = t.raw
+		}
+		var comments []*Directive
+		for {
+			if p.pos >= len(p.tokens) {
+				return nil, &SyntaxError{d.Pos, `unexpected end of file, expecting ";" or "{"`}
+			}
+			t = p.tokens[p.pos]
+			p.pos++
+			if t.kind == tokenWord {
+				d.Args = append(d.Args, Arg{Value: t.value, Raw: t.raw})
+				continue
+			}
+			if t.kind == tokenComment {
+				// Comments in the middle of a directive are moved before it
+				comments = append(comments, &Directive{Name: "#", Comment: t.value, Pos: t.pos})
+				continue
+			}
+			if t.kind == tokenClose {
+				return nil, &SyntaxError{t.pos, `unexpected "}"`}
+			}
+			if t.kind == tokenOpen {
+				block, err := p.block(&t)
+				if err != nil {
+					return nil, err
+				}
+				d.Block = block
+				d.IsBlock = true
+			}
+			break
+		}
+		if len(comments) > 0 {
+			comments[0].Blank = d.Blank
+			d.Blank = false
+			directives = append(directives, comments...)
+		}
+		directives = append(directives, d)
+	}
+	if open != nil {
+		return nil, &SyntaxError{open.pos, `unexpected end of file, expecting "}"`}
+	}
+	return directives, nil
+}
+
+// text returns the text of a punctuation token.
+func (p *parser) text(t token) string {
+	switch t.kind {
+	case tokenOpen:
+		return "{"
+	case tokenClose:
+		return "}"
+	case tokenSemicolon:
+		return ";"
+	}
+	return t.raw
+}
@@ -0,0 +1,160 @@
+package nginxconf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotedDirectiveNames(t *testing.T) {
+	src := "types {\n    \"text/html\" html htm;\n    'image/svg+xml' svg;\n}\n\nmap $http_upgrade $connection_upgrade {\n    default upgrade;\n    \"\" close;\n    \"~^a b\" spaced;\n}\n"
+	f, err := Parse([]byte(src), "quoted.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.Bytes()); got != src {
+		t.Errorf("printed\n%s\nwant\n%s", got, src)
+	}
+
+	// Names are unquoted for lookups, as arguments are
+	types := f.Directives[0].Block
+	if types[0].Name != "text/html" || types[1].Name != "image/svg+xml" {
+		t.Errorf("types names %q and %q, want them unquoted", types[0].Name, types[1].Name)
+	}
+	entries := f.Directives[1].Block
+	if entries[1].Name != "" || entries[2].Name != "~^a b" {
+		t.Errorf("map keys %q and %q, want them unquoted", entries[1].Name, entries[2].Name)
+	}
+
+	// Built directives quote names that need it
+	if got := New("", "close").String(); got != `"" close` {
+		t.Errorf("New(\"\", \"close\") printed %s, want \"\" close", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := `# main config
+user www-data;
+worker_processes auto; # one per core
+
+http {
+    include mime.types;
+    log_format main '$remote_addr "$request" \'q\'';
+
+    map $host $backend {
+        hostnames;
+        default app;
+        *.example.com "web";
+    }
+
+    server { # example
+        listen 443 ssl;
+        server_name example.com "*.example.com";
+
+        if ($http_user_agent ~* "(bot|crawler)") {
+            return 403;
+        }
+        if (!-f $request_filename) {
+            rewrite ^/(.*)$ /index.php?q=$1 last;
+        }
+        location ~ \.php$ {
+            add_header X-Test "a;b{c}";
+        }
+        location /empty {}
+    }
+}
+`
+	f, err := Parse([]byte(src), "nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.Bytes()); got != src {
+		t.Errorf("printed\n%s\nwant\n%s", got, src)
+	}
+
+	server := f.Directives[4].First("server")
+	if got := server.First("server_name").Values(); len(got) != 2 || got[1] != "*.example.com" {
+		t.Errorf("server_name values %q", got)
+	}
+	if got := f.Directives[4].First("log_format").Arg(1); got != `$remote_addr "$request" 'q'` {
+		t.Errorf("log_format value %q, want it unescaped", got)
+	}
+	if got := server.Find("if")[0].Values(); len(got) != 4 || got[0] != "($http_user_agent" || got[3] != ")" {
+		t.Errorf("if arguments %q", got)
+	}
+	if comment := f.Directives[3]; !comment.IsComment() || !comment.Inline {
+		t.Errorf("directive after worker_processes is %q, want an inline comment", comment.String())
+	}
+}
+
+func TestFormat(t *testing.T) {
+	src := "http{\n\tserver   {listen 80;\n\n\n\t\tserver_name  a;}\n}"
+	want := "http {\n    server {\n        listen 80;\n\n        server_name a;\n    }\n}\n"
+	f, err := Parse([]byte(src), "nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("formatted\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src, msg string
+	}{
+		{"http {\n    listen 80;\n", "nginx.conf:1: "},
+		{"listen 80;\n}\n", "nginx.conf:2: "},
+		{"server_name \"a;\n", "nginx.conf:1: "},
+		{"listen 80\n", "nginx.conf:1: "},
+	}
+	for _, test := range tests {
+		_, err := Parse([]byte(test.src), "nginx.conf")
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", test.src)
+			continue
+		}
+		if _, ok := err.(*SyntaxError); !ok || !strings.HasPrefix(err.Error(), test.msg) {
+			t.Errorf("Parse(%q) returned %v, want a syntax error at %s", test.src, err, test.msg)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"sites-available/a.conf": "server {listen 80;}\n"})
+	available := filepath.Join(dir, "sites-available", "a.conf")
+	enabled := filepath.Join(dir, "a.conf")
+	if err := os.Chmod(available, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(available, enabled); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing through the link replaces its target and keeps the link and the mode
+	f, err := ParseFile(enabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(enabled); err != nil || target != available {
+		t.Errorf("link points to %q (%v), want %s", target, err, available)
+	}
+	info, err := os.Stat(available)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode %v, want 0640", info.Mode().Perm())
+	}
+	if content, _ := os.ReadFile(available); string(content) != "server {\n    listen 80;\n}\n" {
+		t.Errorf("content %q", content)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(available)); len(entries) != 1 {
+		t.Errorf("%d files in sites-available, want no temporary file left", len(entries))
+	}
+}
@@ -0,0 +1,99 @@
+package nginxconf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Indent is the indentation of one block level in printed configs.
+const Indent = "    "
+
+// Format writes directives in the canonical style: four spaces per block level, one
+// directive per line, comments kept in place and at most one empty line between
+// directives. Arguments are printed as written in the source.
+func Format(w io.Writer, directives []*Directive) error {
+	bw := bufio.NewWriter(w)
+	printBlock(bw, directives, 0)
+	return bw.Flush()
+}
+
+func printBlock(w *bufio.Writer, directives []*Directive, depth int) {
+	indent := strings.Repeat(Indent, depth)
+	for i, d := range directives {
+		if d.IsComment() && d.Inline && i > 0 {
+			// Inline comments follow the directive they were written after
+			continue
+		}
+		if d.Blank && i > 0 {
+			w.WriteString("\n")
+		}
+		w.WriteString(indent)
+		w.WriteString(d.String())
+		if !d.IsComment() {
+			if d.IsBlock {
+				if len(d.Block) == 0 {
+					w.WriteString(" {}")
+				} else {
+					w.WriteString(" {")
+					// A comment on the line of the opening brace stays there
+					block := d.Block
+					if block[0].IsComment() && block[0].Inline {
+						w.WriteString(" " + block[0].String())
+						block = block[1:]
+					}
+					w.WriteString("\n")
+					printBlock(w, block, depth+1)
+					w.WriteString(indent + "}")
+				}
+			} else {
+				w.WriteString(";")
+			}
+		}
+		if i+1 < len(directives) && directives[i+1].IsComment() && directives[i+1].Inline {
+			w.WriteString(" " + directives[i+1].String())
+		}
+		w.WriteString("\n")
+	}
+}
+
+// Bytes returns the file printed by Format.
+func (f *File) Bytes() []byte {
+	var buf bytes.Buffer
+	Format(&buf, f.Directives)
+	return buf.Bytes()
+}
+
+// WriteFile prints the file to its path through a temporary file renamed over it, so that
+// nginx never reads a partly written file. A symbolic link is followed, and the permissions
+// and owner of an existing file are kept. The temporary file starts with a dot, which the
+// wildcard of an include does not match.
+func (f *File) WriteFile() error {
+	path := f.Path
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	mode := os.FileMode(0644)
+	info, statErr := os.Stat(path)
+	if statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, f.Bytes(), mode); err != nil {
+		return err
+	}
+	if statErr == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			os.Chown(tmp, int(st.Uid), int(st.Gid))
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
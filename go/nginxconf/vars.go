@@ -0,0 +1,56 @@
+package nginxconf
+
+// isVariableChar reports whether c may appear in a variable name.
+func isVariableChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Variables returns the names of the variables used in a value, written as $name or
+// ${name}, in order of appearance and without duplicates.
+func Variables(value string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 >= len(value) {
+			continue
+		}
+		start, end := i+1, i+1
+		if value[start] == '{' {
+			start++
+			end = start
+			for end < len(value) && value[end] != '}' {
+				end++
+			}
+			if end >= len(value) {
+				break
+			}
+			i = end
+		} else {
+			for end < len(value) && isVariableChar(value[end]) {
+				end++
+			}
+			i = end - 1
+		}
+		name := value[start:end]
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Variables returns the variables used in the arguments of the directive.
+func (d *Directive) Variables() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, a := range d.Args {
+		for _, name := range Variables(a.Value) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
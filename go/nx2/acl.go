@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// namePattern matches the names of access lists and limit zones.
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// aclFile returns the snippet of a named access list, included by sites created with
+// nx2create --allow=@name.
+func aclFile(configDir, name string) string {
+	return filepath.Join(configDir, "snippets", "nx2-acl-"+name+".conf")
+}
+
+// normalizeCIDR validates an address or network and returns it in canonical form.
+func normalizeCIDR(value string) (string, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String(), nil
+	}
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid address or network %s", value)
+	}
+	if !ip.Equal(network.IP) {
+		return "", fmt.Errorf("%s has host bits set; did you mean %s?", value, network)
+	}
+	return network.String(), nil
+}
+
+// readACL returns the networks of an access list.
+func readACL(path string) ([]string, error) {
+	f, err := nginxconf.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var networks []string
+	for _, d := range f.Find("allow") {
+		networks = append(networks, d.Arg(0))
+	}
+	return networks, nil
+}
+
+// writeACL writes an access list as allow directives.
+func writeACL(path, name string, networks []string) error {
+	f := &nginxconf.File{Path: path}
+	f.Directives = append(f.Directives,
+		nginxconf.NewComment(fmt.Sprintf("Access list %s managed by nx2 acl; include it in a server or location", name)),
+		nginxconf.NewComment("followed by \"deny all;\" to allow only these networks."))
+	for _, network := range networks {
+		f.Directives = append(f.Directives, nginxconf.New("allow", network))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return f.WriteFile()
+}
+
+// aclUsers returns the enabled sites that include an access list.
+func aclUsers(configDir, name string) []string {
+	suffix := "snippets/nx2-acl-" + name + ".conf"
+	matches, _ := filepath.Glob(filepath.Join(configDir, "sites-enabled", "*"))
+	var sites []string
+	for _, path := range matches {
+		f, err := nginxconf.ParseFile(path)
+		if err != nil {
+			continue
+		}
+		used := false
+		nginxconf.Walk(f.Directives, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+			if d.Name == "include" && strings.HasSuffix(d.Arg(0), suffix) {
+				used = true
+			}
+			return true
+		})
+		if used {
+			sites = append(sites, strings.TrimSuffix(filepath.Base(path), ".conf"))
+		}
+	}
+	return sites
+}
+
+func runACL(args []string) int {
+	fs := flag.NewFlagSet("acl", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	noReload := fs.Bool("no-reload", false, "Do not reload nginx after changing a list used by enabled sites")
+	fs.Parse(args)
+
+	action, name := fs.Arg(0), fs.Arg(1)
+	if *help || action == "" || (action != "list" && name == "") {
+		fmt.Println("Usage: nx2 acl [--config-dir=<path>] [--no-reload] set|add|remove|delete|show|list [name] [network...]")
+		fmt.Println("Manage named IP allowlists shared by sites created with nx2create --allow=@name.")
+		fmt.Println("\nActions:")
+		fmt.Println("  set <name> <network>...     Create or replace a list")
+		fmt.Println("  add <name> <network>...     Add networks to a list")
+		fmt.Println("  remove <name> <network>...  Remove networks from a list")
+		fmt.Println("  delete <name>               Delete a list that no enabled site uses")
+		fmt.Println("  show <name>                 Print the networks of a list and the enabled sites using it")
+		fmt.Println("  list                        Print the lists")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --no-reload          Do not reload nginx after changing a list used by enabled sites")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nLists are stored in <config-dir>/snippets/nx2-acl-<name>.conf as allow directives. Networks are")
+		fmt.Println("IPv4 or IPv6 addresses or CIDR ranges.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 acl set office 10.10.0.0/16 192.168.1.0/24")
+		fmt.Println("  nx2 acl add office 2001:db8::/32")
+		fmt.Println("  nx2createsite --site-name=intranet.example.com --site-type=proxy ... --allow=@office")
+		return 0
+	}
+
+	if action == "list" {
+		matches, _ := filepath.Glob(filepath.Join(*configDir, "snippets", "nx2-acl-*.conf"))
+		for _, path := range matches {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "nx2-acl-"), ".conf")
+			networks, err := readACL(path)
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				continue
+			}
+			fmt.Printf("%-20s %d network(s)\n", name, len(networks))
+		}
+		return 0
+	}
+
+	if !namePattern.MatchString(name) {
+		fmt.Printf("Error: Invalid list name %s (use lowercase letters, digits, - and _).\n", name)
+		return 1
+	}
+	path := aclFile(*configDir, name)
+	networks, err := readACL(path)
+	if err != nil && !(errors.Is(err, os.ErrNotExist) && action == "set") {
+		fmt.Printf("Error: Failed to read access list %s: %v\n", name, err)
+		return 1
+	}
+	users := aclUsers(*configDir, name)
+
+	switch action {
+	case "show":
+		for _, network := range networks {
+			fmt.Println(network)
+		}
+		if len(users) > 0 {
+			fmt.Printf("\nUsed by: %s\n", strings.Join(users, ", "))
+		}
+		return 0
+	case "delete":
+		if len(users) > 0 {
+			fmt.Printf("Error: Access list %s is used by %s.\n", name, strings.Join(users, ", "))
+			return 2
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("Error: Failed to delete access list %s: %v\n", name, err)
+			return 1
+		}
+		fmt.Printf("Access list %s deleted.\n", name)
+		return 0
+	case "set", "add", "remove":
+	default:
+		fmt.Printf("Error: Unknown action %s. Use set, add, remove, delete, show or list.\n", action)
+		return 1
+	}
+
+	var given []string
+	for _, value := range fs.Args()[2:] {
+		network, err := normalizeCIDR(value)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		given = append(given, network)
+	}
+	if len(given) == 0 {
+		fmt.Println("Error: At least one network is required.")
+		return 1
+	}
+
+	previous := networks
+	switch action {
+	case "set":
+		networks = nil
+		fallthrough
+	case "add":
+		for _, network := range given {
+			found := false
+			for _, existing := range networks {
+				found = found || existing == network
+			}
+			if !found {
+				networks = append(networks, network)
+			}
+		}
+	case "remove":
+		var kept []string
+		for _, existing := range networks {
+			remove := false
+			for _, network := range given {
+				remove = remove || existing == network
+			}
+			if !remove {
+				kept = append(kept, existing)
+			}
+		}
+		if len(kept) == 0 {
+			fmt.Printf("Error: Access list %s would be empty and deny every client. Use delete instead.\n", name)
+			return 2
+		}
+		networks = kept
+	}
+
+	if err := writeACL(path, name, networks); err != nil {
+		fmt.Printf("Error: Failed to write access list %s: %v\n", name, err)
+		return 1
+	}
+	fmt.Printf("Access list %s saved with %d network(s): %s\n", name, len(networks), path)
+
+	if len(users) == 0 || *noReload {
+		return 0
+	}
+	if err := reloadNginx(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		if previous != nil {
+			writeACL(path, name, previous)
+			fmt.Printf("Access list %s restored.\n", name)
+		}
+		return 3
+	}
+	fmt.Printf("Nginx reloaded for %s.\n", strings.Join(users, ", "))
+	return 0
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// auditFinding is a deviation from the security baseline with the risk points it adds.
+type auditFinding struct {
+	Check       string `json:"check"`
+	Points      int    `json:"points"`
+	Message     string `json:"message"`
+	Location    string `json:"location"`
+	Remediation string `json:"remediation"`
+}
+
+// siteAudit is the report of an enabled site.
+type siteAudit struct {
+	Site     string         `json:"site"`
+	File     string         `json:"file"`
+	Score    int            `json:"score"`
+	Risk     int            `json:"risk"`
+	Findings []auditFinding `json:"findings"`
+}
+
+// minHSTSMaxAge is the lowest HSTS max-age accepted, six months as required for preload lists.
+const minHSTSMaxAge = 15768000
+
+var (
+	weakProtocols = []string{"SSLv2", "SSLv3", "TLSv1", "TLSv1.1"}
+	weakCiphers   = []string{"RC4", "DES", "MD5", "NULL", "EXPORT", "EXP", "ADH", "AECDH", "aNULL", "eNULL"}
+	maxAgePattern = regexp.MustCompile(`(?i)max-age\s*=\s*"?(\d+)`)
+)
+
+// auditor checks the server blocks of a site against the baseline.
+type auditor struct {
+	http     []*nginxconf.Directive // directives of the http block in nginx.conf, without servers
+	findings []auditFinding
+}
+
+func (a *auditor) add(check string, points int, d *nginxconf.Directive, message, remediation string) {
+	a.findings = append(a.findings, auditFinding{check, points, message, d.Pos.String(), remediation})
+}
+
+// effective returns the directives with the given name that apply to a server: its own
+// or, when it has none, those of the http block.
+func (a *auditor) effective(server *nginxconf.Directive, name string) []*nginxconf.Directive {
+	if found := server.Find(name); len(found) > 0 {
+		return found
+	}
+	return nginxconf.Find(a.http, name)
+}
+
+// header returns the value of a response header set with add_header for a server.
+func (a *auditor) header(server *nginxconf.Directive, name string) (string, bool) {
+	for _, h := range a.effective(server, "add_header") {
+		if strings.EqualFold(h.Arg(0), name) {
+			return h.Arg(1), true
+		}
+	}
+	return "", false
+}
+
+// dhParamBits returns the size of the prime of a PEM file with DH parameters.
+func dhParamBits(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "DH PARAMETERS" {
+		return 0, fmt.Errorf("no DH PARAMETERS block")
+	}
+	var params struct {
+		P *big.Int
+		G *big.Int
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &params); err != nil {
+		return 0, err
+	}
+	return params.P.BitLen(), nil
+}
+
+// auditTLS checks HSTS, protocols, ciphers and DH parameters of a server with ssl.
+func (a *auditor) auditTLS(server *nginxconf.Directive) {
+	if value, ok := a.header(server, "Strict-Transport-Security"); !ok {
+		a.add("hsts", 20, server, "Strict-Transport-Security is not set",
+			`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains" always;`)
+	} else if m := maxAgePattern.FindStringSubmatch(value); m == nil {
+		a.add("hsts", 15, server, fmt.Sprintf("Strict-Transport-Security %q has no max-age", value),
+			`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains" always;`)
+	} else if maxAge, _ := strconv.Atoi(m[1]); maxAge < minHSTSMaxAge {
+		a.add("hsts", 10, server, fmt.Sprintf("Strict-Transport-Security max-age=%d is below six months (%d)", maxAge, minHSTSMaxAge),
+			"Raise max-age to 31536000 (one year) once HTTPS works on every subdomain covered")
+	}
+
+	if protocols := a.effective(server, "ssl_protocols"); len(protocols) == 0 {
+		a.add("protocols", 5, server, "ssl_protocols is not set; the default of nginx before 1.23.4 enables TLSv1 and TLSv1.1",
+			"ssl_protocols TLSv1.2 TLSv1.3;")
+	} else {
+		var weak []string
+		for _, p := range weakProtocols {
+			if protocols[0].HasArg(p) {
+				weak = append(weak, p)
+			}
+		}
+		if len(weak) > 0 {
+			a.add("protocols", 20, protocols[0], fmt.Sprintf("ssl_protocols enables %s", strings.Join(weak, ", ")),
+				"ssl_protocols TLSv1.2 TLSv1.3;")
+		}
+	}
+
+	if ciphers := a.effective(server, "ssl_ciphers"); len(ciphers) > 0 {
+		var weak []string
+		for _, c := range strings.Split(ciphers[0].Arg(0), ":") {
+			if strings.HasPrefix(c, "!") || strings.HasPrefix(c, "-") {
+				continue
+			}
+			for _, w := range weakCiphers {
+				if strings.Contains(c, w) {
+					weak = append(weak, c)
+					break
+				}
+			}
+		}
+		if len(weak) > 0 {
+			a.add("ciphers", 15, ciphers[0], fmt.Sprintf("ssl_ciphers enables weak ciphers: %s", strings.Join(weak, ", ")),
+				"ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305;")
+		}
+	}
+
+	if dh := a.effective(server, "ssl_dhparam"); len(dh) > 0 {
+		path := dh[0].Arg(0)
+		bits, err := dhParamBits(path)
+		switch {
+		case os.IsNotExist(err):
+			a.add("dhparam", 20, dh[0], fmt.Sprintf("ssl_dhparam file %s does not exist; nginx will fail to start", path),
+				"openssl dhparam -out "+path+" 2048")
+		case err != nil:
+			a.add("dhparam", 10, dh[0], fmt.Sprintf("ssl_dhparam file %s cannot be read: %v", path, err),
+				"openssl dhparam -out "+path+" 2048")
+		case bits < 2048:
+			a.add("dhparam", 15, dh[0], fmt.Sprintf("ssl_dhparam file %s has %d-bit parameters", path, bits),
+				"openssl dhparam -out "+path+" 2048")
+		}
+	}
+}
+
+// auditContent checks the headers, directory listing and dotfile exposure of a server
+// that serves content.
+func (a *auditor) auditContent(server *nginxconf.Directive) {
+	csp, hasCSP := a.header(server, "Content-Security-Policy")
+	if !hasCSP {
+		a.add("csp", 10, server, "Content-Security-Policy is not set",
+			`add_header Content-Security-Policy "default-src 'self'; frame-ancestors 'self'" always;`)
+	}
+	if _, ok := a.header(server, "X-Frame-Options"); !ok && !strings.Contains(csp, "frame-ancestors") {
+		a.add("frame-options", 5, server, "X-Frame-Options is not set and the CSP has no frame-ancestors",
+			"add_header X-Frame-Options SAMEORIGIN always;")
+	}
+	if value, ok := a.header(server, "X-Content-Type-Options"); !ok || !strings.EqualFold(value, "nosniff") {
+		a.add("content-type-options", 5, server, "X-Content-Type-Options nosniff is not set",
+			"add_header X-Content-Type-Options nosniff always;")
+	}
+	if _, ok := a.header(server, "Referrer-Policy"); !ok {
+		a.add("referrer-policy", 5, server, "Referrer-Policy is not set",
+			"add_header Referrer-Policy strict-origin-when-cross-origin always;")
+	}
+
+	nginxconf.Walk(server.Block, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+		if d.Name == "autoindex" && d.Arg(0) == "on" {
+			a.add("autoindex", 10, d, "autoindex on lists directory contents",
+				"Remove autoindex on, or restrict the location with allow/deny or auth_basic")
+		}
+		return true
+	})
+
+	protected := false
+	nginxconf.Walk(server.Block, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+		if d.Name != "location" {
+			return true
+		}
+		loc := parseLocation(d)
+		if (loc.modifier == "~" || loc.modifier == "~*") && strings.Contains(loc.path, `/\.`) {
+			for _, child := range d.Children() {
+				if (child.Name == "deny" && child.Arg(0) == "all") || (child.Name == "return" && strings.HasPrefix(child.Arg(0), "4")) {
+					protected = true
+				}
+			}
+		}
+		return true
+	})
+	if !protected {
+		a.add("dotfiles", 10, server, "no location denies dotfiles such as .git and .env",
+			`location ~ /\.(?!well-known) { deny all; }`)
+	}
+}
+
+// auditServer runs the checks that apply to a server block.
+func (a *auditor) auditServer(server *nginxconf.Directive) {
+	tokens := a.effective(server, "server_tokens")
+	if len(tokens) == 0 || tokens[0].Arg(0) != "off" {
+		a.add("server-tokens", 5, server, "server_tokens is not off; the nginx version is shown in headers and error pages",
+			"server_tokens off; (in the http block of nginx.conf)")
+	}
+
+	ssl := false
+	for _, l := range server.Find("listen") {
+		if l.HasArg("ssl") || l.HasArg("quic") {
+			ssl = true
+		}
+	}
+	if ssl {
+		a.auditTLS(server)
+	}
+
+	// Redirecting servers, such as HTTP to HTTPS redirects, serve no content
+	if servesNoContent(server) {
+		return
+	}
+	a.auditContent(server)
+}
+
+// auditSite loads an enabled site and scores its server blocks. Points of a check are
+// counted once per site, using the highest.
+func auditSite(path, configDir string, http []*nginxconf.Directive) (*siteAudit, error) {
+	config, err := nginxconf.Load(path, nginxconf.LoadOptions{Prefix: configDir})
+	if err != nil {
+		return nil, err
+	}
+	a := &auditor{http: http}
+	for _, server := range findServers(config.Directives()) {
+		a.auditServer(server)
+	}
+
+	report := &siteAudit{
+		Site:     strings.TrimSuffix(filepath.Base(path), ".conf"),
+		File:     path,
+		Findings: a.findings,
+	}
+	if report.Findings == nil {
+		report.Findings = []auditFinding{}
+	}
+	points := map[string]int{}
+	for _, f := range a.findings {
+		points[f.Check] = max(points[f.Check], f.Points)
+	}
+	for _, p := range points {
+		report.Risk += p
+	}
+	report.Score = max(100-report.Risk, 0)
+	return report, nil
+}
+
+// httpContext returns the directives of the http block of nginx.conf other than servers,
+// which are inherited by every site.
+func httpContext(configDir string) []*nginxconf.Directive {
+	mainConf := filepath.Join(configDir, "nginx.conf")
+	if _, err := os.Stat(mainConf); err != nil {
+		return nil
+	}
+	config, err := nginxconf.Load(mainConf, nginxconf.LoadOptions{Prefix: configDir})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to parse %s, http-level settings are ignored: %v\n", mainConf, err)
+		return nil
+	}
+	var directives []*nginxconf.Directive
+	for _, http := range config.Main.Find("http") {
+		for _, d := range http.Children() {
+			if d.Name != "server" {
+				directives = append(directives, d)
+			}
+		}
+	}
+	return directives
+}
+
+func runAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	threshold := fs.Int("threshold", 0, "Exit with status 3 when a site has more risk points than this")
+	jsonOutput := fs.Bool("json", false, "Print the reports as JSON")
+	fs.Parse(args)
+
+	if *help {
+		fmt.Println("Usage: nx2 audit [--config-dir=<path>] [--threshold=<points>] [--json] [site...]")
+		fmt.Println("Score the enabled sites against a security baseline: HSTS, TLS protocols and ciphers, DH parameters,")
+		fmt.Println("server_tokens, security headers, directory listing and dotfile exposure.")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>    Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --threshold=<points>   Exit with status 3 when a site has more risk points than this (default: 0)")
+		fmt.Println("  --json                 Print the reports as JSON")
+		fmt.Println("  --help                 Display this help message")
+		fmt.Println("\nEach site starts with a score of 100 and loses the risk points of every failed check.")
+		fmt.Println("Without sites, every site in sites-enabled is audited.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 audit")
+		fmt.Println("  nx2 audit --threshold=20 example")
+		return 0
+	}
+
+	sitesEnabled := filepath.Join(*configDir, "sites-enabled")
+	var files []string
+	if fs.NArg() == 0 {
+		entries, err := os.ReadDir(sitesEnabled)
+		if err != nil {
+			fmt.Printf("Error: Failed to list enabled sites: %v\n", err)
+			return 1
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(sitesEnabled, entry.Name()))
+			}
+		}
+	}
+	for _, site := range fs.Args() {
+		files = append(files, filepath.Join(sitesEnabled, strings.TrimSuffix(site, ".conf")+".conf"))
+	}
+
+	http := httpContext(*configDir)
+	status := 0
+	reports := []*siteAudit{}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Site %s is not enabled (%s not found).\n", strings.TrimSuffix(filepath.Base(file), ".conf"), file)
+			status = max(status, 1)
+			continue
+		}
+		report, err := auditSite(file, *configDir, http)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to parse %v\n", err)
+			status = max(status, 2)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	if *jsonOutput {
+		out, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for i, r := range reports {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Site %s (%s): score %d/100, risk %d\n", r.Site, r.File, r.Score, r.Risk)
+			if len(r.Findings) == 0 {
+				fmt.Println("  No issues found.")
+			}
+			for _, f := range r.Findings {
+				fmt.Printf("  [%2d] %-20s %s (%s)\n", f.Points, f.Check, f.Message, f.Location)
+				fmt.Printf("       %-20s Fix: %s\n", "", f.Remediation)
+			}
+		}
+	}
+
+	if status != 0 {
+		return status
+	}
+	for _, r := range reports {
+		if r.Risk > *threshold {
+			return 3
+		}
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testdata/www.conf was generated with nx2create --site-type=local --hsts
+// --hsts-include-subdomains --csp=strict --frame-options=DENY --nosniff --referrer-policy=no-referrer.
+func TestAuditGeneratedSite(t *testing.T) {
+	report, err := auditSite("testdata/www.conf", "testdata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range report.Findings {
+		switch f.Check {
+		case "hsts", "csp", "frame-options", "content-type-options", "referrer-policy":
+			t.Errorf("finding %s at %s for a header the site sets", f.Check, f.Location)
+		}
+		// The HTTP server only redirects to HTTPS, in location /
+		if strings.HasSuffix(f.Location, "www.conf:1") && f.Check != "server-tokens" {
+			t.Errorf("finding %s for the redirecting HTTP server: %s", f.Check, f.Message)
+		}
+	}
+}
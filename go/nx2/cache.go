@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// cacheDir is a cache directory declared with proxy_cache_path.
+type cacheDir struct {
+	path   string
+	levels []int // lengths of the subdirectory names, from levels=1:2
+}
+
+// cacheEntryPattern matches the files nginx writes in a cache: responses named after the
+// MD5 of their key, and numbered temporary files when use_temp_path=off.
+var cacheEntryPattern = regexp.MustCompile(`^([0-9a-f]{32}|[0-9]{10})$`)
+
+// cachePaths returns the directories of the proxy_cache_path directives of a site file.
+func cachePaths(path string) ([]cacheDir, error) {
+	f, err := nginxconf.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []cacheDir
+	for _, d := range f.Find("proxy_cache_path") {
+		dir := cacheDir{path: d.Arg(0)}
+		for _, arg := range d.Values()[1:] {
+			value, ok := strings.CutPrefix(arg, "levels=")
+			if !ok {
+				continue
+			}
+			for _, level := range strings.Split(value, ":") {
+				n, err := strconv.Atoi(level)
+				if err != nil || n < 1 || n > 2 {
+					return nil, fmt.Errorf("%s: invalid proxy_cache_path levels=%s", d.Pos, value)
+				}
+				dir.levels = append(dir.levels, n)
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// isCacheEntry reports whether a path inside a cache directory fits the layout nginx
+// creates: hexadecimal subdirectories as long as the levels, then cache files.
+func (c cacheDir) isCacheEntry(rel string, isDir bool) bool {
+	parts := strings.Split(rel, string(filepath.Separator))
+	depth := len(parts) - 1
+	if depth < len(c.levels) {
+		name := parts[depth]
+		return isDir && len(name) == c.levels[depth] && strings.Trim(name, "0123456789abcdef") == ""
+	}
+	return depth == len(c.levels) && !isDir && cacheEntryPattern.MatchString(parts[depth])
+}
+
+// purgeCache removes the contents of a cache directory, keeping the directory itself, and
+// returns the number of files and bytes removed. Nothing is removed when the directory
+// holds anything but the files and subdirectories of an nginx cache, so that a
+// proxy_cache_path pointing to a shared directory such as /var/cache is refused.
+func purgeCache(dir cacheDir, dryRun bool) (files int, size int64, err error) {
+	if !filepath.IsAbs(dir.path) || filepath.Dir(filepath.Clean(dir.path)) == "/" {
+		return 0, 0, fmt.Errorf("refusing to purge %s, which is not a dedicated cache directory", dir.path)
+	}
+	err = filepath.WalkDir(dir.path, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir.path {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir.path, path)
+		if !dir.isCacheEntry(rel, d.IsDir()) {
+			return fmt.Errorf("%s is not part of an nginx cache with levels=%s; nothing was removed", path, formatLevels(dir.levels))
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil || dryRun {
+		return files, size, err
+	}
+	entries, err := os.ReadDir(dir.path)
+	if err != nil {
+		return files, size, err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir.path, entry.Name())); err != nil {
+			return files, size, err
+		}
+	}
+	return files, size, nil
+}
+
+// formatLevels formats cache levels as in proxy_cache_path, e.g. 1:2, or none.
+func formatLevels(levels []int) string {
+	if len(levels) == 0 {
+		return "none"
+	}
+	var parts []string
+	for _, n := range levels {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, ":")
+}
+
+// formatBytes formats a size with a binary unit, e.g. 1.5 MiB.
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func runCache(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	dryRun := fs.Bool("dry-run", false, "Print what would be removed without removing it")
+	fs.Parse(args)
+
+	action, site := fs.Arg(0), fs.Arg(1)
+	if *help || action == "" || site == "" {
+		fmt.Println("Usage: nx2 cache [--config-dir=<path>] [--dry-run] purge <site>")
+		fmt.Println("Clear the proxy cache of a site created with nx2create --cache.")
+		fmt.Println("\nActions:")
+		fmt.Println("  purge <site>  Remove every cached response from the directories of the site's proxy_cache_path")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --dry-run            Print what would be removed without removing it")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nnginx treats purged responses as cache misses and fetches them again from the upstream; no reload is")
+		fmt.Println("needed. Directories holding anything but the subdirectories and files of an nginx cache are refused.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 cache purge example")
+		fmt.Println("  nx2 cache --dry-run purge /etc/nginx/sites-available/example.conf")
+		return 0
+	}
+	if action != "purge" {
+		fmt.Printf("Error: Unknown action %s. Use purge.\n", action)
+		return 1
+	}
+
+	path := siteFile(*configDir, site)
+	dirs, err := cachePaths(path)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse %s: %v\n", path, err)
+		return 2
+	}
+	if len(dirs) == 0 {
+		fmt.Printf("Error: %s has no proxy_cache_path; create the site with nx2create --cache.\n", path)
+		return 2
+	}
+
+	status := 0
+	for _, dir := range dirs {
+		files, size, err := purgeCache(dir, *dryRun)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("%s: nothing cached.\n", dir.path)
+		case err != nil:
+			fmt.Printf("Error: Failed to purge %s: %v\n", dir.path, err)
+			status = 1
+		case *dryRun:
+			fmt.Printf("%s: would remove %d cached response(s), %s.\n", dir.path, files, formatBytes(size))
+		default:
+			fmt.Printf("%s: removed %d cached response(s), %s.\n", dir.path, files, formatBytes(size))
+		}
+	}
+	return status
+}
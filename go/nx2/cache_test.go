@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPurgeCache(t *testing.T) {
+	const key = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name   string
+		levels []int
+		files  []string
+		purged bool
+	}{
+		{"levels 1:2", []int{1, 2}, []string{"f/ef/" + key, "f/ef/0000000012", "3/a1/" + key}, true},
+		{"no levels", nil, []string{key}, true},
+		{"empty cache", []int{1, 2}, nil, true},
+		{"shared directory", []int{1, 2}, []string{"apt/archives/lock", "f/ef/" + key}, false},
+		{"file outside the levels", []int{1, 2}, []string{"f/" + key}, false},
+		{"other file name", []int{1, 2}, []string{"f/ef/notes.txt"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("cached"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, _, err := purgeCache(cacheDir{path: dir, levels: tt.levels}, false)
+			entries, _ := os.ReadDir(dir)
+			if tt.purged {
+				if err != nil || files != len(tt.files) || len(entries) != 0 {
+					t.Errorf("purged %d files with %v, %d entries left; want %d files purged", files, err, len(entries), len(tt.files))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "nothing was removed") {
+				t.Errorf("purge returned %v, want a refusal", err)
+			}
+			if len(entries) == 0 {
+				t.Error("files were removed from a directory that is not a cache")
+			}
+		})
+	}
+
+	if _, _, err := purgeCache(cacheDir{path: "/var"}, true); err == nil {
+		t.Error("purge of /var was accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// loadFile parses a config file and its includes, resolving relative includes from configDir.
+func loadFile(path, configDir string) ([]*nginxconf.Directive, error) {
+	config, err := nginxconf.Load(path, nginxconf.LoadOptions{Prefix: configDir})
+	if err != nil {
+		return nil, err
+	}
+	return config.Directives(), nil
+}
+
+// enabledConfig parses the configuration nginx would load: nginx.conf with its includes
+// when present, otherwise the files in sites-enabled and conf.d.
+func enabledConfig(configDir string) ([]*nginxconf.Directive, error) {
+	mainConf := filepath.Join(configDir, "nginx.conf")
+	if _, err := os.Stat(mainConf); err == nil {
+		return loadFile(mainConf, configDir)
+	}
+
+	var directives []*nginxconf.Directive
+	for _, pattern := range []string{"conf.d/*.conf", "sites-enabled/*"} {
+		files, _ := filepath.Glob(filepath.Join(configDir, pattern))
+		for _, file := range files {
+			if info, err := os.Stat(file); err != nil || info.IsDir() {
+				continue
+			}
+			parsed, err := loadFile(file, configDir)
+			if err != nil {
+				return nil, err
+			}
+			directives = append(directives, parsed...)
+		}
+	}
+	return directives, nil
+}
+
+// dumpConfig parses the output of nginx -T.
+func dumpConfig(dump []byte) ([]*nginxconf.Directive, error) {
+	config, err := nginxconf.LoadDump(dump)
+	if err != nil {
+		return nil, err
+	}
+	return config.Directives(), nil
+}
+
+// findServers returns the http server blocks, skipping stream, mail and upstream contexts.
+func findServers(directives []*nginxconf.Directive) []*nginxconf.Directive {
+	var servers []*nginxconf.Directive
+	for _, d := range nginxconf.Expand(directives) {
+		switch {
+		case !d.IsBlock, d.Name == "stream", d.Name == "mail", d.Name == "upstream":
+		case d.Name == "server":
+			servers = append(servers, d)
+		default:
+			servers = append(servers, findServers(d.Block)...)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// listen is a listen socket of a server block.
+type listen struct {
+	addr          string // normalized address:port, e.g. *:443 or [::]:80
+	defaultServer bool
+	ssl           bool
+	proxyProtocol bool
+	reusePort     bool
+	d             *nginxconf.Directive
+}
+
+// server holds the names and listen sockets of a server block.
+type server struct {
+	d       *nginxconf.Directive
+	names   []string
+	listens []listen
+}
+
+// conflict is a problem found across the enabled server blocks.
+type conflict struct {
+	Kind      string   `json:"kind"`
+	Listen    string   `json:"listen"`
+	Message   string   `json:"message"`
+	Locations []string `json:"locations"`
+}
+
+// normalizeListen turns the address of a listen directive into address:port,
+// using * for any IPv4 address and port 80 when no port is given.
+func normalizeListen(addr string) string {
+	if strings.HasPrefix(addr, "unix:") {
+		return addr
+	}
+
+	host, port := "*", "80"
+	switch {
+	case strings.HasPrefix(addr, "["):
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return addr
+		}
+		host = addr[:end+1]
+		if rest := addr[end+1:]; strings.HasPrefix(rest, ":") {
+			port = rest[1:]
+		}
+	case strings.Contains(addr, ":"):
+		i := strings.LastIndex(addr, ":")
+		host, port = addr[:i], addr[i+1:]
+	case strings.Trim(addr, "0123456789") == "":
+		port = addr
+	default:
+		host = addr
+	}
+	if host == "0.0.0.0" {
+		host = "*"
+	}
+	return host + ":" + port
+}
+
+// newServer collects the names and listen sockets of a server block.
+func newServer(d *nginxconf.Directive) *server {
+	s := &server{d: d}
+	for _, l := range nginxconf.Find(d.Block, "listen") {
+		if len(l.Args) == 0 {
+			continue
+		}
+		ls := listen{addr: normalizeListen(l.Arg(0)), d: l}
+		for _, param := range l.Values()[1:] {
+			switch param {
+			case "default_server", "default":
+				ls.defaultServer = true
+			case "ssl":
+				ls.ssl = true
+			case "proxy_protocol":
+				ls.proxyProtocol = true
+			case "reuseport":
+				ls.reusePort = true
+			}
+		}
+		s.listens = append(s.listens, ls)
+	}
+	if len(s.listens) == 0 {
+		s.listens = []listen{{addr: "*:80", d: d}}
+	}
+
+	for _, n := range nginxconf.Find(d.Block, "server_name") {
+		for _, name := range n.Values() {
+			if !strings.HasPrefix(name, "~") {
+				name = strings.ToLower(name)
+			}
+			s.names = append(s.names, name)
+		}
+	}
+	if len(s.names) == 0 {
+		s.names = []string{""}
+	}
+	return s
+}
+
+// locations returns the positions of listen directives, one per server.
+func locations(listens []listen) []string {
+	var positions []string
+	seen := map[*nginxconf.Directive]bool{}
+	for _, l := range listens {
+		if !seen[l.d] {
+			positions = append(positions, l.d.Pos.String())
+			seen[l.d] = true
+		}
+	}
+	return positions
+}
+
+// findConflicts builds the map of listen socket and server name to server blocks and
+// reports duplicate names, several default_server or reuseport flags and ssl or
+// proxy_protocol mismatches on a socket.
+func findConflicts(servers []*server) []conflict {
+	var conflicts []conflict
+
+	byName := map[string][]*server{}
+	byAddr := map[string][]listen{}
+	for _, s := range servers {
+		seen := map[string]bool{}
+		for _, l := range s.listens {
+			byAddr[l.addr] = append(byAddr[l.addr], l)
+			for _, name := range s.names {
+				key := l.addr + " " + name
+				// Regex names are tried in order and never conflict
+				if seen[key] || strings.HasPrefix(name, "~") {
+					continue
+				}
+				seen[key] = true
+				byName[key] = append(byName[key], s)
+			}
+		}
+	}
+
+	for key, claimed := range byName {
+		if len(claimed) < 2 {
+			continue
+		}
+		addr, name, _ := strings.Cut(key, " ")
+		var positions []string
+		for _, s := range claimed {
+			positions = append(positions, s.d.Pos.String())
+		}
+		conflicts = append(conflicts, conflict{
+			Kind:      "server_name",
+			Listen:    addr,
+			Message:   fmt.Sprintf("%s: server name %q is claimed by %s; nginx ignores all but the first", addr, name, strings.Join(positions, ", ")),
+			Locations: positions,
+		})
+	}
+
+	for addr, listens := range byAddr {
+		var defaults, reused, ssl, plain, proxied, direct []listen
+		for _, l := range listens {
+			if l.defaultServer {
+				defaults = append(defaults, l)
+			}
+			if l.reusePort {
+				reused = append(reused, l)
+			}
+			if l.ssl {
+				ssl = append(ssl, l)
+			} else {
+				plain = append(plain, l)
+			}
+			if l.proxyProtocol {
+				proxied = append(proxied, l)
+			} else {
+				direct = append(direct, l)
+			}
+		}
+
+		if positions := locations(defaults); len(positions) > 1 {
+			conflicts = append(conflicts, conflict{
+				Kind:      "default_server",
+				Listen:    addr,
+				Message:   fmt.Sprintf("%s: default_server is set in %s", addr, strings.Join(positions, ", ")),
+				Locations: positions,
+			})
+		}
+
+		// reuseport opens the socket, so nginx rejects it on more than one listen of a socket
+		if positions := locations(reused); len(positions) > 1 {
+			conflicts = append(conflicts, conflict{
+				Kind:      "reuseport",
+				Listen:    addr,
+				Message:   fmt.Sprintf("%s: reuseport is set in %s; nginx accepts it on one listen per socket", addr, strings.Join(positions, ", ")),
+				Locations: positions,
+			})
+		}
+
+		if len(ssl) > 0 && len(plain) > 0 {
+			positions := append(locations(ssl), locations(plain)...)
+			conflicts = append(conflicts, conflict{
+				Kind:   "ssl",
+				Listen: addr,
+				Message: fmt.Sprintf("%s: ssl is set in %s but not in %s; nginx enables ssl for every server on this socket",
+					addr, strings.Join(locations(ssl), ", "), strings.Join(locations(plain), ", ")),
+				Locations: positions,
+			})
+		}
+
+		if len(proxied) > 0 && len(direct) > 0 {
+			positions := append(locations(proxied), locations(direct)...)
+			conflicts = append(conflicts, conflict{
+				Kind:   "proxy_protocol",
+				Listen: addr,
+				Message: fmt.Sprintf("%s: proxy_protocol is set in %s but not in %s; nginx expects the PROXY protocol from every client on this socket",
+					addr, strings.Join(locations(proxied), ", "), strings.Join(locations(direct), ", ")),
+				Locations: positions,
+			})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Message < conflicts[j].Message
+	})
+	return conflicts
+}
+
+// realPath resolves symbolic links so that sites-enabled links match their sites-available target.
+func realPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func runConflicts(args []string) int {
+	fs := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	with := fs.String("with", "", "Check a config file as if it were enabled, reporting only its conflicts")
+	list := fs.Bool("list", false, "Print the map of listen socket and server name to file")
+	jsonOutput := fs.Bool("json", false, "Print the conflicts as JSON")
+	fs.Parse(args)
+
+	if *help {
+		fmt.Println("Usage: nx2 conflicts [--config-dir=<path>] [--with=<file>] [--list] [--json]")
+		fmt.Println("Parse every enabled config and report server names claimed by more than one server on the same")
+		fmt.Println("listen address:port, several default_server or reuseport flags and ssl or proxy_protocol mismatches on the")
+		fmt.Println("same socket.")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --with=<file>        Check a config file as if it were enabled, reporting only its conflicts")
+		fmt.Println("  --list               Print the map of listen address:port and server name to file")
+		fmt.Println("  --json               Print the conflicts as JSON")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 conflicts")
+		fmt.Println("  nx2 conflicts --with=/etc/nginx/sites-available/example.conf")
+		fmt.Println("\nExit status is 3 when conflicts are found.")
+		return 0
+	}
+
+	// Check if configuration directory exists
+	if _, err := os.Stat(*configDir); os.IsNotExist(err) {
+		fmt.Printf("Error: Configuration directory %s does not exist.\n", *configDir)
+		return 1
+	}
+
+	directives, err := enabledConfig(*configDir)
+	if err != nil {
+		fmt.Printf("Error: Failed to parse configuration: %v\n", err)
+		return 2
+	}
+	var servers []*server
+	loaded := map[string]bool{}
+	for _, d := range findServers(directives) {
+		servers = append(servers, newServer(d))
+		loaded[realPath(d.Pos.File)] = true
+	}
+
+	if *with != "" && !loaded[realPath(*with)] {
+		directives, err := loadFile(*with, *configDir)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse %s: %v\n", *with, err)
+			return 2
+		}
+		for _, d := range findServers(directives) {
+			servers = append(servers, newServer(d))
+		}
+	}
+
+	if *list {
+		var entries []string
+		for _, s := range servers {
+			for _, l := range s.listens {
+				for _, name := range s.names {
+					entries = append(entries, fmt.Sprintf("%-24s %-40s %s", l.addr, name, s.d.Pos))
+				}
+			}
+		}
+		sort.Strings(entries)
+		for _, entry := range entries {
+			fmt.Println(entry)
+		}
+		fmt.Println()
+	}
+
+	conflicts := findConflicts(servers)
+	if *with != "" {
+		var own []conflict
+		withPath := realPath(*with)
+		for _, c := range conflicts {
+			for _, position := range c.Locations {
+				if realPath(position[:strings.LastIndex(position, ":")]) == withPath {
+					own = append(own, c)
+					break
+				}
+			}
+		}
+		conflicts = own
+	}
+
+	if *jsonOutput {
+		if conflicts == nil {
+			conflicts = []conflict{}
+		}
+		out, _ := json.MarshalIndent(conflicts, "", "  ")
+		fmt.Println(string(out))
+	} else if len(conflicts) == 0 {
+		fmt.Println("No conflicts found.")
+	} else {
+		fmt.Println("Conflicts found:")
+		for _, c := range conflicts {
+			fmt.Printf("- %s\n", c.Message)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeListen(t *testing.T) {
+	tests := []struct{ addr, want string }{
+		{"80", "*:80"},
+		{"*:80", "*:80"},
+		{"0.0.0.0:80", "*:80"},
+		{"443", "*:443"},
+		{"10.0.0.1", "10.0.0.1:80"},
+		{"10.0.0.1:8080", "10.0.0.1:8080"},
+		{"localhost:8080", "localhost:8080"},
+		{"[::]:80", "[::]:80"},
+		{"[::1]", "[::1]:80"},
+		{"unix:/run/nginx.sock", "unix:/run/nginx.sock"},
+	}
+	for _, tt := range tests {
+		if got := normalizeListen(tt.addr); got != tt.want {
+			t.Errorf("normalizeListen(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string // kind and socket of each conflict
+	}{
+		{"same name on 80, *:80 and 0.0.0.0:80", `server {
+    listen 80;
+    server_name a.test;
+}
+server {
+    listen *:80;
+    server_name a.test;
+}
+server {
+    listen 0.0.0.0:80;
+    server_name a.test;
+}
+`, []string{"server_name *:80"}},
+		{"IPv6 socket is separate", `server {
+    listen 80 default_server;
+    server_name a.test;
+}
+server {
+    listen [::]:80 default_server;
+    server_name a.test;
+}
+`, nil},
+		{"regex names never conflict", `server {
+    listen 80;
+    server_name ~^a\.test$;
+}
+server {
+    listen 80;
+    server_name ~^a\.test$;
+}
+`, nil},
+		{"two default servers", `server {
+    listen 443 ssl default_server;
+}
+server {
+    listen 443 ssl default_server;
+    server_name b.test;
+}
+`, []string{"default_server *:443"}},
+		{"ssl mismatch", `server {
+    listen 443 ssl;
+    server_name a.test;
+}
+server {
+    listen 443;
+    server_name b.test;
+}
+`, []string{"ssl *:443"}},
+		{"proxy_protocol mismatch", `server {
+    listen 8443 ssl proxy_protocol;
+    server_name a.test;
+}
+server {
+    listen 8443 ssl;
+    server_name b.test;
+}
+`, []string{"proxy_protocol *:8443"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflicts := findConflicts(parseServers(t, tt.src))
+			var got []string
+			for _, c := range conflicts {
+				got = append(got, c.Kind+" "+c.Listen)
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("conflicts %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The messages name the socket and the listen directives on both sides
+	conflicts := findConflicts(parseServers(t, "server {\n    listen 443 ssl;\n    server_name a.test;\n}\nserver {\n    listen 443;\n    server_name b.test;\n}\n"))
+	want := `*:443: ssl is set in test.conf:2 but not in test.conf:6; nginx enables ssl for every server on this socket`
+	if len(conflicts) != 1 || conflicts[0].Message != want {
+		t.Errorf("ssl conflict %v, want %q", conflicts, want)
+	}
+	conflicts = findConflicts(parseServers(t, "server {\n    listen 80 proxy_protocol;\n    server_name a.test;\n}\nserver {\n    listen 80;\n    server_name b.test;\n}\n"))
+	want = `*:80: proxy_protocol is set in test.conf:2 but not in test.conf:6; nginx expects the PROXY protocol from every client on this socket`
+	if len(conflicts) != 1 || conflicts[0].Message != want {
+		t.Errorf("proxy_protocol conflict %v, want %q", conflicts, want)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// defaultSite is the site of the catch-all server installed by nx2 default.
+const defaultSite = "nx2-default"
+
+// defaultFlagPattern matches the default_server parameter of a listen directive, and its
+// old spelling default.
+var defaultFlagPattern = regexp.MustCompile(`\s+(default_server|default)\b`)
+
+// socketDefault is the server nginx uses on a listen socket for requests whose Host
+// matches no server_name.
+type socketDefault struct {
+	addr     string
+	server   *server
+	listen   listen
+	explicit bool // set with default_server, not only the first server loaded
+}
+
+// effectiveDefaults returns the default server of every listen socket: the server with
+// default_server, otherwise the first server loaded on the socket.
+func effectiveDefaults(servers []*server) []socketDefault {
+	byAddr := map[string]*socketDefault{}
+	var addrs []string
+	for _, s := range servers {
+		for _, l := range s.listens {
+			current, ok := byAddr[l.addr]
+			if !ok {
+				byAddr[l.addr] = &socketDefault{l.addr, s, l, l.defaultServer}
+				addrs = append(addrs, l.addr)
+			} else if l.defaultServer && !current.explicit {
+				*current = socketDefault{l.addr, s, l, true}
+			}
+		}
+	}
+	sort.Strings(addrs)
+	var defaults []socketDefault
+	for _, addr := range addrs {
+		defaults = append(defaults, *byAddr[addr])
+	}
+	return defaults
+}
+
+// listenEdit adds or removes the default_server parameter of a listen directive.
+type listenEdit struct {
+	l   listen
+	add bool
+}
+
+// moveDefault returns the edits making the servers of a file the default of the sockets
+// they listen on: default_server is added to one listen of the file per socket and
+// removed from the listens of every other server on those sockets.
+func moveDefault(servers []*server, file string) ([]listenEdit, error) {
+	target := realPath(file)
+	chosen := map[string]listen{}
+	for _, s := range servers {
+		if realPath(s.d.Pos.File) != target {
+			continue
+		}
+		for _, l := range s.listens {
+			if l.d.Name != "listen" {
+				return nil, fmt.Errorf("the server at %s has no listen directive", s.d.Pos)
+			}
+			if c, ok := chosen[l.addr]; !ok || (!c.defaultServer && l.defaultServer) {
+				chosen[l.addr] = l
+			}
+		}
+	}
+	if len(chosen) == 0 {
+		return nil, fmt.Errorf("%s has no enabled server block", file)
+	}
+
+	var edits []listenEdit
+	for _, s := range servers {
+		for _, l := range s.listens {
+			c, ok := chosen[l.addr]
+			switch {
+			case !ok:
+			case c.d == l.d && !l.defaultServer:
+				edits = append(edits, listenEdit{l, true})
+			case c.d != l.d && l.defaultServer:
+				edits = append(edits, listenEdit{l, false})
+			}
+		}
+	}
+	return edits, nil
+}
+
+// editListenLine adds or removes default_server in the listen directive starting at a
+// column of a line, leaving the rest of the line as written.
+func editListenLine(line string, column int, add bool) (string, error) {
+	start := column - 1
+	if start < 0 || start >= len(line) || !strings.HasPrefix(line[start:], "listen") {
+		return "", errors.New("listen directive not found where it was parsed")
+	}
+	end := strings.IndexByte(line[start:], ';')
+	if end < 0 {
+		return "", errors.New("the listen directive spans several lines; edit it by hand")
+	}
+	end += start
+	statement := line[start:end]
+	if add {
+		statement += " default_server"
+	} else {
+		statement = defaultFlagPattern.ReplaceAllString(statement, "")
+	}
+	return line[:start] + statement + line[end:], nil
+}
+
+// editListens applies the edits in place, changing only the lines of the edited listen
+// directives, and returns the previous content of the edited files.
+func editListens(edits []listenEdit) (map[string][]byte, error) {
+	byFile := map[string][]listenEdit{}
+	var files []string
+	for _, e := range edits {
+		file := e.l.d.Pos.File
+		if byFile[file] == nil {
+			files = append(files, file)
+		}
+		byFile[file] = append(byFile[file], e)
+	}
+
+	backup := map[string][]byte{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			restoreFiles(backup)
+			return nil, err
+		}
+		lines := strings.Split(string(content), "\n")
+		fileEdits := byFile[file]
+		// Edit from the end of the file so that earlier columns stay valid
+		sort.Slice(fileEdits, func(i, j int) bool {
+			pi, pj := fileEdits[i].l.d.Pos, fileEdits[j].l.d.Pos
+			return pi.Line > pj.Line || pi.Line == pj.Line && pi.Column > pj.Column
+		})
+		for _, e := range fileEdits {
+			pos := e.l.d.Pos
+			if pos.Line > len(lines) {
+				restoreFiles(backup)
+				return nil, fmt.Errorf("%s: listen directive not found where it was parsed", pos)
+			}
+			edited, err := editListenLine(lines[pos.Line-1], pos.Column, e.add)
+			if err != nil {
+				restoreFiles(backup)
+				return nil, fmt.Errorf("%s: %v", pos, err)
+			}
+			lines[pos.Line-1] = edited
+		}
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(file); err == nil {
+			mode = info.Mode().Perm()
+		}
+		backup[file] = content
+		if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")), mode); err != nil {
+			restoreFiles(backup)
+			return nil, err
+		}
+	}
+	return backup, nil
+}
+
+// restoreFiles writes back the content saved by editListens; a nil content removes the
+// file, which did not exist before.
+func restoreFiles(backup map[string][]byte) {
+	for file, content := range backup {
+		if content == nil {
+			os.Remove(file)
+		} else {
+			os.WriteFile(file, content, 0644)
+		}
+	}
+}
+
+// defaultConfig returns the catch-all server. Without a certificate, TLS handshakes are
+// rejected with ssl_reject_handshake (nginx 1.19.4+) instead of presenting the
+// certificate of another site.
+func defaultConfig(path string, ipv6, page bool, cert, key string) *nginxconf.File {
+	var listens []*nginxconf.Directive
+	for _, port := range []string{"80", "443"} {
+		addrs := []string{port}
+		if ipv6 {
+			addrs = append(addrs, "[::]:"+port)
+		}
+		for _, addr := range addrs {
+			args := []string{addr, "default_server"}
+			if port == "443" {
+				args = []string{addr, "ssl", "default_server"}
+			}
+			listens = append(listens, nginxconf.New("listen", args...))
+		}
+	}
+
+	children := append(listens,
+		nginxconf.New("server_name", "_"),
+		nginxconf.New("access_log", "/var/log/nginx/"+defaultSite+"_access.log"))
+	tls := []*nginxconf.Directive{nginxconf.New("ssl_reject_handshake", "on")}
+	if cert != "" {
+		tls = []*nginxconf.Directive{
+			nginxconf.New("ssl_certificate", cert),
+			nginxconf.New("ssl_certificate_key", key),
+		}
+	}
+	tls[0].Blank = true
+	children = append(children, tls...)
+	response := []*nginxconf.Directive{nginxconf.New("return", "444")}
+	if page {
+		response = []*nginxconf.Directive{
+			nginxconf.New("default_type", "text/plain"),
+			nginxconf.New("return", "404", "Not found"),
+		}
+	}
+	response[0].Blank = true
+	children = append(children, response...)
+
+	f := &nginxconf.File{Path: path}
+	f.Directives = append(f.Directives,
+		nginxconf.NewComment("Catch-all server managed by nx2 default: requests whose Host matches no site are"),
+		nginxconf.NewComment("answered here instead of by the first site nginx loaded."),
+		nginxconf.NewBlock("server", nil, children...))
+	return f
+}
+
+// enabledServers returns the enabled server blocks in load order.
+func enabledServers(configDir string) ([]*server, error) {
+	directives, err := enabledConfig(configDir)
+	if err != nil {
+		return nil, err
+	}
+	var servers []*server
+	for _, d := range findServers(directives) {
+		servers = append(servers, newServer(d))
+	}
+	return servers, nil
+}
+
+// siteName returns the site of a config file, e.g. example for sites-enabled/example.conf.
+func siteName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), ".conf")
+}
+
+func runDefault(args []string) int {
+	fs := flag.NewFlagSet("default", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	ipv6 := fs.Bool("ipv6", false, "Also catch requests on the IPv6 sockets [::]:80 and [::]:443")
+	page := fs.Bool("page", false, "Return a neutral 404 page instead of closing the connection (444)")
+	cert := fs.String("cert", "", "Certificate presented by the catch-all server when nginx lacks ssl_reject_handshake")
+	key := fs.String("key", "", "Private key of --cert")
+	noReload := fs.Bool("no-reload", false, "Do not reload nginx after the change")
+	fs.Parse(args)
+
+	action, site := fs.Arg(0), fs.Arg(1)
+	if *help || action == "" || (action == "move" && site == "") {
+		fmt.Println("Usage: nx2 default [--config-dir=<path>] [--ipv6] [--page] [--cert=<path> --key=<path>] [--no-reload] install|remove|show|move [site]")
+		fmt.Println("Manage the server answering requests whose Host matches no site.")
+		fmt.Println("\nActions:")
+		fmt.Println("  install      Install a catch-all server on 80 and 443 and make it the default of those sockets")
+		fmt.Println("  remove       Remove the catch-all server")
+		fmt.Println("  show         Print the effective default server of every listen socket")
+		fmt.Println("  move <site>  Make an enabled site the default of the sockets it listens on")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --ipv6               Also catch requests on [::]:80 and [::]:443")
+		fmt.Println("  --page               Return a neutral 404 page instead of closing the connection (444)")
+		fmt.Println("  --cert=<path>        Certificate presented on 443 instead of rejecting the TLS handshake, for nginx")
+		fmt.Println("                       older than 1.19.4; use a self-signed certificate for a name no site uses")
+		fmt.Println("  --key=<path>         Private key of --cert")
+		fmt.Println("  --no-reload          Do not reload nginx after the change")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nThe catch-all server is stored in <config-dir>/sites-available/nx2-default.conf and enabled in")
+		fmt.Println("sites-enabled. install and move remove default_server from the other servers on the same sockets,")
+		fmt.Println("editing only their listen lines; if nginx -t fails, every edited file is restored.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 default show")
+		fmt.Println("  nx2 default --ipv6 install")
+		fmt.Println("  nx2 default move intranet")
+		return 0
+	}
+
+	available := filepath.Join(*configDir, "sites-available", defaultSite+".conf")
+	enabled := filepath.Join(*configDir, "sites-enabled", defaultSite+".conf")
+
+	switch action {
+	case "show":
+		servers, err := enabledServers(*configDir)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse configuration: %v\n", err)
+			return 2
+		}
+		implicit := 0
+		for _, d := range effectiveDefaults(servers) {
+			how := "default_server"
+			if !d.explicit {
+				how = "first loaded"
+				implicit++
+			}
+			fmt.Printf("%-24s %-24s %-16s %s\n", d.addr, siteName(d.server.d.Pos.File), how, d.listen.d.Pos)
+		}
+		if implicit > 0 {
+			fmt.Printf("\n%d socket(s) have no default_server; requests with unknown names reach the first site loaded.\n", implicit)
+			fmt.Println("Run 'nx2 default install' to answer them with a catch-all server.")
+		}
+		return 0
+	case "install", "remove", "move":
+	default:
+		fmt.Printf("Error: Unknown action %s. Use install, remove, show or move.\n", action)
+		return 1
+	}
+
+	backup := map[string][]byte{}
+	linked := false
+	switch action {
+	case "install":
+		if (*cert == "") != (*key == "") {
+			fmt.Println("Error: --cert and --key must be given together.")
+			return 1
+		}
+		if *cert == "" {
+			version, err := nginxVersion()
+			if err != nil {
+				fmt.Printf("Warning: Cannot check ssl_reject_handshake support: %v\n", err)
+			} else if !versionAtLeast(version, "1.19.4") {
+				fmt.Printf("Error: nginx %s lacks ssl_reject_handshake (1.19.4+); give a self-signed certificate with --cert and --key.\n", version)
+				return 1
+			}
+		}
+
+		previous, err := os.ReadFile(available)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Error: Failed to read %s: %v\n", available, err)
+			return 1
+		}
+		if err := os.MkdirAll(filepath.Dir(available), 0755); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if err := defaultConfig(available, *ipv6, *page, *cert, *key).WriteFile(); err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", available, err)
+			return 1
+		}
+		backup[available] = previous
+		if _, err := os.Lstat(enabled); err != nil {
+			if err := os.Symlink(available, enabled); err != nil {
+				fmt.Printf("Error: Failed to enable %s: %v\n", defaultSite, err)
+				restoreFiles(backup)
+				return 1
+			}
+			linked = true
+		}
+		fmt.Printf("Catch-all server written to %s\n", available)
+		site = enabled
+	case "remove":
+		if _, err := os.Stat(available); err != nil {
+			fmt.Println("Nothing to remove; the catch-all server is not installed.")
+			return 0
+		}
+		previous, err := os.ReadFile(available)
+		if err != nil {
+			fmt.Printf("Error: Failed to read %s: %v\n", available, err)
+			return 1
+		}
+		os.Remove(enabled)
+		if err := os.Remove(available); err != nil {
+			fmt.Printf("Error: Failed to remove %s: %v\n", available, err)
+			return 1
+		}
+		backup[available] = previous
+		fmt.Println("Catch-all server removed; requests with unknown names reach the first site loaded on each socket.")
+	case "move":
+		site = siteFile(*configDir, site)
+	}
+
+	// rollback undoes the changes when editing or reloading fails
+	rollback := func() {
+		if len(backup) == 0 {
+			return
+		}
+		restoreFiles(backup)
+		if linked {
+			os.Remove(enabled)
+		}
+		if action == "remove" {
+			os.Symlink(available, enabled)
+		}
+		fmt.Println("Previous configuration restored.")
+	}
+
+	if action != "remove" {
+		servers, err := enabledServers(*configDir)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse configuration: %v\n", err)
+			rollback()
+			return 2
+		}
+		edits, err := moveDefault(servers, site)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			rollback()
+			return 2
+		}
+		edited, err := editListens(edits)
+		if err != nil {
+			fmt.Printf("Error: Failed to edit listen directives: %v\n", err)
+			rollback()
+			return 1
+		}
+		for file, content := range edited {
+			backup[file] = content
+		}
+		for _, e := range edits {
+			if e.add {
+				fmt.Printf("default_server added to %s (%s)\n", e.l.d.Pos, e.l.addr)
+			} else {
+				fmt.Printf("default_server removed from %s (%s)\n", e.l.d.Pos, e.l.addr)
+			}
+		}
+		if action == "move" && len(edits) == 0 {
+			fmt.Printf("%s is already the default of its sockets.\n", siteName(site))
+			return 0
+		}
+	}
+
+	if *noReload {
+		return 0
+	}
+	if err := reloadNginx(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		rollback()
+		return 3
+	}
+	fmt.Println("Nginx reloaded.")
+	return 0
+}
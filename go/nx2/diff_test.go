@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numbered returns n lines line1 to lineN.
+func numbered(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "line%d\n", i)
+	}
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name, old, new, want string
+	}{
+		{"same text", "a\nb\n", "a\nb\n", ""},
+		{"first line", "a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", `--- old
++++ new
+@@ -1,4 +1,4 @@
+-a
++A
+ b
+ c
+ d
+`},
+		{"newline removed at the end", "a\nb\nc\nd\ne\n", "a\nb\nc\nd\ne", `--- old
++++ new
+@@ -2,4 +2,4 @@
+ b
+ c
+ d
+-e
++e
+\ No newline at end of file
+`},
+		{"last line without newline", "a\nb\nc\nd\ne", "a\nb\nc\nd\nE", `--- old
++++ new
+@@ -2,4 +2,4 @@
+ b
+ c
+ d
+-e
+\ No newline at end of file
++E
+\ No newline at end of file
+`},
+		{"lines added to an empty file", "", "a\n", `--- old
++++ new
+@@ -0,0 +1,1 @@
++a
+`},
+		// Changes 6 unchanged lines apart share the context, as in diff -u
+		{"one hunk", numbered(12), strings.NewReplacer("line2\n", "two\n", "line9\n", "nine\n").Replace(numbered(12)), `--- old
++++ new
+@@ -1,12 +1,12 @@
+ line1
+-line2
++two
+ line3
+ line4
+ line5
+ line6
+ line7
+ line8
+-line9
++nine
+ line10
+ line11
+ line12
+`},
+		{"two hunks", numbered(13), strings.NewReplacer("line2\n", "two\n", "line10\n", "ten\n").Replace(numbered(13)), `--- old
++++ new
+@@ -1,5 +1,5 @@
+ line1
+-line2
++two
+ line3
+ line4
+ line5
+@@ -7,7 +7,7 @@
+ line7
+ line8
+ line9
+-line10
++ten
+ line11
+ line12
+ line13
+`},
+	}
+	for _, tt := range tests {
+		if got := unifiedDiff("old", "new", tt.old, tt.new); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
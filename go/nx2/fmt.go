@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// siteFile returns the config file of a site: a path when the argument contains a slash,
+// otherwise sites-available/<site>.conf.
+func siteFile(configDir, site string) string {
+	if strings.Contains(site, "/") {
+		return site
+	}
+	return filepath.Join(configDir, "sites-available", strings.TrimSuffix(site, ".conf")+".conf")
+}
+
+// availableSites returns the files in sites-available.
+func availableSites(configDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(configDir, "sites-available"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, filepath.Join(configDir, "sites-available", entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// formatConfig parses a config and prints it in the canonical style.
+func formatConfig(content []byte, path string) ([]byte, error) {
+	f, err := nginxconf.Parse(content, path)
+	if err != nil {
+		return nil, err
+	}
+	return f.Bytes(), nil
+}
+
+func runFmt(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	all := fs.Bool("all", false, "Format every site in sites-available")
+	check := fs.Bool("check", false, "Only report files that are not formatted")
+	showDiff := fs.Bool("diff", false, "Print the changes as a unified diff instead of writing them")
+	fs.Parse(args)
+
+	if *help || (fs.NArg() == 0 && !*all) {
+		fmt.Println("Usage: nx2 fmt [--config-dir=<path>] [--check] [--diff] <site>... | --all | -")
+		fmt.Println("Rewrite Nginx configs in the canonical style: 4 spaces per block level, one directive per line,")
+		fmt.Println("comments kept in place and at most one empty line between directives.")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --all                Format every site in sites-available")
+		fmt.Println("  --check              Do not write files; list the files that are not formatted")
+		fmt.Println("  --diff               Do not write files; print the changes as a unified diff")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nA site is a name in sites-available (example or example.conf) or a path to a file;")
+		fmt.Println("- reads a config from stdin and writes the formatted config to stdout.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 fmt example")
+		fmt.Println("  nx2 fmt --all --check")
+		fmt.Println("  nx2 fmt --diff /etc/nginx/nginx.conf")
+		fmt.Println("  cat site.conf | nx2 fmt -")
+		fmt.Println("\nExit status is 3 with --check when files are not formatted and 2 when a file cannot be parsed.")
+		return 0
+	}
+
+	if fs.NArg() == 1 && fs.Arg(0) == "-" {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Printf("Error: Failed to read stdin: %v\n", err)
+			return 1
+		}
+		formatted, err := formatConfig(content, "<stdin>")
+		if err != nil {
+			fmt.Printf("Error: Failed to parse configuration: %v\n", err)
+			return 2
+		}
+		changed := string(formatted) != string(content)
+		switch {
+		case *showDiff:
+			fmt.Print(unifiedDiff("<stdin>", "<stdin> (formatted)", string(content), string(formatted)))
+		case *check:
+			if changed {
+				fmt.Println("<stdin>")
+			}
+		default:
+			os.Stdout.Write(formatted)
+		}
+		if *check && changed {
+			return 3
+		}
+		return 0
+	}
+
+	var files []string
+	if *all {
+		sites, err := availableSites(*configDir)
+		if err != nil {
+			fmt.Printf("Error: Failed to list sites: %v\n", err)
+			return 1
+		}
+		files = append(files, sites...)
+	}
+	for _, site := range fs.Args() {
+		files = append(files, siteFile(*configDir, site))
+	}
+
+	status, unformatted := 0, false
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error: Configuration file %s not found.\n", file)
+			status = max(status, 1)
+			continue
+		}
+		formatted, err := formatConfig(content, file)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse %v\n", err)
+			status = max(status, 2)
+			continue
+		}
+		if string(formatted) == string(content) {
+			continue
+		}
+
+		switch {
+		case *showDiff:
+			fmt.Print(unifiedDiff(file, file+" (formatted)", string(content), string(formatted)))
+		case *check:
+			fmt.Println(file)
+		default:
+			info, err := os.Stat(file)
+			if err == nil {
+				err = os.WriteFile(file, formatted, info.Mode().Perm())
+			}
+			if err != nil {
+				fmt.Printf("Error: Failed to write %s: %v\n", file, err)
+				status = max(status, 1)
+				continue
+			}
+			fmt.Printf("Formatted %s\n", file)
+		}
+		unformatted = true
+	}
+	if status == 0 && *check && unformatted {
+		return 3
+	}
+	return status
+}
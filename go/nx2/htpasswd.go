@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// htpasswdEntry is a user of an htpasswd file.
+type htpasswdEntry struct {
+	user string
+	hash string
+}
+
+// htpasswdFile returns the htpasswd file of a site: a path when the argument contains a
+// slash, otherwise <config-dir>/htpasswd/<site>, the default used by nx2create --basic-auth.
+func htpasswdFile(configDir, site string) string {
+	if strings.Contains(site, "/") {
+		return site
+	}
+	return filepath.Join(configDir, "htpasswd", site)
+}
+
+// readHtpasswd reads the entries of an htpasswd file, skipping comments and empty lines.
+func readHtpasswd(path string) ([]htpasswdEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []htpasswdEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, _ := strings.Cut(line, ":")
+		entries = append(entries, htpasswdEntry{user, hash})
+	}
+	return entries, nil
+}
+
+// nginxGroups are the groups the nginx workers run as on Debian, Red Hat and Arch.
+var nginxGroups = []string{"www-data", "nginx", "http"}
+
+// writeHtpasswd replaces an htpasswd file atomically, keeping the mode and owner of an
+// existing file. New files are 0640 and belong to the nginx group, so that the workers can
+// read the hashes but other users cannot; without that group, a hint is printed.
+func writeHtpasswd(path string, entries []htpasswdEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var content strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&content, "%s:%s\n", e.user, e.hash)
+	}
+	mode := os.FileMode(0640)
+	info, statErr := os.Stat(path)
+	if statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content.String()), mode); err != nil {
+		return err
+	}
+	if statErr == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			os.Chown(tmp, int(st.Uid), int(st.Gid))
+		}
+	} else {
+		chownNginxGroup(tmp, path)
+	}
+	return os.Rename(tmp, path)
+}
+
+// chownNginxGroup gives the group of a new htpasswd file to the nginx workers, printing
+// how to do it by hand when no nginx group exists or the change fails.
+func chownNginxGroup(tmp, path string) {
+	for _, name := range nginxGroups {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(tmp, -1, gid); err != nil {
+			fmt.Printf("Warning: Failed to give %s to group %s: %v. Run chgrp %s %s so that nginx can read it.\n",
+				path, name, err, name, path)
+		}
+		return
+	}
+	fmt.Printf("Warning: No nginx group (%s) found; %s is readable only by its owner and group. Run chgrp <nginx group> %s so that nginx can read it.\n",
+		strings.Join(nginxGroups, ", "), path, path)
+}
+
+// hashPassword hashes a password with bcrypt in the $2y$ form written by Apache htpasswd.
+func hashPassword(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return "$2y$" + strings.TrimPrefix(string(hash), "$2a$"), nil
+}
+
+// generatePassword returns a random password of letters and digits.
+func generatePassword(length int) (string, error) {
+	const alphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// readPassword prompts for a password twice without echo on a terminal, or reads a line
+// from stdin otherwise.
+func readPassword(user string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("no password on stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Printf("Password for %s: ", user)
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Confirm password: ")
+	confirm, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(confirm) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password), nil
+}
+
+func runHtpasswd(args []string) int {
+	fs := flag.NewFlagSet("htpasswd", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	generate := fs.Bool("generate", false, "Generate a random password and print it")
+	cost := fs.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	fs.Parse(args)
+
+	action := fs.Arg(0)
+	if *help || action == "" || fs.NArg() < 2 {
+		fmt.Println("Usage: nx2 htpasswd [--config-dir=<path>] [--generate] [--cost=<n>] add|rotate|remove|list <site|file> [user]")
+		fmt.Println("Manage the users of an htpasswd file for basic auth, hashing passwords with bcrypt.")
+		fmt.Println("\nActions:")
+		fmt.Println("  add <site> <user>     Add a user, creating the file when needed")
+		fmt.Println("  rotate <site> <user>  Set a new password for an existing user")
+		fmt.Println("  remove <site> <user>  Remove a user")
+		fmt.Println("  list <site>           List the users")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --generate           Generate a random password and print it instead of prompting")
+		fmt.Printf("  --cost=<n>           bcrypt cost (default: %d)\n", bcrypt.DefaultCost)
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nThe file of a site is <config-dir>/htpasswd/<site>, the default of nx2create --basic-auth; an argument")
+		fmt.Println("with a slash is used as the path. Without a terminal, the password is read from the first line of stdin.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 htpasswd add intranet alice")
+		fmt.Println("  nx2 htpasswd --generate rotate intranet alice")
+		fmt.Println("  echo 's3cret' | nx2 htpasswd add /etc/nginx/htpasswd/shared bob")
+		return 0
+	}
+
+	path := htpasswdFile(*configDir, fs.Arg(1))
+	entries, err := readHtpasswd(path)
+	if err != nil && !(os.IsNotExist(err) && action == "add") {
+		fmt.Printf("Error: Failed to read %s: %v\n", path, err)
+		return 1
+	}
+
+	if action == "list" {
+		for _, e := range entries {
+			fmt.Println(e.user)
+		}
+		return 0
+	}
+	if action != "add" && action != "rotate" && action != "remove" {
+		fmt.Printf("Error: Unknown action %s. Use add, rotate, remove or list.\n", action)
+		return 1
+	}
+
+	user := fs.Arg(2)
+	if user == "" || strings.ContainsAny(user, ": \t\n") {
+		fmt.Println("Error: A user name without colons or spaces is required.")
+		return 1
+	}
+	index := -1
+	for i, e := range entries {
+		if e.user == user {
+			index = i
+		}
+	}
+	switch {
+	case action == "add" && index >= 0:
+		fmt.Printf("Error: User %s already exists in %s. Use rotate to change the password.\n", user, path)
+		return 2
+	case action != "add" && index < 0:
+		fmt.Printf("Error: User %s not found in %s.\n", user, path)
+		return 2
+	}
+
+	if action == "remove" {
+		entries = append(entries[:index], entries[index+1:]...)
+	} else {
+		var password string
+		if *generate {
+			password, err = generatePassword(20)
+		} else {
+			password, err = readPassword(user)
+		}
+		if err == nil && password == "" {
+			err = fmt.Errorf("the password is empty")
+		}
+		if err != nil {
+			fmt.Printf("Error: Failed to read the password: %v\n", err)
+			return 1
+		}
+		hash, err := hashPassword(password, *cost)
+		if err != nil {
+			fmt.Printf("Error: Failed to hash the password: %v\n", err)
+			return 1
+		}
+		if index >= 0 {
+			entries[index].hash = hash
+		} else {
+			entries = append(entries, htpasswdEntry{user, hash})
+		}
+		if *generate {
+			fmt.Printf("Password for %s: %s\n", user, password)
+		}
+	}
+
+	if err := writeHtpasswd(path, entries); err != nil {
+		fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+		return 1
+	}
+	past := map[string]string{"add": "added to", "rotate": "updated in", "remove": "removed from"}[action]
+	fmt.Printf("User %s %s %s.\n", user, past, path)
+	return 0
+}
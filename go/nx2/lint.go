@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// Severity levels of lint findings, from the most to the least severe.
+var severities = []string{"error", "warning", "info"}
+
+// severityRank orders severities; lower is more severe.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return len(severities)
+}
+
+// lintRule is a documented check run by nx2 lint.
+type lintRule struct {
+	ID          string
+	Name        string
+	Severity    string // default severity; a check may lower it for a finding
+	Description string
+	check       func(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc)
+}
+
+// reportFunc records a finding of the running rule at a directive. An empty severity
+// uses the default of the rule.
+type reportFunc func(d *nginxconf.Directive, severity, message string)
+
+// finding is a problem reported by a lint rule.
+type finding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+var lintRules = []lintRule{
+	{"NX001", "proxy-pass-uri", "warning",
+		"proxy_pass with a URI part replaces the part of the request URI matched by the location, which usually strips a path prefix",
+		checkProxyPassURI},
+	{"NX002", "add-header-inheritance", "warning",
+		"add_header in a block drops every add_header inherited from the enclosing blocks",
+		checkAddHeader},
+	{"NX003", "if-in-location", "warning",
+		"if inside a location is only safe with return or rewrite ... last; other directives behave unexpectedly",
+		checkIfInLocation},
+	{"NX004", "proxy-host-header", "warning",
+		"proxy_pass without proxy_set_header Host sends the upstream name as Host instead of the requested host",
+		checkProxyHost},
+	{"NX005", "root-in-location", "info",
+		"root inside a location; set it in the server block so every location, including the default ones, shares it",
+		checkRootInLocation},
+	{"NX006", "http-without-redirect", "warning",
+		"server listening only on plain HTTP that serves content instead of redirecting to HTTPS",
+		checkHTTPWithoutRedirect},
+}
+
+// innermost returns the innermost parent, or nil at the top level.
+func innermost(parents []*nginxconf.Directive) *nginxconf.Directive {
+	if len(parents) == 0 {
+		return nil
+	}
+	return parents[len(parents)-1]
+}
+
+// enclosing returns the innermost parent with the given name, or nil.
+func enclosing(parents []*nginxconf.Directive, name string) *nginxconf.Directive {
+	for i := len(parents) - 1; i >= 0; i-- {
+		if parents[i].Name == name {
+			return parents[i]
+		}
+	}
+	return nil
+}
+
+// locationPath returns the path of a location directive without its modifier.
+func locationPath(d *nginxconf.Directive) string {
+	return parseLocation(d).path
+}
+
+func checkProxyPassURI(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc) {
+	loc := innermost(parents)
+	if d.Name != "proxy_pass" || loc == nil || loc.Name != "location" || strings.Contains(d.Arg(0), "$") {
+		return
+	}
+	_, rest, ok := strings.Cut(d.Arg(0), "://")
+	if !ok {
+		return
+	}
+	_, uri, ok := strings.Cut(rest, "/")
+	if !ok || "/"+uri == locationPath(loc) {
+		return
+	}
+	report(d, "", fmt.Sprintf("proxy_pass %s has the URI /%s: nginx replaces the part of the request URI matching %s with it",
+		d.Arg(0), uri, loc))
+}
+
+func checkAddHeader(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc) {
+	if !d.IsBlock {
+		return
+	}
+	own := d.Find("add_header")
+	if len(own) == 0 {
+		return
+	}
+	redefined := map[string]bool{}
+	for _, h := range own {
+		redefined[strings.ToLower(h.Arg(0))] = true
+	}
+
+	// Only the nearest level with add_header would have been inherited
+	for i := len(parents) - 1; i >= 0; i-- {
+		inherited := parents[i].Find("add_header")
+		if len(inherited) == 0 {
+			continue
+		}
+		var dropped []string
+		for _, h := range inherited {
+			if !redefined[strings.ToLower(h.Arg(0))] {
+				dropped = append(dropped, h.Arg(0))
+			}
+		}
+		if len(dropped) > 0 {
+			report(own[0], "", fmt.Sprintf("add_header in %s drops the headers set in %s (%s): %s",
+				d, parents[i].Name, parents[i].Pos, strings.Join(dropped, ", ")))
+		}
+		return
+	}
+}
+
+func checkIfInLocation(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc) {
+	if d.Name != "if" || enclosing(parents, "location") == nil {
+		return
+	}
+	for _, child := range d.Children() {
+		if child.Name == "return" || (child.Name == "rewrite" && child.HasArg("last")) {
+			continue
+		}
+		report(d, "", fmt.Sprintf("%s inside a location contains %s; only return and rewrite ... last are safe there", d, child.Name))
+		return
+	}
+}
+
+func checkProxyHost(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc) {
+	// proxy_pass in the stream context forwards TCP and UDP, without headers
+	if d.Name != "proxy_pass" || enclosing(parents, "stream") != nil {
+		return
+	}
+	// proxy_set_header is inherited only by blocks that do not set any of their own
+	for i := len(parents) - 1; i >= 0; i-- {
+		headers := parents[i].Find("proxy_set_header")
+		if len(headers) == 0 {
+			continue
+		}
+		for _, h := range headers {
+			if strings.EqualFold(h.Arg(0), "Host") {
+				return
+			}
+		}
+		report(d, "", fmt.Sprintf("proxy_pass %s without proxy_set_header Host; the proxy_set_header directives in %s (%s) replace the inherited ones",
+			d.Arg(0), parents[i].Name, parents[i].Pos))
+		return
+	}
+	report(d, "", fmt.Sprintf("proxy_pass %s without proxy_set_header Host; the upstream receives the upstream name as Host", d.Arg(0)))
+}
+
+func checkRootInLocation(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc) {
+	if d.Name != "root" || enclosing(parents, "location") == nil {
+		return
+	}
+	server := enclosing(parents, "server")
+	if server != nil && server.First("root") == nil {
+		report(d, "warning", fmt.Sprintf("root %s is set in a location but the server has no root; other locations serve from the default html directory", d.Arg(0)))
+		return
+	}
+	report(d, "", fmt.Sprintf("root %s is set in a location; set it in the server block and use alias or a nested root only where needed", d.Arg(0)))
+}
+
+// isRedirect reports whether a return or rewrite directive sends a redirect.
+func isRedirect(d *nginxconf.Directive) bool {
+	switch d.Name {
+	case "return":
+		code := d.Arg(0)
+		return code == "301" || code == "302" || code == "303" || code == "307" || code == "308" ||
+			strings.HasPrefix(code, "http://") || strings.HasPrefix(code, "https://")
+	case "rewrite":
+		return d.HasArg("redirect") || d.HasArg("permanent") ||
+			strings.HasPrefix(d.Arg(1), "http://") || strings.HasPrefix(d.Arg(1), "https://")
+	}
+	return false
+}
+
+// servesNoContent reports whether a server answers every request without serving content:
+// with a server-level return or redirecting rewrite, or with a redirect in location /, as
+// the HTTP to HTTPS servers of nx2create do.
+func servesNoContent(server *nginxconf.Directive) bool {
+	if len(server.Find("return")) > 0 {
+		return true
+	}
+	for _, r := range server.Find("rewrite") {
+		if isRedirect(r) {
+			return true
+		}
+	}
+	for _, loc := range server.Find("location") {
+		if path := locationPath(loc); path != "/" {
+			continue
+		}
+		for _, child := range loc.Children() {
+			if isRedirect(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkHTTPWithoutRedirect(d *nginxconf.Directive, parents []*nginxconf.Directive, report reportFunc) {
+	if d.Name != "server" || !d.IsBlock || enclosing(parents, "stream") != nil || enclosing(parents, "mail") != nil ||
+		enclosing(parents, "upstream") != nil {
+		return
+	}
+	for _, l := range d.Find("listen") {
+		if l.HasArg("ssl") || l.HasArg("quic") {
+			return
+		}
+	}
+	if ssl := d.First("ssl"); ssl != nil && ssl.Arg(0) == "on" {
+		return
+	}
+
+	if servesNoContent(d) {
+		return
+	}
+	report(d, "", fmt.Sprintf("server %s listens only on plain HTTP and serves content; redirect it to HTTPS with return 301 https://$host$request_uri",
+		serverNames(d)))
+}
+
+// serverNames returns the names of a server block for messages.
+func serverNames(d *nginxconf.Directive) string {
+	var names []string
+	for _, n := range d.Find("server_name") {
+		names = append(names, n.Values()...)
+	}
+	if len(names) == 0 {
+		return `""`
+	}
+	return strings.Join(names, " ")
+}
+
+// suppressions returns the rules disabled by "# nx2lint:disable=NX001,NX002" comments,
+// by file and line. A comment at the end of a line applies to that line; a comment on its
+// own line applies to the next directive. "# nx2lint:disable-file=..." applies to the
+// whole file (line 0). "all" disables every rule.
+func suppressions(files []*nginxconf.File) map[string]map[int][]string {
+	result := map[string]map[int][]string{}
+	add := func(file string, line int, rules []string) {
+		if result[file] == nil {
+			result[file] = map[int][]string{}
+		}
+		result[file][line] = append(result[file][line], rules...)
+	}
+
+	var scan func(file string, directives []*nginxconf.Directive)
+	scan = func(file string, directives []*nginxconf.Directive) {
+		for i, d := range directives {
+			if d.IsBlock {
+				scan(file, d.Block)
+			}
+			if !d.IsComment() {
+				continue
+			}
+			text := strings.TrimSpace(d.Comment)
+			var value string
+			var ok bool
+			if value, ok = strings.CutPrefix(text, "nx2lint:disable-file="); ok {
+				add(file, 0, strings.Split(value, ","))
+				continue
+			}
+			if value, ok = strings.CutPrefix(text, "nx2lint:disable="); !ok {
+				continue
+			}
+			rules := strings.Split(value, ",")
+			if d.Inline {
+				add(file, d.Pos.Line, rules)
+				continue
+			}
+			for _, next := range directives[i+1:] {
+				if !next.IsComment() {
+					add(file, next.Pos.Line, rules)
+					break
+				}
+			}
+		}
+	}
+	for _, f := range files {
+		scan(f.Path, f.Directives)
+	}
+	return result
+}
+
+// suppressed reports whether a rule is disabled for a line of a file.
+func suppressed(disabled map[string]map[int][]string, rule, file string, line int) bool {
+	for _, l := range []int{0, line} {
+		for _, r := range disabled[file][l] {
+			r = strings.TrimSpace(r)
+			if strings.EqualFold(r, rule) || r == "all" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lintConfig runs the rules on a loaded config, including the files it includes.
+func lintConfig(config *nginxconf.Config, rules []lintRule) []finding {
+	disabled := suppressions(config.Files)
+	var findings []finding
+	for _, rule := range rules {
+		report := func(d *nginxconf.Directive, severity, message string) {
+			if severity == "" {
+				severity = rule.Severity
+			}
+			if suppressed(disabled, rule.ID, d.Pos.File, d.Pos.Line) {
+				return
+			}
+			findings = append(findings, finding{rule.ID, severity, d.Pos.File, d.Pos.Line, d.Pos.Column, message})
+		}
+		nginxconf.Walk(config.Directives(), func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+			rule.check(d, parents, report)
+			return true
+		})
+	}
+	return findings
+}
+
+// sarifReport formats findings as a SARIF 2.1.0 log for code scanning tools.
+func sarifReport(rules []lintRule, findings []finding) any {
+	type object = map[string]any
+	levels := map[string]string{"error": "error", "warning": "warning", "info": "note"}
+
+	var ruleList []object
+	for _, r := range rules {
+		ruleList = append(ruleList, object{
+			"id":                   r.ID,
+			"name":                 r.Name,
+			"shortDescription":     object{"text": r.Description},
+			"defaultConfiguration": object{"level": levels[r.Severity]},
+		})
+	}
+	results := []object{}
+	for _, f := range findings {
+		results = append(results, object{
+			"ruleId":  f.Rule,
+			"level":   levels[f.Severity],
+			"message": object{"text": f.Message},
+			"locations": []object{{
+				"physicalLocation": object{
+					"artifactLocation": object{"uri": f.File},
+					"region":           object{"startLine": f.Line, "startColumn": f.Column},
+				},
+			}},
+		})
+	}
+	return object{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []object{{
+			"tool":    object{"driver": object{"name": "nx2 lint", "rules": ruleList}},
+			"results": results,
+		}},
+	}
+}
+
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	all := fs.Bool("all", false, "Lint every site in sites-available")
+	format := fs.String("format", "text", "Output format: text, json or sarif")
+	severity := fs.String("severity", "info", "Minimum severity to report: error, warning or info")
+	only := fs.String("rules", "", "Comma-separated rule IDs to run (default: all)")
+	listRules := fs.Bool("list-rules", false, "Print the rule set")
+	fs.Parse(args)
+
+	if *listRules {
+		for _, r := range lintRules {
+			fmt.Printf("%s  %-8s %-24s %s\n", r.ID, r.Severity, r.Name, r.Description)
+		}
+		return 0
+	}
+
+	if *help || (fs.NArg() == 0 && !*all) {
+		fmt.Println("Usage: nx2 lint [--config-dir=<path>] [--format=text|json|sarif] [--severity=<level>] [--rules=<ids>] <site>... | --all")
+		fmt.Println("Check site configs for mistakes that nginx -t accepts, such as add_header dropping inherited headers.")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --all                Lint every site in sites-available")
+		fmt.Println("  --format=<format>    Output format: text, json or sarif (default: text)")
+		fmt.Println("  --severity=<level>   Minimum severity to report: error, warning or info (default: info)")
+		fmt.Println("  --rules=<ids>        Comma-separated rule IDs to run, e.g. NX001,NX004 (default: all)")
+		fmt.Println("  --list-rules         Print the rule set")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nSuppressions:")
+		fmt.Println("  add_header X-Test 1;  # nx2lint:disable=NX002      disables rules on this line")
+		fmt.Println("  # nx2lint:disable=NX003,NX005                      on its own line, disables rules on the next directive")
+		fmt.Println("  # nx2lint:disable-file=NX006                       disables rules in the whole file")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 lint example")
+		fmt.Println("  nx2 lint --all --severity=warning")
+		fmt.Println("  nx2 lint --all --format=sarif > nx2lint.sarif")
+		fmt.Println("\nExit status is 3 when problems are found and 2 when a file cannot be parsed.")
+		return 0
+	}
+
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		fmt.Printf("Error: Invalid format %s. Use text, json or sarif.\n", *format)
+		return 1
+	}
+	if severityRank(*severity) == len(severities) {
+		fmt.Printf("Error: Invalid severity %s. Use error, warning or info.\n", *severity)
+		return 1
+	}
+	rules := lintRules
+	if *only != "" {
+		rules = nil
+		for _, id := range strings.Split(*only, ",") {
+			found := false
+			for _, r := range lintRules {
+				if strings.EqualFold(r.ID, strings.TrimSpace(id)) {
+					rules = append(rules, r)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Printf("Error: Unknown rule %s. Run 'nx2 lint --list-rules' for the rule set.\n", id)
+				return 1
+			}
+		}
+	}
+
+	var files []string
+	if *all {
+		sites, err := availableSites(*configDir)
+		if err != nil {
+			fmt.Printf("Error: Failed to list sites: %v\n", err)
+			return 1
+		}
+		files = append(files, sites...)
+	}
+	for _, site := range fs.Args() {
+		files = append(files, siteFile(*configDir, site))
+	}
+
+	status := 0
+	var findings []finding
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Configuration file %s not found.\n", file)
+			status = max(status, 1)
+			continue
+		}
+		config, err := nginxconf.Load(file, nginxconf.LoadOptions{Prefix: *configDir})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to parse %v\n", err)
+			status = max(status, 2)
+			continue
+		}
+		for _, f := range lintConfig(config, rules) {
+			if severityRank(f.Severity) <= severityRank(*severity) {
+				findings = append(findings, f)
+			}
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Rule < b.Rule
+	})
+
+	switch *format {
+	case "json":
+		if findings == nil {
+			findings = []finding{}
+		}
+		out, _ := json.MarshalIndent(findings, "", "  ")
+		fmt.Println(string(out))
+	case "sarif":
+		out, _ := json.MarshalIndent(sarifReport(rules, findings), "", "  ")
+		fmt.Println(string(out))
+	default:
+		for _, f := range findings {
+			fmt.Printf("%s:%d:%d: %s %s %s\n", f.File, f.Line, f.Column, f.Severity, f.Rule, f.Message)
+		}
+		if len(findings) == 0 && status == 0 {
+			fmt.Println("No problems found.")
+		} else if len(findings) > 0 {
+			fmt.Printf("\n%d problem(s) found.\n", len(findings))
+		}
+	}
+
+	if status == 0 && len(findings) > 0 {
+		return 3
+	}
+	return status
+}
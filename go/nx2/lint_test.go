@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// lintSource lints a config and returns its findings as "rule:line" strings.
+func lintSource(t *testing.T, src string) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "site.conf")
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := nginxconf.Load(path, nginxconf.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range lintConfig(config, lintRules) {
+		got = append(got, fmt.Sprintf("%s:%s:%d", f.Rule, f.Severity, f.Line))
+	}
+	return got
+}
+
+func TestLintRules(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"proxy_pass with a URI", `server {
+    listen 443 ssl;
+    location /api/ {
+        proxy_set_header Host $host;
+        proxy_pass http://backend/;
+    }
+}
+`, []string{"NX001:warning:5"}},
+		{"proxy_pass with the location path or a variable", `server {
+    listen 443 ssl;
+    proxy_set_header Host $host;
+    location /api/ {
+        proxy_pass http://backend/api/;
+    }
+    location /v2/ {
+        proxy_pass http://backend$request_uri;
+    }
+}
+`, nil},
+		{"add_header dropping inherited headers", `server {
+    listen 443 ssl;
+    add_header X-Frame-Options DENY;
+    add_header X-Content-Type-Options nosniff;
+    location /static/ {
+        add_header Cache-Control "max-age=3600";
+        add_header X-Frame-Options DENY;
+    }
+}
+`, []string{"NX002:warning:6"}},
+		{"add_header repeating inherited headers", `server {
+    listen 443 ssl;
+    add_header X-Frame-Options DENY;
+    location /static/ {
+        add_header X-Frame-Options DENY;
+        add_header Cache-Control "max-age=3600";
+    }
+}
+`, nil},
+		{"if in location", `server {
+    listen 443 ssl;
+    location / {
+        if ($request_method = POST) {
+            return 405;
+        }
+        if ($http_x_debug) {
+            add_header X-Debug on;
+        }
+        if ($arg_v) {
+            rewrite ^ /v2$uri last;
+        }
+    }
+}
+`, []string{"NX003:warning:7"}},
+		{"proxy_pass without Host", `server {
+    listen 443 ssl;
+    location / {
+        proxy_pass http://backend;
+    }
+}
+`, []string{"NX004:warning:4"}},
+		{"proxy_set_header replacing the inherited Host", `server {
+    listen 443 ssl;
+    proxy_set_header Host $host;
+    location / {
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_pass http://backend;
+    }
+}
+`, []string{"NX004:warning:6"}},
+		{"root in a location", `server {
+    listen 443 ssl;
+    root /var/www/site;
+    location /docs/ {
+        root /var/www/docs;
+    }
+}
+`, []string{"NX005:info:5"}},
+		{"root only in a location", `server {
+    listen 443 ssl;
+    location / {
+        root /var/www/site;
+    }
+}
+`, []string{"NX005:warning:4"}},
+		{"plain HTTP serving content", `server {
+    listen 80;
+    server_name example.com;
+    root /var/www/site;
+}
+`, []string{"NX006:warning:1"}},
+		{"plain HTTP redirecting", `server {
+    listen 80;
+    return 301 https://$host$request_uri;
+}
+
+server {
+    listen 80;
+    location / {
+        return 301 https://$host$request_uri;
+    }
+}
+
+server {
+    listen 80;
+    rewrite ^ https://$host$request_uri permanent;
+}
+`, nil},
+		{"stream servers", `stream {
+    server {
+        listen 5432;
+        proxy_pass db:5432;
+    }
+}
+`, nil},
+		{"suppressions", `# nx2lint:disable-file=NX005
+server { # nx2lint:disable=NX006
+    listen 80;
+    location / {
+        root /var/www/site;
+        # nx2lint:disable=NX004
+        proxy_pass http://backend;
+        proxy_pass http://backend2;
+    }
+}
+`, []string{"NX004:warning:8"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := lintSource(t, test.src)
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("findings %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// The directives of nx2 maintenance are written between these comments in every server
+// block of the site, so that off removes exactly what on added.
+const (
+	maintenanceBegin = "# nx2 maintenance begin"
+	maintenanceEnd   = "# nx2 maintenance end"
+)
+
+// defaultMaintenancePage is served when no --page is given.
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Under maintenance</title>
+</head>
+<body>
+<h1>Under maintenance</h1>
+<p>This site is temporarily unavailable for scheduled maintenance. Please try again later.</p>
+</body>
+</html>
+`
+
+// maintenance is the maintenance mode of a site.
+type maintenance struct {
+	site       string // site name, e.g. example
+	pageDir    string // directory of the maintenance pages
+	retryAfter int    // seconds sent in Retry-After, 0 to omit it
+	bypass     string // geo variable of the clients that skip the page
+	cookie     string // value of the nx2_maintenance cookie that skips the page
+}
+
+// maintenanceDir returns the directory of the maintenance pages.
+func maintenanceDir(configDir string) string {
+	return filepath.Join(configDir, "nx2", "maintenance")
+}
+
+// maintenanceBypassFile returns the http-level geo snippet of the clients that skip the
+// maintenance page of a site, loaded by the conf.d/*.conf include like the zones snippet.
+func maintenanceBypassFile(configDir, site string) string {
+	return filepath.Join(configDir, "conf.d", "nx2-maintenance-"+site+".conf")
+}
+
+// maintenanceVariable returns the geo variable of the clients that skip the maintenance
+// page of a site, e.g. nx2_maintenance_bypass_my_app for my-app.
+func maintenanceVariable(site string) string {
+	return "nx2_maintenance_bypass_" + variableSuffix(site)
+}
+
+// variableSuffix returns the site name as written in nginx variable names, e.g. my_app
+// for my-app.
+func variableSuffix(site string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(site))
+}
+
+// lines returns the directives added to a server block. The 503 is returned in the server
+// rewrite phase, before any location runs, and error_page serves the page from a named
+// location, which keeps the 503 status. Retry-After is added at the server level, with a
+// value only the named location sets, so that the page keeps the headers of the server.
+func (m maintenance) lines(indent string) []string {
+	lines := []string{
+		maintenanceBegin + "; remove with nx2 maintenance off",
+		"set $nx2_maintenance 1;",
+	}
+	if m.retryAfter > 0 {
+		lines = append(lines, "set $nx2_retry_after \"\";")
+	}
+	if m.bypass != "" {
+		lines = append(lines,
+			"if ($"+m.bypass+") {",
+			"    set $nx2_maintenance 0;",
+			"}")
+	}
+	if m.cookie != "" {
+		lines = append(lines,
+			"if ($cookie_nx2_maintenance = \""+m.cookie+"\") {",
+			"    set $nx2_maintenance 0;",
+			"}")
+	}
+	lines = append(lines,
+		"if ($nx2_maintenance) {",
+		"    return 503;",
+		"}",
+		"error_page 503 @nx2_maintenance;")
+	if m.retryAfter > 0 {
+		lines = append(lines, "add_header Retry-After $nx2_retry_after always;")
+	}
+	lines = append(lines, "location @nx2_maintenance {")
+	if m.retryAfter > 0 {
+		lines = append(lines, fmt.Sprintf("    set $nx2_retry_after %d;", m.retryAfter))
+	}
+	lines = append(lines,
+		"    root "+m.pageDir+"; # nx2lint:disable=NX005",
+		"    try_files /"+m.site+".html =503;",
+		"}",
+		maintenanceEnd)
+	for i := range lines {
+		lines[i] = indent + lines[i]
+	}
+	return lines
+}
+
+// removeMaintenance drops the lines between the maintenance comments and reports whether
+// there were any.
+func removeMaintenance(lines []string) ([]string, bool, error) {
+	var kept []string
+	inside, found := false, false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, maintenanceBegin):
+			if inside {
+				return nil, false, fmt.Errorf("line %d: maintenance block opened twice", i+1)
+			}
+			inside, found = true, true
+		case strings.HasPrefix(trimmed, maintenanceEnd):
+			if !inside {
+				return nil, false, fmt.Errorf("line %d: maintenance block closed without being opened", i+1)
+			}
+			inside = false
+		case !inside:
+			kept = append(kept, line)
+		}
+	}
+	if inside {
+		return nil, false, errors.New("maintenance block is not closed; remove it by hand")
+	}
+	return kept, found, nil
+}
+
+// addMaintenance inserts the maintenance directives at the top of every server block of a
+// site file, leaving the other lines as written.
+func addMaintenance(path string, lines []string, m maintenance) ([]string, error) {
+	f, err := nginxconf.Parse([]byte(strings.Join(lines, "\n")), path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []int
+	for _, d := range f.Directives {
+		if d.IsBlock && d.Name == "server" {
+			servers = append(servers, d.Pos.Line)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s has no server block", path)
+	}
+	// Insert from the end of the file so that earlier line numbers stay valid
+	for i := len(servers) - 1; i >= 0; i-- {
+		n := servers[i]
+		line := lines[n-1]
+		if !strings.HasSuffix(strings.TrimSpace(line), "{") {
+			return nil, fmt.Errorf("%s:%d: the server block does not open on its line; run nx2 fmt first", path, n)
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))] + "    "
+		added := append(m.lines(indent), lines[n:]...)
+		lines = append(lines[:n:n], added...)
+	}
+	return lines, nil
+}
+
+// writeBypass writes the geo snippet of the clients that skip the maintenance page.
+func writeBypass(path, site, variable string, networks []string) error {
+	var children []*nginxconf.Directive
+	children = append(children, nginxconf.New("default", "0"))
+	for _, network := range networks {
+		children = append(children, nginxconf.New(network, "1"))
+	}
+	f := &nginxconf.File{Path: path}
+	f.Directives = append(f.Directives,
+		nginxconf.NewComment("Clients that skip the maintenance page of "+site+", managed by nx2 maintenance."),
+		nginxconf.NewBlock("geo", []string{"$" + variable}, children...))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return f.WriteFile()
+}
+
+// maintenanceStatus describes the maintenance mode of a site file, empty when it is off.
+func maintenanceStatus(path, configDir string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var details []string
+	inside := false
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, maintenanceBegin):
+			// Every server block has the same directives; describe the first one
+			if details != nil {
+				return strings.Join(details, ", "), nil
+			}
+			inside = true
+			details = []string{"on"}
+		case !inside:
+		case strings.HasPrefix(trimmed, "set $nx2_retry_after ") && !strings.HasSuffix(trimmed, `"";`):
+			details = append(details, "Retry-After "+strings.TrimSuffix(strings.Fields(trimmed)[2], ";"))
+		case strings.HasPrefix(trimmed, "if ($cookie_nx2_maintenance"):
+			details = append(details, "bypass cookie")
+		case strings.HasPrefix(trimmed, "if ($nx2_maintenance_bypass_"):
+			if f, err := nginxconf.ParseFile(maintenanceBypassFile(configDir, siteName(path))); err == nil {
+				var networks []string
+				for _, geo := range f.Find("geo") {
+					for _, d := range geo.Children() {
+						if !d.IsComment() && d.Name != "default" {
+							networks = append(networks, d.Name)
+						}
+					}
+				}
+				details = append(details, "bypass from "+strings.Join(networks, " "))
+			}
+		case strings.HasPrefix(trimmed, maintenanceEnd):
+			inside = false
+		}
+	}
+	return strings.Join(details, ", "), nil
+}
+
+func runMaintenance(args []string) int {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	page := fs.String("page", "", "HTML page served with the 503 (default: a generic maintenance page)")
+	retryAfter := fs.Int("retry-after", 3600, "Seconds sent in Retry-After, 0 to omit the header")
+	allow := fs.String("allow", "", "Comma-separated addresses or CIDR ranges that skip the maintenance page")
+	cookie := fs.Bool("cookie", false, "Let clients with a secret nx2_maintenance cookie skip the maintenance page")
+	noReload := fs.Bool("no-reload", false, "Do not reload nginx after the change")
+	fs.Parse(args)
+
+	action, site := fs.Arg(0), fs.Arg(1)
+	if *help || action == "" || (action != "status" && site == "") {
+		fmt.Println("Usage: nx2 maintenance [--config-dir=<path>] [--page=<file>] [--retry-after=<secs>] [--allow=<networks>] [--cookie] [--no-reload] on|off|status [site]")
+		fmt.Println("Answer every request of a site with 503 and a maintenance page, instead of disabling it and letting")
+		fmt.Println("another site answer.")
+		fmt.Println("\nActions:")
+		fmt.Println("  on <site>      Turn the maintenance mode on, or update its options")
+		fmt.Println("  off <site>     Turn the maintenance mode off, restoring the site as it was")
+		fmt.Println("  status [site]  Print the maintenance mode of a site, or of every site in sites-available")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --page=<file>        HTML page served with the 503 (default: a generic maintenance page)")
+		fmt.Println("  --retry-after=<secs> Seconds sent in Retry-After (default: 3600; 0 omits the header)")
+		fmt.Println("  --allow=<networks>   Comma-separated addresses or CIDR ranges that still reach the site, e.g. the team")
+		fmt.Println("                       testing the deploy")
+		fmt.Println("  --cookie             Generate a secret; clients sending it in the nx2_maintenance cookie still reach the site")
+		fmt.Println("  --no-reload          Do not reload nginx after the change")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nThe directives are added at the top of every server block of the site, between \"# nx2 maintenance\"")
+		fmt.Println("comments; the page is stored in <config-dir>/nx2/maintenance and the allowed networks in")
+		fmt.Println("<config-dir>/conf.d/nx2-maintenance-<site>.conf. If nginx -t fails, every file is restored.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 maintenance on example")
+		fmt.Println("  nx2 maintenance --page=/srv/www/maintenance.html --retry-after=600 --allow=10.20.0.0/16 --cookie on example")
+		fmt.Println("  nx2 maintenance off example")
+		return 0
+	}
+
+	if action == "status" {
+		files := []string{siteFile(*configDir, site)}
+		if site == "" {
+			var err error
+			if files, err = availableSites(*configDir); err != nil {
+				fmt.Printf("Error: Failed to list sites: %v\n", err)
+				return 1
+			}
+		}
+		status := 0
+		for _, file := range files {
+			details, err := maintenanceStatus(file, *configDir)
+			switch {
+			case err != nil:
+				fmt.Printf("Error: Failed to read %s: %v\n", file, err)
+				status = 2
+			case details != "":
+				fmt.Printf("%s: %s\n", siteName(file), details)
+			case site != "":
+				fmt.Printf("%s: off\n", siteName(file))
+			}
+		}
+		return status
+	}
+	if action != "on" && action != "off" {
+		fmt.Printf("Error: Unknown action %s. Use on, off or status.\n", action)
+		return 1
+	}
+
+	path := siteFile(*configDir, site)
+	site = siteName(path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Error: Failed to read %s: %v\n", path, err)
+		return 2
+	}
+	lines, found, err := removeMaintenance(strings.Split(string(content), "\n"))
+	if err != nil {
+		fmt.Printf("Error: %s: %v\n", path, err)
+		return 2
+	}
+
+	pagePath := filepath.Join(maintenanceDir(*configDir), site+".html")
+	bypassPath := maintenanceBypassFile(*configDir, site)
+	backup := map[string][]byte{}
+	for _, file := range []string{path, pagePath, bypassPath} {
+		previous, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Error: Failed to read %s: %v\n", file, err)
+			return 1
+		}
+		backup[file] = previous
+	}
+
+	var m maintenance
+	if action == "off" {
+		if !found {
+			fmt.Printf("Nothing to do; %s is not in maintenance.\n", site)
+			return 0
+		}
+		os.Remove(pagePath)
+		os.Remove(bypassPath)
+	} else {
+		if *retryAfter < 0 {
+			fmt.Println("Error: --retry-after must be 0 or more seconds.")
+			return 1
+		}
+		var networks []string
+		for _, value := range strings.Split(*allow, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			network, err := normalizeCIDR(value)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return 1
+			}
+			networks = append(networks, network)
+		}
+
+		html := []byte(defaultMaintenancePage)
+		if *page != "" {
+			if html, err = os.ReadFile(*page); err != nil {
+				fmt.Printf("Error: Failed to read the page: %v\n", err)
+				return 1
+			}
+		}
+		m = maintenance{site: site, pageDir: maintenanceDir(*configDir), retryAfter: *retryAfter}
+		if len(networks) > 0 {
+			m.bypass = maintenanceVariable(site)
+		}
+		if *cookie {
+			if m.cookie, err = generatePassword(32); err != nil {
+				fmt.Printf("Error: Failed to generate the cookie secret: %v\n", err)
+				return 1
+			}
+		}
+		if lines, err = addMaintenance(path, lines, m); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 2
+		}
+
+		if err := os.MkdirAll(m.pageDir, 0755); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(pagePath, html, 0644); err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", pagePath, err)
+			restoreFiles(backup)
+			return 1
+		}
+		if m.bypass != "" {
+			if err := writeBypass(bypassPath, site, m.bypass, networks); err != nil {
+				fmt.Printf("Error: Failed to write %s: %v\n", bypassPath, err)
+				restoreFiles(backup)
+				return 1
+			}
+			if !snippetIncluded(*configDir, bypassPath) {
+				fmt.Printf("Warning: %s is not included by nginx.conf; add \"include conf.d/*.conf;\" to the http block.\n", bypassPath)
+			}
+		} else {
+			os.Remove(bypassPath)
+		}
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), mode); err != nil {
+		fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+		restoreFiles(backup)
+		return 1
+	}
+	if action == "off" {
+		fmt.Printf("Maintenance mode of %s turned off: %s\n", site, path)
+	} else {
+		fmt.Printf("Maintenance mode of %s turned on: %s\n", site, path)
+		if *cookie {
+			fmt.Printf("Bypass cookie: nx2_maintenance=%s\n", m.cookie)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(*configDir, "sites-enabled", site+".conf")); err != nil {
+		fmt.Printf("Warning: %s is not enabled; enable it with nx2ensite to serve the maintenance page.\n", site)
+	}
+
+	if *noReload {
+		return 0
+	}
+	if err := reloadNginx(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		restoreFiles(backup)
+		fmt.Println("Previous configuration restored.")
+		return 3
+	}
+	fmt.Println("Nginx reloaded.")
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// testNginx runs nginx -t and returns its output as the error when the test fails.
+func testNginx() error {
+	cmd := exec.Command("nginx", "-t")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() == 0 {
+			return fmt.Errorf("nginx configuration test failed: %v", err)
+		}
+		return fmt.Errorf("nginx configuration test failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// reloadNginx tests the configuration and reloads nginx.
+func reloadNginx() error {
+	if err := testNginx(); err != nil {
+		return err
+	}
+	if err := exec.Command("systemctl", "reload", "nginx").Run(); err != nil {
+		return fmt.Errorf("failed to reload nginx: %v", err)
+	}
+	return nil
+}
+
+// nginxVersion returns the version printed by nginx -v, e.g. 1.24.0.
+func nginxVersion() (string, error) {
+	out, err := exec.Command("nginx", "-v").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run nginx -v: %v", err)
+	}
+	_, version, found := strings.Cut(strings.TrimSpace(string(out)), "nginx/")
+	if !found {
+		return "", fmt.Errorf("unexpected nginx -v output %q", strings.TrimSpace(string(out)))
+	}
+	version, _, _ = strings.Cut(version, " ")
+	return version, nil
+}
+
+// versionAtLeast compares dotted versions such as 1.19.4.
+func versionAtLeast(version, minimum string) bool {
+	have, want := strings.Split(version, "."), strings.Split(minimum, ".")
+	for i := range want {
+		var h int
+		if i < len(have) {
+			h, _ = strconv.Atoi(have[i])
+		}
+		w, _ := strconv.Atoi(want[i])
+		if h != w {
+			return h > w
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// command is an nx2 subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"acl", "Manage named IP allowlists shared by sites", runACL},
+	{"audit", "Score the enabled sites against a security baseline", runAudit},
+	{"cache", "Purge the proxy cache of a site", runCache},
+	{"conflicts", "Report duplicate server names, default_server flags and listen mismatches", runConflicts},
+	{"default", "Manage the catch-all server and the default server of each socket", runDefault},
+	{"fmt", "Rewrite site configs in the canonical style", runFmt},
+	{"htpasswd", "Manage basic auth users with bcrypt passwords", runHtpasswd},
+	{"lint", "Check site configs for mistakes that nginx -t accepts", runLint},
+	{"maintenance", "Answer the requests of a site with a maintenance page", runMaintenance},
+	{"pool", "Switch the traffic of a proxy site between blue and green upstreams", runPool},
+	{"realip", "Manage the trusted load balancers of the client address", runRealIP},
+	{"route", "Show which server block and location serve a URL", runRoute},
+	{"schedule", "Enable and disable sites at a given time", runSchedule},
+	{"zones", "Manage the rate and connection limit zones used by sites", runZones},
+}
+
+// usage prints the list of subcommands.
+func usage() {
+	fmt.Println("Usage: nx2 <command> [options]")
+	fmt.Println("Inspect and manage Nginx sites created with nx2create and enabled with nx2ensite.")
+	fmt.Println("\nCommands:")
+	for _, c := range commands {
+		fmt.Printf("  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Println("\nRun 'nx2 <command> --help' for the options of a command.")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "--help" || os.Args[1] == "-help" || os.Args[1] == "help" {
+		usage()
+		os.Exit(0)
+	}
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			os.Exit(c.run(os.Args[2:]))
+		}
+	}
+
+	fmt.Printf("Error: Unknown command %s.\n", os.Args[1])
+	usage()
+	os.Exit(1)
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// poolNames are the pools of a site; the active one receives the traffic, the other one
+// the new version being deployed.
+var poolNames = []string{"blue", "green"}
+
+// poolRoute is how the traffic of a site is split between its pools.
+type poolRoute struct {
+	Active string `json:"active"`
+	Canary int    `json:"canary"` // percent of the requests sent to the inactive pool
+}
+
+// poolState is the blue/green setup of a proxy site, from which nx2 pool renders the
+// upstreams and the split_clients block of the site file.
+type poolState struct {
+	Upstream string              `json:"upstream"`          // upstream of the site replaced by the pools
+	Options  []string            `json:"options,omitempty"` // other directives of that upstream, e.g. keepalive 32
+	Pools    map[string][]string `json:"pools"`             // servers of each pool, e.g. 10.0.0.1:8080 max_fails=3
+	Key      string              `json:"key"`               // split_clients key of the canary
+	poolRoute
+	Previous *poolRoute `json:"previous,omitempty"` // route restored by rollback
+}
+
+// poolFile returns the state file of the pools of a site.
+func poolFile(configDir, site string) string {
+	return filepath.Join(configDir, "nx2", "pools", site+".json")
+}
+
+// readPools returns the pools of a site, nil when they were never set.
+func readPools(path string) (*poolState, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state poolState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("invalid pool file %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// writePools saves the pools of a site atomically.
+func writePools(path string, state *poolState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// otherPool returns the pool that is not the given one.
+func otherPool(pool string) string {
+	if pool == "blue" {
+		return "green"
+	}
+	return "blue"
+}
+
+// poolUpstream returns the upstream of a pool, e.g. my-app_green.
+func poolUpstream(upstream, pool string) string {
+	return upstream + "_" + pool
+}
+
+// poolVariable returns the variable set by split_clients to the upstream of a request,
+// e.g. nx2_pool_my_app for my-app.
+func poolVariable(site string) string {
+	return "nx2_pool_" + variableSuffix(site)
+}
+
+// passDirectives are the directives that send requests to an upstream by name.
+var passDirectives = map[string]bool{
+	"proxy_pass": true, "grpc_pass": true, "fastcgi_pass": true, "uwsgi_pass": true, "scgi_pass": true,
+}
+
+// passTarget returns the argument of a pass directive pointing to the variable instead of
+// the upstream, or "" when the directive does not use the upstream. A URI after the
+// upstream is an error: with a variable, nginx would pass it instead of replacing the
+// location prefix.
+func passTarget(d *nginxconf.Directive, upstream, variable string) (string, error) {
+	scheme, host, found := strings.Cut(d.Arg(0), "://")
+	if !found {
+		scheme, host = "", d.Arg(0)
+	}
+	name, uri, _ := strings.Cut(host, "/")
+	if name != upstream {
+		return "", nil
+	}
+	if uri != "" {
+		return "", fmt.Errorf("%s: %s %s has a URI; the pools need the upstream without a URI", d.Pos, d.Name, d.Arg(0))
+	}
+	if scheme == "" {
+		return "$" + variable, nil
+	}
+	return scheme + "://$" + variable, nil
+}
+
+// parseLine parses a single directive written without its semicolon.
+func parseLine(line string) (*nginxconf.Directive, error) {
+	f, err := nginxconf.Parse([]byte(line+";"), "")
+	if err != nil || len(f.Directives) != 1 {
+		return nil, fmt.Errorf("invalid directive %q", line)
+	}
+	return f.Directives[0], nil
+}
+
+// initPools takes the servers and options of the upstream of the site as the blue pool and
+// points the pass directives using it at the pool variable.
+func initPools(f *nginxconf.File, upstream, variable string) (*poolState, error) {
+	var block *nginxconf.Directive
+	for _, d := range f.Directives {
+		if d.IsBlock && d.Name == "upstream" && d.Arg(0) == upstream {
+			block = d
+		}
+	}
+	if block == nil {
+		return nil, fmt.Errorf("%s has no upstream %s; give the upstream with --upstream", f.Path, upstream)
+	}
+	state := &poolState{Upstream: upstream, Pools: map[string][]string{}, Key: "$remote_addr", poolRoute: poolRoute{Active: "blue"}}
+	for _, d := range block.Children() {
+		if d.Name == "server" {
+			state.Pools["blue"] = append(state.Pools["blue"], strings.TrimPrefix(d.String(), "server "))
+		} else {
+			state.Options = append(state.Options, d.String())
+		}
+	}
+
+	passes := 0
+	var walkErr error
+	nginxconf.Walk(f.Directives, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+		if !passDirectives[d.Name] || walkErr != nil {
+			return true
+		}
+		target, err := passTarget(d, upstream, variable)
+		if err != nil {
+			walkErr = err
+		} else if target != "" {
+			d.SetArgs(target)
+			passes++
+		}
+		return true
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	if passes == 0 {
+		return nil, fmt.Errorf("%s does not pass requests to the upstream %s", f.Path, upstream)
+	}
+	return state, nil
+}
+
+// poolComment is written before the blocks rendered by nx2 pool, so that they are found
+// and replaced by the next change.
+func poolComment(site string) string {
+	return "Blue/green pools of " + site + ", managed by nx2 pool"
+}
+
+// renderPools replaces the upstream of the site, or the blocks rendered before, with an
+// upstream per pool and the split_clients block choosing the pool of each request.
+func renderPools(f *nginxconf.File, site string, state *poolState) error {
+	variable := poolVariable(site)
+	comment := poolComment(site)
+	var blocks []*nginxconf.Directive
+	for _, pool := range poolNames {
+		servers := state.Pools[pool]
+		if len(servers) == 0 {
+			continue
+		}
+		upstream := nginxconf.NewBlock("upstream", []string{poolUpstream(state.Upstream, pool)})
+		for _, line := range append(append([]string{}, state.Options...), prefixAll("server ", servers)...) {
+			d, err := parseLine(line)
+			if err != nil {
+				return err
+			}
+			upstream.Block = append(upstream.Block, d)
+		}
+		blocks = append(blocks, upstream)
+	}
+
+	// split_clients sends the canary share to the inactive pool and the rest to the active
+	// one; the active pool alone is a split with only the * entry
+	split := nginxconf.NewBlock("split_clients", []string{state.Key, "$" + variable})
+	if state.Canary > 0 {
+		split.Block = append(split.Block, nginxconf.New(strconv.Itoa(state.Canary)+"%", poolUpstream(state.Upstream, otherPool(state.Active))))
+	}
+	split.Block = append(split.Block, nginxconf.New("*", poolUpstream(state.Upstream, state.Active)))
+	blocks = append(blocks, split)
+	for _, d := range blocks[1:] {
+		d.Blank = true
+	}
+	blocks = append([]*nginxconf.Directive{nginxconf.NewComment(comment)}, blocks...)
+
+	// Drop the original upstream or the previous rendering, inserting at its place
+	var kept []*nginxconf.Directive
+	at := -1
+	for _, d := range f.Directives {
+		rendered := (d.IsComment() && strings.TrimSpace(d.Comment) == comment) ||
+			(d.IsBlock && d.Name == "upstream" && (d.Arg(0) == state.Upstream ||
+				d.Arg(0) == poolUpstream(state.Upstream, "blue") || d.Arg(0) == poolUpstream(state.Upstream, "green"))) ||
+			(d.IsBlock && d.Name == "split_clients" && d.Arg(1) == "$"+variable)
+		if !rendered {
+			kept = append(kept, d)
+		} else if at < 0 {
+			at = len(kept)
+			blocks[0].Blank = d.Blank
+		}
+	}
+	if at < 0 {
+		return fmt.Errorf("%s has neither the upstream %s nor its pools", f.Path, state.Upstream)
+	}
+	if at < len(kept) {
+		kept[at].Blank = true
+	}
+	f.Directives = append(kept[:at:at], append(blocks, kept[at:]...)...)
+	return nil
+}
+
+// prefixAll returns the values with a prefix.
+func prefixAll(prefix string, values []string) []string {
+	prefixed := make([]string, len(values))
+	for i, value := range values {
+		prefixed[i] = prefix + value
+	}
+	return prefixed
+}
+
+// describeRoute describes where the traffic of a site goes.
+func describeRoute(route poolRoute) string {
+	if route.Canary > 0 {
+		return fmt.Sprintf("%s, canary %d%% to %s", route.Active, route.Canary, otherPool(route.Active))
+	}
+	return route.Active
+}
+
+// printPools prints the pools of a site for status.
+func printPools(site string, state *poolState) {
+	fmt.Printf("%s: upstream %s, traffic to %s\n", site, state.Upstream, describeRoute(state.poolRoute))
+	for _, pool := range poolNames {
+		servers := strings.Join(state.Pools[pool], ", ")
+		if servers == "" {
+			servers = "(not set)"
+		}
+		fmt.Printf("  %-6s %s\n", pool, servers)
+	}
+	if state.Previous != nil {
+		fmt.Printf("  rollback to %s\n", describeRoute(*state.Previous))
+	}
+}
+
+func runPool(args []string) int {
+	fs := flag.NewFlagSet("pool", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	upstream := fs.String("upstream", "", "Upstream of the site to replace with the pools (default: the site name)")
+	key := fs.String("key", "", "split_clients key of the canary (default: $remote_addr)")
+	noReload := fs.Bool("no-reload", false, "Do not reload nginx after the change")
+	fs.Parse(args)
+
+	action, site := fs.Arg(0), fs.Arg(1)
+	if *help || action == "" || (action != "status" && site == "") {
+		fmt.Println("Usage: nx2 pool [--config-dir=<path>] [--upstream=<name>] [--key=<key>] [--no-reload] set|switch|canary|rollback|status [site] [args]")
+		fmt.Println("Deploy a new version of the application behind a proxy site on a second upstream pool, then move the")
+		fmt.Println("traffic to it at once or a share at a time.")
+		fmt.Println("\nActions:")
+		fmt.Println("  set <site> blue|green <servers>  Set the comma-separated servers (host:port or unix:<socket>) of a pool;")
+		fmt.Println("                                   the first time, the servers of the upstream become the blue pool")
+		fmt.Println("  switch <site> [blue|green]       Send all the traffic to a pool (default: the inactive one)")
+		fmt.Println("  canary <site> <percent>          Send a share of the traffic to the inactive pool; 0 ends the canary")
+		fmt.Println("  rollback <site>                  Go back to the traffic split before the last switch or canary")
+		fmt.Println("  status [site]                    Print the pools of a site, or of every site with pools")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --upstream=<name>    Upstream of the site to replace with the pools, on the first set (default: the site name)")
+		fmt.Println("  --key=<key>          split_clients key choosing the pool of a client, e.g. $cookie_session (default: $remote_addr)")
+		fmt.Println("  --no-reload          Do not reload nginx after the change")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nThe pools are stored in <config-dir>/nx2/pools/<site>.json and rendered into the site file as the")
+		fmt.Println("upstreams <upstream>_blue and <upstream>_green and a split_clients block; the proxy_pass of the site")
+		fmt.Println("uses the variable it sets. The site file is rewritten in the nx2 fmt style. If nginx -t fails, every")
+		fmt.Println("file is restored.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 pool set example green 10.0.0.21:8080,10.0.0.22:8080")
+		fmt.Println("  nx2 pool canary example 10")
+		fmt.Println("  nx2 pool switch example")
+		fmt.Println("  nx2 pool rollback example")
+		return 0
+	}
+
+	if action == "status" {
+		var sites []string
+		if site != "" {
+			sites = []string{siteName(siteFile(*configDir, site))}
+		} else {
+			files, _ := filepath.Glob(filepath.Join(*configDir, "nx2", "pools", "*.json"))
+			for _, file := range files {
+				sites = append(sites, strings.TrimSuffix(filepath.Base(file), ".json"))
+			}
+			sort.Strings(sites)
+			if len(sites) == 0 {
+				fmt.Println("No site has pools.")
+			}
+		}
+		status := 0
+		for _, name := range sites {
+			state, err := readPools(poolFile(*configDir, name))
+			switch {
+			case err != nil:
+				fmt.Printf("Error: %v\n", err)
+				status = 2
+			case state == nil:
+				fmt.Printf("%s: no pools\n", name)
+			default:
+				printPools(name, state)
+			}
+		}
+		return status
+	}
+
+	path := siteFile(*configDir, site)
+	site = siteName(path)
+	statePath := poolFile(*configDir, site)
+	f, err := nginxconf.ParseFile(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 2
+	}
+	state, err := readPools(statePath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 2
+	}
+	if state == nil {
+		if action != "set" {
+			fmt.Printf("Error: %s has no pools; define them with nx2 pool set first.\n", site)
+			return 2
+		}
+		if *upstream == "" {
+			*upstream = site
+		}
+		if state, err = initPools(f, *upstream, poolVariable(site)); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 2
+		}
+	}
+	if *key != "" {
+		if !strings.HasPrefix(*key, "$") || strings.ContainsAny(*key, " \t;{}\"'") {
+			fmt.Printf("Error: Invalid key %s; use nginx variables such as $remote_addr or $cookie_session.\n", *key)
+			return 1
+		}
+		state.Key = *key
+	}
+
+	current := state.poolRoute
+	switch action {
+	case "set":
+		pool, list := fs.Arg(2), fs.Arg(3)
+		if pool != "blue" && pool != "green" {
+			fmt.Println("Error: Use set <site> blue|green <servers>.")
+			return 1
+		}
+		var servers []string
+		for _, value := range strings.Split(list, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			if strings.ContainsAny(value, ";{}#") {
+				fmt.Printf("Error: Invalid server %s.\n", value)
+				return 1
+			}
+			servers = append(servers, value)
+		}
+		if len(servers) == 0 {
+			fmt.Printf("Error: Give the servers of the %s pool, e.g. 10.0.0.21:8080,10.0.0.22:8080.\n", pool)
+			return 1
+		}
+		state.Pools[pool] = servers
+		if pool == state.Active || state.Canary > 0 {
+			fmt.Printf("Warning: The %s pool receives traffic; the new servers are used after the reload.\n", pool)
+		}
+	case "switch":
+		target := fs.Arg(2)
+		if target == "" {
+			target = otherPool(state.Active)
+		}
+		if target != "blue" && target != "green" {
+			fmt.Println("Error: Use switch <site> [blue|green].")
+			return 1
+		}
+		if target == state.Active && state.Canary == 0 {
+			fmt.Printf("Nothing to do; all the traffic of %s already goes to %s.\n", site, target)
+			return 0
+		}
+		state.poolRoute = poolRoute{Active: target}
+	case "canary":
+		percent, err := strconv.Atoi(strings.TrimSuffix(fs.Arg(2), "%"))
+		if err != nil || percent < 0 || percent > 99 {
+			fmt.Println("Error: Use canary <site> <percent>, from 1 to 99, or 0 to end the canary.")
+			return 1
+		}
+		state.Canary = percent
+	case "rollback":
+		if state.Previous == nil {
+			fmt.Printf("Error: %s has no previous traffic split to go back to.\n", site)
+			return 2
+		}
+		state.poolRoute = *state.Previous
+	default:
+		fmt.Printf("Error: Unknown action %s. Use set, switch, canary, rollback or status.\n", action)
+		return 1
+	}
+	for _, pool := range poolNames {
+		if len(state.Pools[pool]) == 0 && (pool == state.Active || state.Canary > 0) {
+			fmt.Printf("Error: The %s pool has no servers; define them with nx2 pool set first.\n", pool)
+			return 2
+		}
+	}
+	if state.poolRoute != current {
+		state.Previous = &current
+	}
+
+	if err := renderPools(f, site, state); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 2
+	}
+	backup := map[string][]byte{}
+	for _, file := range []string{path, statePath} {
+		previous, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Error: Failed to read %s: %v\n", file, err)
+			return 1
+		}
+		backup[file] = previous
+	}
+	// Both files are replaced atomically, the state first: a site file that is written
+	// always has the state it was rendered from
+	if err := writePools(statePath, state); err != nil {
+		fmt.Printf("Error: Failed to write %s: %v\n", statePath, err)
+		restoreFiles(backup)
+		return 1
+	}
+	if err := f.WriteFile(); err != nil {
+		fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+		restoreFiles(backup)
+		return 1
+	}
+	fmt.Printf("Traffic of %s: %s (%s)\n", site, describeRoute(state.poolRoute), path)
+
+	if *noReload {
+		return 0
+	}
+	if err := reloadNginx(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		restoreFiles(backup)
+		fmt.Println("Previous configuration restored.")
+		return 3
+	}
+	fmt.Println("Nginx reloaded.")
+	return 0
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+var realIPHeaderPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// realIPConfig is the http-level realip configuration: the trusted load balancers and the
+// header or PROXY protocol field carrying the client address.
+type realIPConfig struct {
+	networks  []string
+	header    string
+	recursive bool
+}
+
+// realIPFile returns the http-level snippet of the trusted load balancers managed by
+// nx2 realip, loaded by the conf.d/*.conf include like the zones snippet.
+func realIPFile(configDir string) string {
+	return filepath.Join(configDir, "conf.d", "nx2-realip.conf")
+}
+
+// readRealIP returns the configuration of the nx2 realip snippet.
+func readRealIP(path string) (realIPConfig, error) {
+	var c realIPConfig
+	f, err := nginxconf.ParseFile(path)
+	if err != nil {
+		return c, err
+	}
+	for _, d := range f.Directives {
+		switch d.Name {
+		case "set_real_ip_from":
+			c.networks = append(c.networks, d.Arg(0))
+		case "real_ip_header":
+			c.header = d.Arg(0)
+		case "real_ip_recursive":
+			c.recursive = d.Arg(0) == "on"
+		}
+	}
+	return c, nil
+}
+
+// writeRealIP writes the nx2 realip snippet.
+func writeRealIP(path string, c realIPConfig) error {
+	f := &nginxconf.File{Path: path}
+	f.Directives = append(f.Directives,
+		nginxconf.NewComment("Trusted load balancers managed by nx2 realip; sites created with"),
+		nginxconf.NewComment("nx2create --real-ip-from replace this list with their own."))
+	for _, network := range c.networks {
+		f.Directives = append(f.Directives, nginxconf.New("set_real_ip_from", network))
+	}
+	f.Directives = append(f.Directives, nginxconf.New("real_ip_header", c.header))
+	if c.recursive {
+		f.Directives = append(f.Directives, nginxconf.New("real_ip_recursive", "on"))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return f.WriteFile()
+}
+
+// proxyProtocolListens counts the enabled listen directives accepting the PROXY protocol.
+func proxyProtocolListens(configDir string) (int, error) {
+	directives, err := enabledConfig(configDir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, d := range findServers(directives) {
+		for _, l := range newServer(d).listens {
+			if l.proxyProtocol {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func runRealIP(args []string) int {
+	fs := flag.NewFlagSet("realip", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	header := fs.String("header", "", "Header with the client address, or proxy_protocol")
+	recursive := fs.Bool("recursive", false, "Skip every trusted address in the header instead of only the last one")
+	noReload := fs.Bool("no-reload", false, "Do not reload nginx after the change")
+	fs.Parse(args)
+
+	action := fs.Arg(0)
+	if *help || action == "" {
+		fmt.Println("Usage: nx2 realip [--config-dir=<path>] [--header=<name>] [--recursive] [--no-reload] set|add|remove|clear|show [network...]")
+		fmt.Println("Manage the load balancers trusted to report the client address for every site.")
+		fmt.Println("\nActions:")
+		fmt.Println("  set <network>...     Replace the trusted networks")
+		fmt.Println("  add <network>...     Add trusted networks")
+		fmt.Println("  remove <network>...  Remove trusted networks")
+		fmt.Println("  clear                Remove the configuration, so nginx logs the address of the connecting peer")
+		fmt.Println("  show                 Print the trusted networks and the header")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --header=<name>      Header with the client address: X-Forwarded-For (default), X-Real-IP, ... or proxy_protocol")
+		fmt.Println("                       for L4 load balancers sending the PROXY protocol")
+		fmt.Println("  --recursive          Skip every trusted address in X-Forwarded-For instead of only the last one")
+		fmt.Println("                       (disable with --recursive=false)")
+		fmt.Println("  --no-reload          Do not reload nginx after the change")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nThe configuration is stored in <config-dir>/conf.d/nx2-realip.conf, which nginx.conf must include in the")
+		fmt.Println("http block. Sites created with nx2create --real-ip-from use their own list instead. With")
+		fmt.Println("--header=proxy_protocol, the sites must listen with proxy_protocol (nx2create --accept-proxy-protocol).")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 realip set 10.0.0.0/24")
+		fmt.Println("  nx2 realip --header=proxy_protocol set 10.0.0.10 10.0.0.11")
+		fmt.Println("  nx2 realip --recursive add 2001:db8::/64")
+		return 0
+	}
+
+	path := realIPFile(*configDir)
+	config, err := readRealIP(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Error: Failed to read %s: %v\n", path, err)
+		return 1
+	}
+	exists := err == nil
+
+	switch action {
+	case "show":
+		if !exists {
+			fmt.Println("No trusted load balancers; nginx logs the address of the connecting peer.")
+			return 0
+		}
+		for _, network := range config.networks {
+			fmt.Println(network)
+		}
+		fmt.Printf("\nHeader: %s\n", config.header)
+		if config.recursive {
+			fmt.Println("Recursive: on")
+		}
+		return 0
+	case "set", "add", "remove", "clear":
+	default:
+		fmt.Printf("Error: Unknown action %s. Use set, add, remove, clear or show.\n", action)
+		return 1
+	}
+
+	previous, readErr := os.ReadFile(path)
+	if action == "clear" {
+		if !exists {
+			fmt.Printf("Nothing to clear; %s does not exist.\n", path)
+			return 0
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("Error: Failed to remove %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("Trusted load balancers removed: %s\n", path)
+	} else {
+		var given []string
+		for _, value := range fs.Args()[1:] {
+			network, err := normalizeCIDR(value)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return 1
+			}
+			given = append(given, network)
+		}
+		if len(given) == 0 {
+			fmt.Println("Error: At least one network is required.")
+			return 1
+		}
+
+		switch action {
+		case "set":
+			config.networks = nil
+			fallthrough
+		case "add":
+			for _, network := range given {
+				found := false
+				for _, existing := range config.networks {
+					found = found || existing == network
+				}
+				if !found {
+					config.networks = append(config.networks, network)
+				}
+			}
+		case "remove":
+			var kept []string
+			for _, existing := range config.networks {
+				remove := false
+				for _, network := range given {
+					remove = remove || existing == network
+				}
+				if !remove {
+					kept = append(kept, existing)
+				}
+			}
+			if len(kept) == 0 {
+				fmt.Println("Error: No trusted network would be left. Use clear instead.")
+				return 2
+			}
+			config.networks = kept
+		}
+
+		if *header != "" {
+			config.header = *header
+		} else if config.header == "" {
+			config.header = "X-Forwarded-For"
+		}
+		if config.header != "proxy_protocol" && !realIPHeaderPattern.MatchString(config.header) {
+			fmt.Printf("Error: Invalid header %s; use proxy_protocol or a header name such as X-Forwarded-For.\n", config.header)
+			return 1
+		}
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "recursive" {
+				config.recursive = *recursive
+			}
+		})
+
+		if err := writeRealIP(path, config); err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("Trusted load balancers saved with %d network(s) and header %s: %s\n", len(config.networks), config.header, path)
+		if !snippetIncluded(*configDir, path) {
+			fmt.Printf("Warning: %s is not included by nginx.conf; add \"include conf.d/*.conf;\" to the http block.\n", path)
+		}
+		if config.header == "proxy_protocol" {
+			if count, err := proxyProtocolListens(*configDir); err == nil && count == 0 {
+				fmt.Println("Warning: No enabled site listens with proxy_protocol, so nginx keeps the load balancer address; create the sites with nx2create --accept-proxy-protocol.")
+			}
+		}
+	}
+
+	if *noReload {
+		return 0
+	}
+	if err := reloadNginx(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		if readErr == nil {
+			os.WriteFile(path, previous, 0644)
+		} else {
+			os.Remove(path)
+		}
+		fmt.Printf("Previous configuration of %s restored.\n", path)
+		return 3
+	}
+	fmt.Println("Nginx reloaded.")
+	return 0
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// Results of a location lookup, following ngx_http_core_find_location.
+const (
+	locationDeclined = iota // no location matched at this level
+	locationPrefix          // a prefix location matched; regexes may still win
+	locationFinal           // an exact, ^~ or regex location matched
+)
+
+// location is the parsed header of a location block.
+type location struct {
+	d        *nginxconf.Directive
+	modifier string // "", "=", "^~", "~", "~*" or "@"
+	path     string
+}
+
+// parseLocation splits the arguments of a location directive, accepting modifiers
+// attached to the path such as "location =/health".
+func parseLocation(d *nginxconf.Directive) location {
+	loc := location{d: d}
+	switch len(d.Args) {
+	case 2:
+		loc.modifier, loc.path = d.Arg(0), d.Arg(1)
+	case 1:
+		loc.path = d.Arg(0)
+		for _, mod := range []string{"=", "^~", "~*", "~", "@"} {
+			if strings.HasPrefix(loc.path, mod) && loc.path != mod {
+				loc.modifier, loc.path = mod, strings.TrimPrefix(loc.path, mod)
+				if mod == "@" {
+					loc.path = d.Arg(0)
+				}
+				break
+			}
+		}
+	}
+	return loc
+}
+
+// header formats the location as written in the config.
+func (l location) header() string {
+	if l.modifier == "" || l.modifier == "@" {
+		return "location " + l.path
+	}
+	return "location " + l.modifier + " " + l.path
+}
+
+// findLocation selects the location for a URI among the locations of a block, appending
+// the selected location and its nested locations to chain. Exact matches win, then the
+// longest prefix (and its nested locations); unless that prefix uses ^~, the regexes are
+// then tried in config order and the first match wins.
+func findLocation(block []*nginxconf.Directive, uri string, chain *[]location) int {
+	var exact, prefix *location
+	var regexes []location
+	for _, d := range nginxconf.Find(block, "location") {
+		loc := parseLocation(d)
+		switch loc.modifier {
+		case "=":
+			if loc.path == uri && exact == nil {
+				exact = &loc
+			}
+		case "", "^~":
+			if strings.HasPrefix(uri, loc.path) && (prefix == nil || len(loc.path) > len(prefix.path)) {
+				prefix = &loc
+			}
+		case "~", "~*":
+			regexes = append(regexes, loc)
+		}
+	}
+
+	if exact != nil {
+		*chain = append(*chain, *exact)
+		return locationFinal
+	}
+
+	base := len(*chain)
+	rc := locationDeclined
+	noRegex := false
+	if prefix != nil {
+		*chain = append(*chain, *prefix)
+		noRegex = prefix.modifier == "^~"
+		if findLocation(prefix.d.Block, uri, chain) == locationFinal {
+			return locationFinal
+		}
+		rc = locationPrefix
+	}
+	if noRegex {
+		return locationFinal
+	}
+
+	for _, loc := range regexes {
+		pattern := loc.path
+		if loc.modifier == "~*" {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Printf("Warning: Cannot evaluate %s (%s): %v\n", loc.header(), loc.d.Pos, err)
+			continue
+		}
+		if re.MatchString(uri) {
+			*chain = append((*chain)[:base], loc)
+			findLocation(loc.d.Block, uri, chain)
+			return locationFinal
+		}
+	}
+	return rc
+}
+
+// matchServerName selects a server by name following nginx's order: exact name, longest
+// wildcard starting with an asterisk, longest wildcard ending with an asterisk, then the
+// first matching regex.
+func matchServerName(servers []*server, host string) (*server, string) {
+	host = strings.ToLower(host)
+	var leading, trailing *server
+	var leadingName, trailingName string
+	for _, s := range servers {
+		for _, name := range s.names {
+			switch {
+			case name == host:
+				return s, fmt.Sprintf("exact name %s", name)
+			case strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) && len(name) > len(leadingName):
+				leading, leadingName = s, name
+			case strings.HasPrefix(name, ".") && (host == name[1:] || strings.HasSuffix(host, name)) && len(name) > len(leadingName):
+				leading, leadingName = s, name
+			case strings.HasSuffix(name, ".*") && strings.HasPrefix(host, name[:len(name)-1]) && len(name) > len(trailingName):
+				trailing, trailingName = s, name
+			}
+		}
+	}
+	if leading != nil {
+		return leading, fmt.Sprintf("wildcard name %s", leadingName)
+	}
+	if trailing != nil {
+		return trailing, fmt.Sprintf("wildcard name %s", trailingName)
+	}
+
+	for _, s := range servers {
+		for _, name := range s.names {
+			if !strings.HasPrefix(name, "~") {
+				continue
+			}
+			re, err := regexp.Compile(name[1:])
+			if err != nil {
+				fmt.Printf("Warning: Cannot evaluate server name %s (%s): %v\n", name, s.d.Pos, err)
+				continue
+			}
+			if re.MatchString(host) {
+				return s, fmt.Sprintf("regex name %s", name)
+			}
+		}
+	}
+	return nil, ""
+}
+
+// selectServer picks the listen socket and server block nginx would use for a connection
+// to addr:port with the given Host. When addr is empty, wildcard sockets are assumed.
+func selectServer(servers []*server, addr, port, host string) (*server, string, string) {
+	// nginx accepts the connection on the most specific socket: an exact address
+	// wins over the wildcard socket of the same port.
+	wildcard := "*:" + port
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		wildcard = "[::]:" + port
+	}
+	socket := wildcard
+	if addr != "" {
+		exact := net.JoinHostPort(addr, port)
+		for _, s := range servers {
+			for _, l := range s.listens {
+				if l.addr == exact {
+					socket = exact
+				}
+			}
+		}
+	}
+
+	var candidates []*server
+	var defaultServer *server
+	for _, s := range servers {
+		for _, l := range s.listens {
+			if l.addr != socket {
+				continue
+			}
+			candidates = append(candidates, s)
+			if l.defaultServer && defaultServer == nil {
+				defaultServer = s
+			}
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, socket, ""
+	}
+
+	if s, reason := matchServerName(candidates, host); s != nil {
+		return s, socket, reason
+	}
+	if defaultServer != nil {
+		return defaultServer, socket, "default_server for " + socket
+	}
+	return candidates[0], socket, "first server on " + socket + ", no default_server"
+}
+
+// inherited returns the first directive with the given name, searching from the
+// innermost location outwards to the server block.
+func inherited(name string, srv *nginxconf.Directive, chain []location) *nginxconf.Directive {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if found := nginxconf.Find(chain[i].d.Block, name); len(found) > 0 {
+			return found[0]
+		}
+	}
+	if found := nginxconf.Find(srv.Block, name); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// describeTarget explains what the selected location does with the request.
+func describeTarget(all []*nginxconf.Directive, srv *nginxconf.Directive, chain []location, uri string) []string {
+	var lines []string
+	var block []*nginxconf.Directive
+	if len(chain) > 0 {
+		block = chain[len(chain)-1].d.Block
+	}
+
+	for _, name := range []string{"return", "proxy_pass", "fastcgi_pass", "uwsgi_pass", "scgi_pass", "grpc_pass"} {
+		found := nginxconf.Find(block, name)
+		if len(found) == 0 {
+			continue
+		}
+		d := found[0]
+		lines = append(lines, fmt.Sprintf("%s %s (%s)", name, strings.Join(d.Values(), " "), d.Pos))
+
+		// Show the servers of the upstream group the request is passed to
+		if name != "return" && len(d.Args) > 0 {
+			target := d.Arg(0)
+			if _, rest, ok := strings.Cut(target, "://"); ok {
+				target = rest
+			}
+			target, _, _ = strings.Cut(target, "/")
+			for _, u := range findUpstreams(all) {
+				if len(u.Args) == 1 && u.Arg(0) == target {
+					for _, s := range nginxconf.Find(u.Block, "server") {
+						lines = append(lines, fmt.Sprintf("  upstream %s: server %s (%s)", target, strings.Join(s.Values(), " "), s.Pos))
+					}
+				}
+			}
+		}
+		return lines
+	}
+
+	if d := inherited("alias", srv, chain); d != nil && len(d.Args) > 0 && len(chain) > 0 {
+		file := d.Arg(0) + strings.TrimPrefix(uri, chain[len(chain)-1].path)
+		lines = append(lines, fmt.Sprintf("alias %s (%s) -> %s", d.Arg(0), d.Pos, file))
+	} else if d := inherited("root", srv, chain); d != nil && len(d.Args) > 0 {
+		lines = append(lines, fmt.Sprintf("root %s (%s) -> %s", d.Arg(0), d.Pos, strings.TrimSuffix(d.Arg(0), "/")+uri))
+	} else {
+		lines = append(lines, "root html (nginx default) -> html"+uri)
+	}
+	if d := inherited("try_files", srv, chain); d != nil {
+		lines = append(lines, fmt.Sprintf("try_files %s (%s)", strings.Join(d.Values(), " "), d.Pos))
+	}
+	return lines
+}
+
+// findUpstreams returns the upstream blocks of the http context.
+func findUpstreams(directives []*nginxconf.Directive) []*nginxconf.Directive {
+	var upstreams []*nginxconf.Directive
+	for _, d := range nginxconf.Expand(directives) {
+		switch {
+		case !d.IsBlock, d.Name == "stream", d.Name == "mail", d.Name == "server":
+		case d.Name == "upstream":
+			upstreams = append(upstreams, d)
+		default:
+			upstreams = append(upstreams, findUpstreams(d.Block)...)
+		}
+	}
+	return upstreams
+}
+
+func runRoute(args []string) int {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	useNginxT := fs.Bool("nginx-t", false, "Read the effective configuration from nginx -T")
+	dumpFile := fs.String("dump", "", "Read the configuration from a saved nginx -T output (- for stdin)")
+	addr := fs.String("addr", "", "Local address the request arrives on (default: wildcard listen sockets)")
+	fs.Parse(args)
+
+	if *help || fs.NArg() == 0 {
+		fmt.Println("Usage: nx2 route [--config-dir=<path>] [--nginx-t | --dump=<file>] [--addr=<ip>] <url>")
+		fmt.Println("Show which server block and location nginx selects for a URL and where the request goes.")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --nginx-t            Read the effective configuration from 'nginx -T' instead of the files")
+		fmt.Println("  --dump=<file>        Read a saved 'nginx -T' output (- for stdin)")
+		fmt.Println("  --addr=<ip>          Local address the request arrives on (default: wildcard listen sockets)")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 route https://foo.example.com/api/v1/x")
+		fmt.Println("  nx2 route --nginx-t --addr=10.0.0.1 http://example.com:8080/")
+		fmt.Println("\nNotes:")
+		fmt.Println("  - Regular expressions are evaluated with Go's regexp package, which covers the usual PCRE syntax.")
+		fmt.Println("  - Rewrites, try_files fallbacks and named locations are shown but not followed.")
+		return 0
+	}
+
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil || u.Host == "" {
+		fmt.Printf("Error: Invalid URL %s (e.g., https://www.example.com/path).\n", fs.Arg(0))
+		return 1
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	uri := u.Path
+	if uri == "" {
+		uri = "/"
+	}
+
+	// Load the configuration
+	var directives []*nginxconf.Directive
+	switch {
+	case *dumpFile != "":
+		var content []byte
+		if *dumpFile == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(*dumpFile)
+		}
+		if err == nil {
+			directives, err = dumpConfig(content)
+		}
+	case *useNginxT:
+		cmd := exec.Command("nginx", "-T")
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Println("Error: nginx -T failed. Details:")
+			fmt.Println(stderr.String())
+			return 2
+		}
+		directives, err = dumpConfig(stdout.Bytes())
+	default:
+		if _, statErr := os.Stat(*configDir); os.IsNotExist(statErr) {
+			fmt.Printf("Error: Configuration directory %s does not exist.\n", *configDir)
+			return 1
+		}
+		directives, err = enabledConfig(*configDir)
+	}
+	if err != nil {
+		fmt.Printf("Error: Failed to parse configuration: %v\n", err)
+		return 2
+	}
+
+	var servers []*server
+	for _, d := range findServers(directives) {
+		servers = append(servers, newServer(d))
+	}
+
+	fmt.Printf("Request:  %s %s (host %s, port %s)\n", strings.ToUpper(u.Scheme), uri, u.Hostname(), port)
+	srv, socket, reason := selectServer(servers, *addr, port, u.Hostname())
+	if srv == nil {
+		fmt.Printf("Error: No server listens on %s.\n", socket)
+		return 3
+	}
+	fmt.Printf("Server:   %s (%s)\n", srv.d.Pos, reason)
+	fmt.Printf("          listen socket %s, server_name %s\n", socket, strings.Join(srv.names, " "))
+	for _, l := range srv.listens {
+		if l.addr == socket && (u.Scheme == "https") != l.ssl {
+			fmt.Printf("Warning: The %s request arrives on a listen socket %s ssl (%s).\n", u.Scheme, map[bool]string{true: "with", false: "without"}[l.ssl], l.d.Pos)
+			break
+		}
+	}
+
+	// A return at server level runs before any location is selected
+	if found := nginxconf.Find(srv.d.Block, "return"); len(found) > 0 {
+		d := found[0]
+		fmt.Println("Location: none (server-level return)")
+		fmt.Printf("Target:   return %s (%s)\n", strings.Join(d.Values(), " "), d.Pos)
+		return 0
+	}
+
+	var chain []location
+	findLocation(srv.d.Block, uri, &chain)
+	if len(chain) == 0 {
+		fmt.Println("Location: none (server-level configuration)")
+	} else {
+		for i, loc := range chain {
+			label := "Location:"
+			if i > 0 {
+				label = "  nested:"
+			}
+			fmt.Printf("%-9s %s (%s)\n", label, loc.header(), loc.d.Pos)
+		}
+	}
+	for i, line := range describeTarget(directives, srv.d, chain, uri) {
+		label := "Target:"
+		if i > 0 {
+			label = ""
+		}
+		fmt.Printf("%-9s %s\n", label, line)
+	}
+	return 0
+}
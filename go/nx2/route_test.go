@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+// parseServers parses a config and returns its server blocks.
+func parseServers(t *testing.T, src string) []*server {
+	t.Helper()
+	f, err := nginxconf.Parse([]byte(src), "test.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []*server
+	for _, d := range findServers(f.Directives) {
+		servers = append(servers, newServer(d))
+	}
+	return servers
+}
+
+func TestFindLocation(t *testing.T) {
+	servers := parseServers(t, `server {
+    location / {}
+    location /api {}
+    location = /api/health {}
+    location ^~ /static/ {}
+    location /app/ {
+        location ~ \.php$ {}
+        location /app/admin/ {}
+    }
+    location ~ \.php$ {}
+    location ~* \.(png|jpg)$ {}
+    location ~ ^/api/v2 {}
+}
+`)
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/apix", "location /api"},
+		{"/api/health", "location = /api/health"},
+		{"/api/healthz", "location /api"},
+		{"/api/v2/users", "location ~ ^/api/v2"},
+		{"/static/logo.png", "location ^~ /static/"},
+		{"/img/LOGO.PNG", "location ~* \\.(png|jpg)$"},
+		{"/index.php", "location ~ \\.php$"},
+		{"/app/index.php", "location /app/ > location ~ \\.php$"},
+		{"/app/admin/users", "location /app/ > location /app/admin/"},
+		{"/other", "location /"},
+	}
+	for _, tt := range tests {
+		var chain []location
+		findLocation(servers[0].d.Block, tt.uri, &chain)
+		var headers []string
+		for _, loc := range chain {
+			headers = append(headers, loc.header())
+		}
+		if got := strings.Join(headers, " > "); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestSelectServer(t *testing.T) {
+	servers := parseServers(t, `server {
+    listen 80 default_server;
+    server_name default.test;
+}
+server {
+    listen 80;
+    server_name *.example.com;
+}
+server {
+    listen 80;
+    server_name www.example.com;
+}
+server {
+    listen 80;
+    server_name www.example.*;
+}
+server {
+    listen 80;
+    server_name ~^api\d+\.example\.org$;
+}
+server {
+    listen 10.0.0.1:80;
+    server_name www.example.com;
+}
+server {
+    listen [::]:80;
+    server_name v6.test;
+}
+`)
+	tests := []struct {
+		addr, host string
+		want       string // server_name and socket of the selected server
+	}{
+		{"", "www.example.com", "www.example.com *:80"},
+		{"", "shop.example.com", "*.example.com *:80"},
+		{"", "www.example.net", "www.example.* *:80"},
+		{"", "api7.example.org", "~^api\\d+\\.example\\.org$ *:80"},
+		{"", "unknown.test", "default.test *:80"},
+		{"10.0.0.1", "www.example.com", "www.example.com 10.0.0.1:80"},
+		{"10.0.0.2", "www.example.com", "www.example.com *:80"},
+		{"::1", "v6.test", "v6.test [::]:80"},
+	}
+	for _, tt := range tests {
+		s, socket, _ := selectServer(servers, tt.addr, "80", tt.host)
+		if s == nil {
+			t.Errorf("%s %s: no server", tt.addr, tt.host)
+			continue
+		}
+		if got := s.names[0] + " " + socket; got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.addr, tt.host, got, tt.want)
+		}
+		// The address socket is chosen over *:80 although both have www.example.com
+		if tt.addr == "10.0.0.1" && s.listens[0].addr != "10.0.0.1:80" {
+			t.Errorf("%s %s: selected the server of %s", tt.addr, tt.host, s.listens[0].addr)
+		}
+	}
+}
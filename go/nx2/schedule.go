@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// scheduleEntry is a pending enable or disable of a site.
+type scheduleEntry struct {
+	ID     int       `json:"id"`
+	Action string    `json:"action"` // enable or disable
+	Site   string    `json:"site"`
+	Stream bool      `json:"stream,omitempty"` // site of streams-available
+	At     time.Time `json:"at"`
+}
+
+// scheduleFile returns the file of the pending schedules.
+func scheduleFile(configDir string) string {
+	return filepath.Join(configDir, "nx2", "schedule.json")
+}
+
+// lockSchedule takes an exclusive lock on the schedules, so that a runner started by a
+// timer and a schedule added by nx2ensite do not overwrite each other's changes.
+func lockSchedule(configDir string) (unlock func(), err error) {
+	path := scheduleFile(configDir) + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// readSchedule returns the pending schedules, none when the file does not exist.
+func readSchedule(path string) ([]scheduleEntry, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []scheduleEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("invalid schedule file %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// writeSchedule replaces the schedule file atomically, sorted by time.
+func writeSchedule(path string, entries []scheduleEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	if entries == nil {
+		entries = []scheduleEntry{}
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// parseDuration parses a Go duration such as 90m or 2h30m, also accepting days, e.g. 7d.
+func parseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %s; use e.g. 90m, 2h or 7d", value)
+	}
+	return d, nil
+}
+
+// scheduleTimeLayouts are the absolute times accepted by --at, in local time unless the
+// value has an offset.
+var scheduleTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04"}
+
+// parseScheduleTime parses --at: a time of day such as 02:00 (the next one), a date and
+// time such as "2026-11-01 08:00", RFC 3339, or a delay from now such as +2h.
+func parseScheduleTime(value string, now time.Time) (time.Time, error) {
+	if delay, ok := strings.CutPrefix(value, "+"); ok {
+		d, err := parseDuration(delay)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	if clock, err := time.ParseInLocation("15:04", value, now.Location()); err == nil {
+		at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+	for _, layout := range scheduleTimeLayouts {
+		if at, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			if !at.After(now) {
+				return time.Time{}, fmt.Errorf("%s is in the past", value)
+			}
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s; use e.g. 02:00, \"2026-11-01 08:00\" or +2h", value)
+}
+
+// reverseAction returns the action undoing another one.
+func reverseAction(action string) string {
+	if action == "enable" {
+		return "disable"
+	}
+	return "enable"
+}
+
+// runEntry runs a due schedule with nx2ensite or nx2dissite, which test the configuration,
+// reload nginx and restore the previous state when the test fails. A site that is already
+// in the scheduled state, for instance disabled by hand before the schedule was due, is
+// reported and left alone.
+func runEntry(configDir string, e scheduleEntry) error {
+	enabledDir := "sites-enabled"
+	if e.Stream {
+		enabledDir = "streams-enabled"
+	}
+	_, err := os.Lstat(filepath.Join(configDir, enabledDir, e.Site+".conf"))
+	if enabled := err == nil; enabled == (e.Action == "enable") {
+		fmt.Printf("Site %s is already %sd in %s; nothing to do.\n", e.Site, e.Action, enabledDir)
+		return nil
+	}
+
+	args := []string{"--config-dir=" + configDir}
+	if e.Stream {
+		args = append(args, "--stream")
+	}
+	name := "nx2dissite"
+	if e.Action == "enable" {
+		name = "nx2ensite"
+		args = append(args, "-f")
+	}
+	cmd := exec.Command(name, append(args, e.Site)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	return nil
+}
+
+func runSchedule(args []string) int {
+	fs := flag.NewFlagSet("schedule", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	at := fs.String("at", "", "Time of the action: 02:00, \"2026-11-01 08:00\", RFC 3339 or +2h")
+	duration := fs.String("for", "", "Undo the action after this long, e.g. 2h or 7d")
+	stream := fs.Bool("stream", false, "The site is a stream site of streams-available")
+	dryRun := fs.Bool("dry-run", false, "Check the options of add and print the schedules without recording them")
+	fs.Parse(args)
+
+	action := fs.Arg(0)
+	if *help || action == "" {
+		fmt.Println("Usage: nx2 schedule [--config-dir=<path>] run|list|cancel|add [options]")
+		fmt.Println("Enable and disable sites at a given time, as recorded by nx2ensite and nx2dissite --at and --for.")
+		fmt.Println("\nActions:")
+		fmt.Println("  run                  Run the schedules that are due; call it every minute from a systemd timer or cron")
+		fmt.Println("  list                 Print the pending schedules")
+		fmt.Println("  cancel <id|site>     Remove a pending schedule, or every pending schedule of a site")
+		fmt.Println("  add [--at=<time>] [--for=<duration>] [--stream] [--dry-run] enable|disable <site>")
+		fmt.Println("                       Record a schedule; with --for, the opposite action is recorded after the duration")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --at=<time>          Time of day (02:00, the next one), date and time (\"2026-11-01 08:00\"), RFC 3339,")
+		fmt.Println("                       or a delay from now (+90m, +2h, +7d)")
+		fmt.Println("  --for=<duration>     Undo the action after this long, e.g. 90m, 2h or 7d")
+		fmt.Println("  --stream             The site is a stream site of streams-available")
+		fmt.Println("  --dry-run            Check the options of add and print the schedules without recording them")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nThe schedules are stored in <config-dir>/nx2/schedule.json. run enables and disables the sites with")
+		fmt.Println("nx2ensite and nx2dissite, which test the configuration, reload nginx and restore the previous state")
+		fmt.Println("when the test fails; failed schedules are reported and dropped, and sites already in the scheduled")
+		fmt.Println("state are left alone.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2ensite --at=\"2026-11-01 08:00\" --for=7d campaign")
+		fmt.Println("  nx2dissite --at=02:00 --for=2h erp")
+		fmt.Println("  nx2 schedule list")
+		fmt.Println("  nx2 schedule cancel erp")
+		fmt.Println("  echo '* * * * * root nx2 schedule run' > /etc/cron.d/nx2-schedule")
+		return 0
+	}
+
+	path := scheduleFile(*configDir)
+	unlock, err := lockSchedule(*configDir)
+	if err != nil {
+		fmt.Printf("Error: Failed to lock %s: %v\n", path, err)
+		return 1
+	}
+	defer unlock()
+	entries, err := readSchedule(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	switch action {
+	case "list":
+		if len(entries) == 0 {
+			fmt.Println("No pending schedules.")
+			return 0
+		}
+		for _, e := range entries {
+			site := e.Site
+			if e.Stream {
+				site += " (stream)"
+			}
+			fmt.Printf("%-4d %-25s %-8s %s\n", e.ID, e.At.Format("2006-01-02 15:04 -0700"), e.Action, site)
+		}
+		return 0
+	case "cancel":
+		target := fs.Arg(1)
+		if target == "" {
+			fmt.Println("Error: Give the id or the site of the schedules to cancel.")
+			return 1
+		}
+		var kept []scheduleEntry
+		for _, e := range entries {
+			if strconv.Itoa(e.ID) == target || e.Site == target {
+				fmt.Printf("Cancelled: %s %s at %s\n", e.Action, e.Site, e.At.Format("2006-01-02 15:04"))
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(entries) {
+			fmt.Printf("Error: No pending schedule matches %s.\n", target)
+			return 2
+		}
+		if err := writeSchedule(path, kept); err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+			return 1
+		}
+		return 0
+	case "add":
+		verb, site := fs.Arg(1), fs.Arg(2)
+		if (verb != "enable" && verb != "disable") || site == "" {
+			fmt.Println("Error: Use add [--at=<time>] [--for=<duration>] enable|disable <site>.")
+			return 1
+		}
+		if *at == "" && *duration == "" {
+			fmt.Println("Error: --at or --for is required.")
+			return 1
+		}
+		now := time.Now()
+		next := 1
+		for _, e := range entries {
+			if e.ID >= next {
+				next = e.ID + 1
+			}
+		}
+		start := now
+		var added []scheduleEntry
+		if *at != "" {
+			if start, err = parseScheduleTime(*at, now); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return 1
+			}
+			added = append(added, scheduleEntry{ID: next, Action: verb, Site: site, Stream: *stream, At: start})
+		}
+		if *duration != "" {
+			d, err := parseDuration(*duration)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return 1
+			}
+			// Without --at, the caller has just run the action; only its undo is recorded
+			added = append(added, scheduleEntry{ID: next + len(added), Action: reverseAction(verb), Site: site, Stream: *stream, At: start.Add(d)})
+		}
+		result := "Scheduled"
+		if *dryRun {
+			result = "Would schedule"
+		} else if err := writeSchedule(path, append(entries, added...)); err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+			return 1
+		}
+		for _, e := range added {
+			fmt.Printf("%s %d: %s %s at %s\n", result, e.ID, e.Action, e.Site, e.At.Format("2006-01-02 15:04 -0700"))
+		}
+		return 0
+	case "run":
+	default:
+		fmt.Printf("Error: Unknown action %s. Use run, list, cancel or add.\n", action)
+		return 1
+	}
+
+	now := time.Now()
+	var pending []scheduleEntry
+	failed := 0
+	for _, e := range entries {
+		if e.At.After(now) {
+			pending = append(pending, e)
+			continue
+		}
+		fmt.Printf("Running schedule %d: %s %s (due %s)\n", e.ID, e.Action, e.Site, e.At.Format("2006-01-02 15:04"))
+		if err := runEntry(*configDir, e); err != nil {
+			fmt.Printf("Error: Schedule %d: %v\n", e.ID, err)
+			failed++
+		}
+	}
+	if len(pending) != len(entries) {
+		if err := writeSchedule(path, pending); err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+			return 1
+		}
+	}
+	if failed > 0 {
+		return 3
+	}
+	return 0
+}
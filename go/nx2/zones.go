@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dotfob/sysadmin-tools/go/nginxconf"
+)
+
+var (
+	ratePattern = regexp.MustCompile(`^[1-9][0-9]*r/[sm]$`)
+	sizePattern = regexp.MustCompile(`^[1-9][0-9]*[kKmM]?$`)
+)
+
+// limitZone is a shared memory zone declared with limit_req_zone or limit_conn_zone.
+type limitZone struct {
+	kind string // req or conn
+	name string
+	key  string
+	size string
+	rate string // requests per second or minute, for req zones
+	pos  nginxconf.Pos
+}
+
+// directive returns the http-level directive declaring the zone.
+func (z limitZone) directive() *nginxconf.Directive {
+	if z.kind == "req" {
+		return nginxconf.New("limit_req_zone", z.key, "zone="+z.name+":"+z.size, "rate="+z.rate)
+	}
+	return nginxconf.New("limit_conn_zone", z.key, "zone="+z.name+":"+z.size)
+}
+
+// zoneRef is a limit_req or limit_conn directive using a zone.
+type zoneRef struct {
+	kind string
+	name string
+	pos  nginxconf.Pos
+}
+
+// zonesFile returns the http-level snippet of the zones managed by nx2 zones. Debian and
+// the official packages include conf.d/*.conf in the http block.
+func zonesFile(configDir string) string {
+	return filepath.Join(configDir, "conf.d", "nx2-zones.conf")
+}
+
+// parseZone returns the zone declared by a limit_req_zone or limit_conn_zone directive.
+func parseZone(d *nginxconf.Directive) (limitZone, bool) {
+	kind := strings.TrimSuffix(strings.TrimPrefix(d.Name, "limit_"), "_zone")
+	if (d.Name != "limit_req_zone" && d.Name != "limit_conn_zone") || len(d.Args) == 0 {
+		return limitZone{}, false
+	}
+	z := limitZone{kind: kind, key: d.Arg(0), pos: d.Pos}
+	for _, arg := range d.Values()[1:] {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "zone":
+			z.name, z.size, _ = strings.Cut(value, ":")
+		case "rate":
+			z.rate = value
+		}
+	}
+	return z, z.name != ""
+}
+
+// zoneRefs returns the zones used by limit_req and limit_conn directives.
+func zoneRefs(directives []*nginxconf.Directive) []zoneRef {
+	var refs []zoneRef
+	nginxconf.Walk(directives, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+		switch d.Name {
+		case "limit_req":
+			for _, arg := range d.Values() {
+				if name, ok := strings.CutPrefix(arg, "zone="); ok {
+					refs = append(refs, zoneRef{"req", name, d.Pos})
+				}
+			}
+		case "limit_conn":
+			refs = append(refs, zoneRef{"conn", d.Arg(0), d.Pos})
+		}
+		return true
+	})
+	return refs
+}
+
+// readZones returns the zones of the nx2 zones snippet.
+func readZones(path string) ([]limitZone, error) {
+	f, err := nginxconf.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var zones []limitZone
+	for _, d := range f.Directives {
+		if z, ok := parseZone(d); ok {
+			zones = append(zones, z)
+		}
+	}
+	return zones, nil
+}
+
+// writeZones writes the nx2 zones snippet.
+func writeZones(path string, zones []limitZone) error {
+	f := &nginxconf.File{Path: path}
+	f.Directives = append(f.Directives,
+		nginxconf.NewComment("Rate and connection limit zones managed by nx2 zones; sites use them with"),
+		nginxconf.NewComment("nx2create --limit-req and --limit-conn."))
+	for _, z := range zones {
+		f.Directives = append(f.Directives, z.directive())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return f.WriteFile()
+}
+
+// zoneUsers maps zone names to the enabled sites using them.
+func zoneUsers(configDir string) map[string][]string {
+	users := map[string][]string{}
+	matches, _ := filepath.Glob(filepath.Join(configDir, "sites-enabled", "*"))
+	for _, path := range matches {
+		f, err := nginxconf.ParseFile(path)
+		if err != nil {
+			continue
+		}
+		site := strings.TrimSuffix(filepath.Base(path), ".conf")
+		seen := map[string]bool{}
+		for _, ref := range zoneRefs(f.Directives) {
+			if !seen[ref.name] {
+				users[ref.name] = append(users[ref.name], site)
+				seen[ref.name] = true
+			}
+		}
+	}
+	return users
+}
+
+// snippetIncluded reports whether nginx.conf loads an http-level snippet of conf.d, such as
+// the zones snippet; it is true when there is no nginx.conf to check.
+func snippetIncluded(configDir, path string) bool {
+	mainConf := filepath.Join(configDir, "nginx.conf")
+	if _, err := os.Stat(mainConf); err != nil {
+		return true
+	}
+	config, err := nginxconf.Load(mainConf, nginxconf.LoadOptions{Prefix: configDir})
+	if err != nil {
+		return true
+	}
+	for _, f := range config.Files {
+		if strings.HasSuffix(f.Path, filepath.Join("conf.d", filepath.Base(path))) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkZones reports the zones used by the enabled config but not declared, used with the
+// wrong directive, or declared but never used.
+func checkZones(configDir string) (problems, unused []string, err error) {
+	directives, err := enabledConfig(configDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	declared := map[string]limitZone{}
+	var names []string
+	nginxconf.Walk(directives, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+		if z, ok := parseZone(d); ok {
+			if _, dup := declared[z.name]; !dup {
+				names = append(names, z.name)
+			}
+			declared[z.name] = z
+		}
+		return true
+	})
+
+	used := map[string]bool{}
+	for _, ref := range zoneRefs(directives) {
+		used[ref.name] = true
+		z, ok := declared[ref.name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: limit_%s uses zone %s, which is not declared", ref.pos, ref.kind, ref.name))
+		case z.kind != ref.kind:
+			problems = append(problems, fmt.Sprintf("%s: limit_%s uses zone %s, which is a limit_%s_zone (%s)", ref.pos, ref.kind, ref.name, z.kind, z.pos))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !used[name] {
+			unused = append(unused, fmt.Sprintf("%s: zone %s is not used by any enabled site", declared[name].pos, name))
+		}
+	}
+	return problems, unused, nil
+}
+
+func runZones(args []string) int {
+	fs := flag.NewFlagSet("zones", flag.ExitOnError)
+	help := fs.Bool("help", false, "Display usage information")
+	configDir := fs.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+	rate := fs.String("rate", "", "Request rate of a req zone, e.g. 10r/s or 60r/m")
+	key := fs.String("key", "$binary_remote_addr", "Variable that identifies a client")
+	size := fs.String("size", "10m", "Size of the shared memory zone")
+	noReload := fs.Bool("no-reload", false, "Do not reload nginx after changing a zone used by enabled sites")
+	fs.Parse(args)
+
+	action, name := fs.Arg(0), fs.Arg(1)
+	if *help || action == "" || (action != "list" && action != "check" && name == "") {
+		fmt.Println("Usage: nx2 zones [--config-dir=<path>] [--rate=<rate>] [--key=<var>] [--size=<size>] [--no-reload] req|conn|remove|list|check [name]")
+		fmt.Println("Manage the http-level rate and connection limit zones used by sites created with nx2create --limit-req and")
+		fmt.Println("--limit-conn.")
+		fmt.Println("\nActions:")
+		fmt.Println("  req <name>     Create or update a request rate zone (limit_req_zone); requires --rate")
+		fmt.Println("  conn <name>    Create or update a connection zone (limit_conn_zone)")
+		fmt.Println("  remove <name>  Remove a zone that no enabled site uses")
+		fmt.Println("  list           Print the zones and the enabled sites using them")
+		fmt.Println("  check          Report zones used by enabled sites but not declared, and zones nobody uses")
+		fmt.Println("\nOptions:")
+		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+		fmt.Println("  --rate=<rate>        Request rate of a req zone, e.g. 10r/s or 60r/m")
+		fmt.Println("  --key=<var>          Variable that identifies a client (default: $binary_remote_addr)")
+		fmt.Println("  --size=<size>        Size of the shared memory zone (default: 10m, about 160000 addresses)")
+		fmt.Println("  --no-reload          Do not reload nginx after changing a zone used by enabled sites")
+		fmt.Println("  --help               Display this help message")
+		fmt.Println("\nZones are stored in <config-dir>/conf.d/nx2-zones.conf, which nginx.conf must include in the http block.")
+		fmt.Println("\nExamples:")
+		fmt.Println("  nx2 zones --rate=10r/s req api")
+		fmt.Println("  nx2 zones conn perip")
+		fmt.Println("  nx2createsite --site-name=api.example.com ... --limit-req=api:burst=20:nodelay --limit-conn=perip:10")
+		fmt.Println("  nx2 zones check")
+		fmt.Println("\nExit status of check is 3 when a zone used by an enabled site is missing.")
+		return 0
+	}
+
+	path := zonesFile(*configDir)
+	zones, err := readZones(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Error: Failed to read %s: %v\n", path, err)
+		return 1
+	}
+	users := zoneUsers(*configDir)
+
+	switch action {
+	case "list":
+		for _, z := range zones {
+			detail := z.key + " " + z.size
+			if z.rate != "" {
+				detail += " " + z.rate
+			}
+			fmt.Printf("%-20s %-5s %-40s %s\n", z.name, z.kind, detail, strings.Join(users[z.name], ", "))
+		}
+		return 0
+	case "check":
+		problems, unused, err := checkZones(*configDir)
+		if err != nil {
+			fmt.Printf("Error: Failed to parse configuration: %v\n", err)
+			return 2
+		}
+		for _, problem := range problems {
+			fmt.Printf("Error: %s\n", problem)
+		}
+		for _, zone := range unused {
+			fmt.Printf("Warning: %s\n", zone)
+		}
+		if len(problems) > 0 {
+			return 3
+		}
+		if len(unused) == 0 {
+			fmt.Println("No problems found.")
+		}
+		return 0
+	case "req", "conn", "remove":
+	default:
+		fmt.Printf("Error: Unknown action %s. Use req, conn, remove, list or check.\n", action)
+		return 1
+	}
+
+	if !namePattern.MatchString(name) {
+		fmt.Printf("Error: Invalid zone name %s (use lowercase letters, digits, - and _).\n", name)
+		return 1
+	}
+	index := -1
+	for i, z := range zones {
+		if z.name == name {
+			index = i
+		}
+	}
+
+	previous := append([]limitZone(nil), zones...)
+	if action == "remove" {
+		if index < 0 {
+			fmt.Printf("Error: Zone %s not found in %s.\n", name, path)
+			return 2
+		}
+		if len(users[name]) > 0 {
+			fmt.Printf("Error: Zone %s is used by %s.\n", name, strings.Join(users[name], ", "))
+			return 2
+		}
+		zones = append(zones[:index], zones[index+1:]...)
+	} else {
+		z := limitZone{kind: action, name: name, key: *key, size: *size, rate: *rate}
+		switch {
+		case index >= 0 && zones[index].kind != action:
+			fmt.Printf("Error: Zone %s is a %s zone; remove it first to change its type.\n", name, zones[index].kind)
+			return 2
+		case action == "req" && !ratePattern.MatchString(z.rate):
+			fmt.Println("Error: A req zone requires --rate as requests per second or minute, e.g. 10r/s or 60r/m.")
+			return 1
+		case action == "conn" && z.rate != "":
+			fmt.Println("Error: --rate only applies to req zones.")
+			return 1
+		case !strings.HasPrefix(z.key, "$") || strings.ContainsAny(z.key, " \t;{}\"'"):
+			fmt.Printf("Error: Invalid key %s; use nginx variables such as $binary_remote_addr.\n", z.key)
+			return 1
+		case !sizePattern.MatchString(z.size):
+			fmt.Printf("Error: Invalid size %s; use a number of bytes with an optional k or m suffix.\n", z.size)
+			return 1
+		}
+		if index >= 0 {
+			zones[index] = z
+		} else {
+			zones = append(zones, z)
+		}
+	}
+
+	if err := writeZones(path, zones); err != nil {
+		fmt.Printf("Error: Failed to write %s: %v\n", path, err)
+		return 1
+	}
+	if action == "remove" {
+		fmt.Printf("Zone %s removed from %s.\n", name, path)
+	} else {
+		fmt.Printf("Zone %s saved in %s.\n", name, path)
+	}
+	if !snippetIncluded(*configDir, path) {
+		fmt.Printf("Warning: %s is not included by nginx.conf; add \"include conf.d/*.conf;\" to the http block.\n", path)
+	}
+
+	if len(users[name]) == 0 || *noReload {
+		return 0
+	}
+	if err := reloadNginx(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		writeZones(path, previous)
+		fmt.Printf("Zones in %s restored.\n", path)
+		return 3
+	}
+	fmt.Printf("Nginx reloaded for %s.\n", strings.Join(users[name], ", "))
+	return 0
+}
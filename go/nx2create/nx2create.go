@@ -3,8 +3,13 @@ package main
 import (
         "bufio"
         "bytes"
+        "crypto/x509"
+        "encoding/json"
+        "encoding/pem"
         "flag"
         "fmt"
+        "net"
+        "net/url"
         "os"
         "os/exec"
         "path/filepath"
@@ -12,88 +17,2202 @@ import (
         "strconv"
         "strings"
         "text/template"
+
+        "github.com/dotfob/sysadmin-tools/go/nginxconf"
+        "golang.org/x/net/idna"
 )
 
-const proxyTemplate = `upstream {{.SiteHostName}} {
-    server {{.IPHostName}}:{{.PortUpstream}};
+const proxyTemplate = `{{template "cache_path" .Cache}}{{template "asset_map" .AssetCache}}upstream {{.SiteHostName}} {
+    server {{.UpstreamServer}};
+}
+
+{{template "upstreams" .}}{{if .HTTPListens}}server {
+{{- range .HTTPListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}
+    location / {
+        return 301 {{.HTTPSRedirect}};
+    }
+}
+
+{{end}}{{if .Listen.HTTPOnly}}# Internal site served over plain HTTP (nx2create --http-only)
+# nx2lint:disable=NX006
+{{end}}server {
+{{- range .SiteListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}{{if not .Listen.HTTPOnly}}
+    ssl_certificate "{{.FullchainPath}}";
+    ssl_certificate_key "{{.PrivkeyPath}}";
+    ssl_session_timeout 10m;
+    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
+    ssl_prefer_server_ciphers on;
+    ssl_dhparam /etc/nginx/dhparam.pem;
+{{end}}{{template "client_tls" .ClientTLS}}{{template "headers" .}}{{template "directives" .Access}}{{template "directives" .Limits}}{{template "directives" .Cache}}{{template "directives" .Compression}}
+    location / {
+{{- if .IsGateway .Protocol}}
+        include {{.Protocol}}_params;
+        {{.Protocol}}_param HTTP_X_FORWARDED_FOR $proxy_add_x_forwarded_for;
+        {{.Protocol}}_param HTTP_X_FORWARDED_PROTO $scheme;
+        {{.Protocol}}_pass {{.SiteHostName}};
+{{- else}}
+        proxy_pass {{.Protocol}}://{{.SiteHostName}};
+        proxy_redirect off;
+        proxy_buffering {{$.ProxyBuffering}};
+        proxy_set_header Host $host;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-Proto $scheme;{{template "client_cert" .ClientTLS}}
+{{- if eq .Protocol "https"}}{{template "upstream_tls" .UpstreamTLS.Directives .IPHostName}}{{end}}
+{{- end}}
+    }
+{{template "locations" .}}}
+`
+
+const localTemplate = `{{template "cache_path" .Cache}}{{template "asset_map" .AssetCache}}{{template "upstreams" .}}{{if .HTTPListens}}server {
+{{- range .HTTPListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}
+    location / {
+        return 301 {{.HTTPSRedirect}};
+    }
+}
+
+{{end}}{{if .Listen.HTTPOnly}}# Internal site served over plain HTTP (nx2create --http-only)
+# nx2lint:disable=NX006
+{{end}}server {
+{{- range .SiteListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}{{if not .Listen.HTTPOnly}}
+    ssl_certificate "{{.FullchainPath}}";
+    ssl_certificate_key "{{.PrivkeyPath}}";
+    ssl_session_timeout 10m;
+    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
+    ssl_prefer_server_ciphers on;
+    ssl_dhparam /etc/nginx/dhparam.pem;
+{{end}}{{template "client_tls" .ClientTLS}}{{template "headers" .}}{{template "directives" .Access}}{{template "directives" .Limits}}{{template "directives" .Cache}}{{template "directives" .Compression}}
+    root {{.DocumentRoot}};
+    index index.html index.htm;
+
+    location / {
+        try_files $uri $uri/ /index.html;
+    }
+{{template "locations" .}}}
+`
+
+const phpTemplate = `{{template "cache_path" .Cache}}{{template "asset_map" .AssetCache}}{{template "upstreams" .}}{{if .HTTPListens}}server {
+{{- range .HTTPListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}
+    location / {
+        return 301 {{.HTTPSRedirect}};
+    }
+}
+
+{{end}}{{if .Listen.HTTPOnly}}# Internal site served over plain HTTP (nx2create --http-only)
+# nx2lint:disable=NX006
+{{end}}server {
+{{- range .SiteListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}{{if not .Listen.HTTPOnly}}
+    ssl_certificate "{{.FullchainPath}}";
+    ssl_certificate_key "{{.PrivkeyPath}}";
+    ssl_session_timeout 10m;
+    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
+    ssl_prefer_server_ciphers on;
+    ssl_dhparam /etc/nginx/dhparam.pem;
+{{end}}{{template "client_tls" .ClientTLS}}{{template "headers" .}}{{template "directives" .Access}}{{template "directives" .Limits}}{{template "directives" .Cache}}{{template "directives" .Compression}}
+    root {{.DocumentRoot}};
+    index index.php index.html;
+
+    location / {
+        try_files $uri $uri/ /index.php?$query_string;
+    }
+{{with .PHP.DenyPattern}}
+    location ~* {{.}} {
+        deny all;
+    }
+{{end}}
+    location ~ \.php$ {
+        try_files $uri =404;
+        include fastcgi_params;
+        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+        fastcgi_index index.php;
+        fastcgi_pass {{.PHP.Pass}};
+    }
+{{template "locations" .}}}
+`
+
+const redirectTemplate = `{{template "cache_path" .Cache}}{{template "asset_map" .AssetCache}}{{template "upstreams" .}}{{with .RedirectPath}}map $request_uri ${{.}} {
+    "~^(?<{{.}}_raw>[^?]*)" ${{.}}_raw;
+}
+
+{{end}}{{if .HTTPListens}}server {
+{{- range .HTTPListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}
+    location / {
+        return {{.RedirectCode}} {{.RedirectURL}};
+    }
+}
+
+{{end}}{{if .Listen.HTTPOnly}}# Internal site served over plain HTTP (nx2create --http-only)
+# nx2lint:disable=NX006
+{{end}}server {
+{{- range .SiteListens}}
+    listen {{.}};
+{{- end}}
+    server_name {{.ServerNames}};
+    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
+    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+{{template "directives" .RealIP}}{{if not .Listen.HTTPOnly}}
+    ssl_certificate "{{.FullchainPath}}";
+    ssl_certificate_key "{{.PrivkeyPath}}";
+    ssl_session_timeout 10m;
+    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
+    ssl_prefer_server_ciphers on;
+    ssl_dhparam /etc/nginx/dhparam.pem;
+{{end}}{{template "client_tls" .ClientTLS}}{{template "headers" .}}{{template "directives" .Access}}{{template "directives" .Limits}}{{template "directives" .Cache}}{{template "directives" .Compression}}
+    location / {
+        return {{.RedirectCode}} {{.RedirectURL}};
+    }
+{{template "locations" .}}}
+`
+
+const streamTemplate = `# TCP/UDP proxy in the stream context; enable it with nx2ensite --stream
+upstream {{.SiteHostName}} {
+{{- with .Stream.BalanceDirective}}
+    {{.}};
+{{- end}}
+{{- range .Stream.Servers}}
+    server {{.}};
+{{- end}}
+}
+
+{{template "upstreams" .}}{{if .Stream.Routes}}map {{.Stream.RouteVariable}} ${{.Stream.Variable}} {
+    hostnames;
+{{- range .Stream.Routes}}
+    {{.Name}} {{.UpstreamName}};
+{{- end}}
+    default {{.SiteHostName}};
+}
+
+{{end}}server {
+{{- range .StreamListens}}
+    listen {{.}};
+{{- end}}
+    error_log /var/log/nginx/{{.SiteHostName}}_stream_error.log;
+{{template "directives" .Access}}{{if eq .Stream.TLS "terminate"}}
+    ssl_certificate "{{.FullchainPath}}";
+    ssl_certificate_key "{{.PrivkeyPath}}";
+    ssl_session_timeout 10m;
+    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
+    ssl_prefer_server_ciphers on;
+{{else if eq .Stream.TLS "passthrough"}}
+    ssl_preread on;
+{{end}}{{template "directives" .Stream}}}
+`
+
+// sharedTemplates holds the upstream, cache, asset map, client certificate, upstream TLS,
+// header, server directive and location blocks used by every site type.
+const sharedTemplates = `{{define "upstreams"}}{{range .Upstreams}}upstream {{.Name}} {
+    server {{.Address}};
+}
+
+{{end}}{{end}}{{define "cache_path"}}{{with .PathDirective}}{{.}};
+
+{{end}}{{end}}{{define "asset_map"}}{{if .Enabled}}map $uri ${{.Variable}} {
+    "~*{{.Pattern}}" "public, max-age=31536000, immutable";
+    /index.html "no-cache";
+    default "";
+}
+
+{{end}}{{end}}{{define "client_tls"}}{{if .CA}}    ssl_client_certificate "{{.CA}}";
+    ssl_verify_client {{.Verify}};
+    ssl_verify_depth {{.Depth}};
+{{if .CRL}}    ssl_crl "{{.CRL}}";
+{{end}}{{end}}{{end}}{{define "client_cert"}}{{range .Headers}}
+        proxy_set_header {{.Name}} {{.Value}};{{end}}{{end}}{{define "upstream_tls"}}{{range .}}
+        {{.}};{{end}}{{end}}{{define "headers"}}{{with .Headers}}
+{{range .}}    add_header {{.Name}} "{{.Value}}" always;
+{{end}}{{end}}{{end}}{{define "directives"}}{{with .Directives}}
+{{range .}}    {{.}};
+{{end}}{{end}}{{end}}{{define "locations"}}{{range .Locations}}
+    location {{.Header}} {
+{{- if and (eq .Target "upstream") ($.IsGateway .Protocol)}}
+        include {{.Protocol}}_params;
+        {{.Protocol}}_param HTTP_X_FORWARDED_FOR $proxy_add_x_forwarded_for;
+        {{.Protocol}}_param HTTP_X_FORWARDED_PROTO $scheme;
+        {{.Protocol}}_pass {{.UpstreamName}};
+{{- else if eq .Target "upstream"}}
+        proxy_pass {{.Protocol}}://{{.UpstreamName}};
+        proxy_redirect off;
+        proxy_buffering {{$.ProxyBuffering}};
+        proxy_set_header Host $host;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-Proto $scheme;
+{{- template "client_cert" $.ClientTLS}}
+{{- if eq .Protocol "https"}}{{template "upstream_tls" $.UpstreamTLS.Directives .UpstreamHost}}{{end}}
+{{- else if eq .Target "static"}}
+        {{.RootDirective}} {{.Root}};
+{{- else if eq .Target "redirect"}}
+        return {{.Code}} {{.URL}};
+{{- else if eq .Target "return"}}
+        return {{.Code}}{{if .Text}} "{{.Text}}"{{end}};
+{{- end}}
+{{- range .Options}}
+        {{.}};
+{{- end}}
+{{- range .Access.Directives}}
+        {{.}};
+{{- end}}
+{{- range .Limits.Directives}}
+        {{.}};
+{{- end}}
+    }
+{{end}}{{end}}`
+
+// ConfigData holds template variables.
+type ConfigData struct {
+        SiteName      string
+        SiteHostName  string
+        IPHostName    string
+        PortUpstream  string
+        FullchainPath string
+        PrivkeyPath   string
+        DocumentRoot  string
+        Protocol      string
+        Upstreams     []Upstream
+        Locations     []Location
+        Aliases       []string
+        RedirectURL   string
+        RedirectCode  int
+        RedirectPath  string // map variable of the path, from $request_uri so that it stays encoded
+        Security      SecurityHeaders
+        Access        Access
+        Limits        Limits
+        Cache         Cache
+        Compression   Compression
+        AssetCache    AssetCache
+        PHP           PHP
+        Stream        Stream
+        Listen        Listen
+        RealIP        RealIP
+        ClientTLS     ClientTLS
+        UpstreamTLS   UpstreamTLS
+        configDir     string // resolves the uwsgi_params and scgi_params includes
+}
+
+// SecurityHeaders holds the security response headers of the HTTPS server.
+type SecurityHeaders struct {
+        HSTS                  bool
+        HSTSMaxAge            int
+        HSTSIncludeSubdomains bool
+        HSTSPreload           bool
+        CSP                   string
+        FrameOptions          string
+        ReferrerPolicy        string
+        PermissionsPolicy     string
+        NoSniff               bool
+}
+
+// ClientTLS holds the client certificate authentication (mutual TLS) of the HTTPS server.
+type ClientTLS struct {
+        CA      string // PEM bundle of the CAs that issue client certificates
+        Verify  string // on, or optional to let the upstream decide
+        Depth   int
+        CRL     string
+        Forward bool // pass the verification result, subject and fingerprint upstream
+}
+
+// Headers returns the request headers that forward the client certificate to upstreams.
+// They are always set, so clients cannot supply their own values.
+func (c ClientTLS) Headers() []Header {
+        if !c.Forward {
+                return nil
+        }
+        return []Header{
+                {"X-SSL-Client-Verify", "$ssl_client_verify"},
+                {"X-SSL-Client-S-DN", "$ssl_client_s_dn"},
+                {"X-SSL-Client-I-DN", "$ssl_client_i_dn"},
+                {"X-SSL-Client-Serial", "$ssl_client_serial"},
+                {"X-SSL-Client-Fingerprint", "$ssl_client_fingerprint"},
+        }
+}
+
+// validateClientTLS checks the client certificate options: the CA bundle must hold only
+// PEM certificates and the CRL must be a PEM or DER revocation list.
+func validateClientTLS(c ClientTLS, proxied int) []string {
+        if c.CA == "" {
+                if c.Verify != "" || c.CRL != "" || c.Forward {
+                        return []string{"Client certificate options require a CA bundle (--client-ca)"}
+                }
+                return nil
+        }
+
+        var errors []string
+        if content, err := os.ReadFile(c.CA); err != nil {
+                errors = append(errors, fmt.Sprintf("Client CA bundle %s cannot be read: %v", c.CA, err))
+        } else {
+                count := 0
+                for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+                        if block.Type != "CERTIFICATE" {
+                                errors = append(errors, fmt.Sprintf("Client CA bundle %s contains non-certificate data (%s); only certificates are allowed", c.CA, block.Type))
+                                continue
+                        }
+                        cert, err := x509.ParseCertificate(block.Bytes)
+                        if err != nil {
+                                errors = append(errors, fmt.Sprintf("Client CA bundle %s contains an invalid certificate: %v", c.CA, err))
+                                continue
+                        }
+                        if !cert.IsCA {
+                                errors = append(errors, fmt.Sprintf("Client CA bundle %s contains %s, which is not a CA certificate", c.CA, cert.Subject))
+                        }
+                        count++
+                }
+                if count == 0 && len(errors) == 0 {
+                        errors = append(errors, fmt.Sprintf("Client CA bundle %s contains no PEM certificates", c.CA))
+                }
+        }
+
+        if c.Verify != "on" && c.Verify != "optional" {
+                errors = append(errors, "Client certificate verification must be 'on' or 'optional'")
+        }
+        if c.Depth < 1 {
+                errors = append(errors, "Client certificate verify depth must be at least 1")
+        }
+        if c.CRL != "" {
+                content, err := os.ReadFile(c.CRL)
+                if err != nil {
+                        errors = append(errors, fmt.Sprintf("CRL file %s cannot be read: %v", c.CRL, err))
+                } else {
+                        if block, _ := pem.Decode(content); block != nil {
+                                content = block.Bytes
+                        }
+                        if _, err := x509.ParseRevocationList(content); err != nil {
+                                errors = append(errors, fmt.Sprintf("CRL file %s is not a valid revocation list: %v", c.CRL, err))
+                        }
+                }
+        }
+        if c.Forward && proxied == 0 {
+                errors = append(errors, "Forwarding the client certificate requires a proxy site or upstream locations using http or https")
+        }
+        return errors
+}
+
+// UpstreamTLS holds how nginx connects to https upstreams: the SNI name, verification of
+// the upstream certificate and the client certificate presented to the upstream.
+type UpstreamTLS struct {
+        Name   string // SNI and verified name (default: the upstream host)
+        Verify bool
+        CA     string
+        Depth  int
+        Cert   string
+        Key    string
+}
+
+// Directives returns the proxy_ssl directives of a location proxying to host over https.
+// The name defaults to the host, since nginx would otherwise send the upstream block name.
+func (u UpstreamTLS) Directives(host string) []string {
+        name := u.Name
+        if name == "" {
+                name = host
+        }
+        directives := []string{"proxy_ssl_server_name on", "proxy_ssl_name " + name}
+        if u.Verify {
+                directives = append(directives,
+                        "proxy_ssl_verify on",
+                        fmt.Sprintf("proxy_ssl_trusted_certificate \"%s\"", u.CA),
+                        fmt.Sprintf("proxy_ssl_verify_depth %d", u.Depth))
+        }
+        if u.Cert != "" {
+                directives = append(directives,
+                        fmt.Sprintf("proxy_ssl_certificate \"%s\"", u.Cert),
+                        fmt.Sprintf("proxy_ssl_certificate_key \"%s\"", u.Key))
+        }
+        return directives
+}
+
+// validateUpstreamTLS checks the upstream TLS options against the https upstreams of the site.
+func validateUpstreamTLS(u UpstreamTLS, hosts []string) []string {
+        var errors []string
+        if len(hosts) == 0 {
+                if u.Name != "" || u.Verify || u.CA != "" || u.Cert != "" || u.Key != "" {
+                        errors = append(errors, "Upstream TLS options require an https upstream (--proxy-protocol=https or upstream:https:// locations)")
+                }
+                return errors
+        }
+
+        if u.Name != "" && !isIPAddress(u.Name) {
+                if err := validateServerName(u.Name, false); err != nil || strings.HasPrefix(u.Name, "*") {
+                        errors = append(errors, fmt.Sprintf("Invalid upstream SNI name %s: must be a domain or IP address", u.Name))
+                }
+        }
+        if u.Verify {
+                if u.CA == "" {
+                        errors = append(errors, "Upstream verification requires a CA bundle (--upstream-ca), e.g. /etc/ssl/certs/ca-certificates.crt")
+                }
+                if u.Depth < 1 {
+                        errors = append(errors, "Upstream verify depth must be at least 1")
+                }
+                // nginx matches the name against DNS names only, so IP upstreams need a name
+                for _, host := range hosts {
+                        if u.Name == "" && isIPAddress(host) {
+                                errors = append(errors, fmt.Sprintf("Upstream verification of %s requires --upstream-sni-name with a name from its certificate", host))
+                        }
+                }
+        }
+        if u.CA != "" {
+                errors = append(errors, validateFile("Upstream CA bundle", u.CA)...)
+        }
+        if (u.Cert == "") != (u.Key == "") {
+                errors = append(errors, "Upstream client certificate and key must be given together")
+        } else if u.Cert != "" {
+                errors = append(errors, validateFile("Upstream client certificate", u.Cert)...)
+                errors = append(errors, validateFile("Upstream client key", u.Key)...)
+        }
+        return errors
+}
+
+// Header is a response header added with add_header ... always.
+type Header struct {
+        Name  string
+        Value string
+}
+
+// Access holds the access control of the HTTPS server or of a location: IP rules, basic
+// auth, and whether a client must pass both (satisfy all) or either (satisfy any).
+type Access struct {
+        Allow     []string `json:"allow,omitempty"`      // addresses, CIDR ranges or @name access lists
+        Deny      []string `json:"deny,omitempty"`       // addresses or CIDR ranges
+        BasicAuth bool     `json:"basic_auth,omitempty"` // require a user of the htpasswd file
+        AuthRealm string   `json:"auth_realm,omitempty"` // realm shown by browsers (default: Restricted)
+        AuthFile  string   `json:"auth_file,omitempty"`  // htpasswd file (default: <config-dir>/htpasswd/<site>)
+        Satisfy   string   `json:"satisfy,omitempty"`    // all (default) or any
+        aclDir    string
+}
+
+// aclPattern matches the names of access lists managed by nx2 acl.
+var aclPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// aclFile returns the snippet of a named access list managed by nx2 acl.
+func (a Access) aclFile(name string) string {
+        return filepath.Join(a.aclDir, "nx2-acl-"+name+".conf")
+}
+
+// Directives returns the access directives in the order nginx evaluates them: denied
+// networks first, then the allowlist closed by deny all, then basic auth.
+func (a Access) Directives() []string {
+        var directives []string
+        for _, network := range a.Deny {
+                directives = append(directives, "deny "+network)
+        }
+        for _, network := range a.Allow {
+                if name, ok := strings.CutPrefix(network, "@"); ok {
+                        directives = append(directives, "include "+a.aclFile(name))
+                } else {
+                        directives = append(directives, "allow "+network)
+                }
+        }
+        if len(a.Allow) > 0 {
+                directives = append(directives, "deny all")
+        }
+        if a.BasicAuth {
+                directives = append(directives, fmt.Sprintf("auth_basic \"%s\"", a.AuthRealm), "auth_basic_user_file "+a.AuthFile)
+        }
+        if a.Satisfy != "" {
+                directives = append(directives, "satisfy "+a.Satisfy)
+        }
+        return directives
+}
+
+// inheritSatisfy makes a location with its own IP rules or basic auth require all of them
+// when the server uses satisfy any: nginx inherits satisfy, so either check alone would
+// otherwise let clients into the location.
+func (a *Access) inheritSatisfy(server Access) {
+        if server.Satisfy == "any" && a.Satisfy == "" && (len(a.Allow) > 0 || len(a.Deny) > 0 || a.BasicAuth) {
+                a.Satisfy = "all"
+        }
+}
+
+// resolve fills in the defaults that depend on the configuration directory and the site.
+func (a *Access) resolve(configDir, siteHostName string) {
+        a.aclDir = filepath.Join(configDir, "snippets")
+        if a.BasicAuth && a.AuthFile == "" {
+                a.AuthFile = filepath.Join(configDir, "htpasswd", siteHostName)
+        }
+        if a.BasicAuth && a.AuthRealm == "" {
+                a.AuthRealm = "Restricted"
+        }
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(value string) []string {
+        var items []string
+        for _, item := range strings.Split(value, ",") {
+                if item = strings.TrimSpace(item); item != "" {
+                        items = append(items, item)
+                }
+        }
+        return items
+}
+
+// validateNetwork checks an address or CIDR range for allow and deny.
+func validateNetwork(value string) error {
+        if net.ParseIP(value) != nil {
+                return nil
+        }
+        ip, network, err := net.ParseCIDR(value)
+        if err != nil {
+                return fmt.Errorf("%s is not an address or CIDR range", value)
+        }
+        if !ip.Equal(network.IP) {
+                return fmt.Errorf("%s has host bits set (did you mean %s?)", value, network)
+        }
+        return nil
+}
+
+// Listen holds the sockets of the site. The site is served over HTTPS, with a server that
+// redirects HTTP to it, or over plain HTTP only for internal sites without certificates.
+type Listen struct {
+        Addresses     []string // IP addresses to bind (default: every IPv4 address)
+        IPv6          bool     // also listen on every IPv6 address, [::]
+        HTTPPort      int
+        HTTPSPort     int
+        DefaultServer bool
+        ReusePort     bool
+        HTTPOnly      bool // serve the site over HTTP, without certificates
+        NoRedirect    bool // omit the server redirecting HTTP to HTTPS
+}
+
+// sockets returns the addresses of the listen directives on a port, e.g. 443,
+// 10.0.0.5:443 or [::]:443.
+func (l Listen) sockets(port int) []string {
+        p := strconv.Itoa(port)
+        if len(l.Addresses) == 0 {
+                sockets := []string{p}
+                if l.IPv6 {
+                        sockets = append(sockets, "[::]:"+p)
+                }
+                return sockets
+        }
+        var sockets []string
+        for _, addr := range l.Addresses {
+                if strings.Contains(addr, ":") {
+                        addr = "[" + strings.Trim(addr, "[]") + "]"
+                }
+                sockets = append(sockets, addr+":"+p)
+        }
+        return sockets
+}
+
+// validateListen checks the listen addresses and ports.
+func validateListen(l Listen) []string {
+        var errors []string
+        for _, addr := range l.Addresses {
+                if net.ParseIP(strings.Trim(addr, "[]")) == nil {
+                        errors = append(errors, fmt.Sprintf("Invalid listen address %s; use an IPv4 or IPv6 address", addr))
+                }
+        }
+        if l.IPv6 && len(l.Addresses) > 0 {
+                errors = append(errors, "--ipv6 listens on [::] and cannot be combined with --listen-address; list the IPv6 addresses instead")
+        }
+        for _, port := range []int{l.HTTPPort, l.HTTPSPort} {
+                if port < 1 || port > 65535 {
+                        errors = append(errors, fmt.Sprintf("Listen port %d must be between 1 and 65535", port))
+                }
+        }
+        if !l.HTTPOnly && !l.NoRedirect && l.HTTPPort == l.HTTPSPort {
+                errors = append(errors, fmt.Sprintf("HTTP and HTTPS ports must differ (both are %d)", l.HTTPPort))
+        }
+        return errors
+}
+
+// RealIP holds how the site finds the client address behind load balancers: the PROXY
+// protocol header sent by L4 balancers, or a header set by trusted proxies.
+type RealIP struct {
+        ProxyProtocol bool     // accept the PROXY protocol on the listen sockets
+        From          []string // trusted load balancer networks
+        Header        string   // X-Forwarded-For, X-Real-IP, proxy_protocol or another header
+        Recursive     bool     // skip every trusted address in X-Forwarded-For, not only the last one
+}
+
+var realIPHeaderPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// Directives returns the realip directives of both servers, so the access logs and the
+// X-Real-IP sent to upstreams carry the client address. A site list replaces the one set
+// by nx2 realip for the whole http block.
+func (r RealIP) Directives() []string {
+        var directives []string
+        for _, network := range r.From {
+                directives = append(directives, "set_real_ip_from "+network)
+        }
+        if len(r.From) > 0 {
+                directives = append(directives, "real_ip_header "+r.Header)
+                if r.Recursive {
+                        directives = append(directives, "real_ip_recursive on")
+                }
+        }
+        return directives
+}
+
+// validateRealIP checks the trusted networks and the header carrying the client address.
+func validateRealIP(r RealIP) []string {
+        var errors []string
+        for _, network := range r.From {
+                if strings.HasPrefix(network, "unix:") {
+                        continue
+                }
+                if err := validateNetwork(network); err != nil {
+                        errors = append(errors, fmt.Sprintf("Invalid trusted proxy network: %v", err))
+                }
+        }
+        if len(r.From) == 0 {
+                if r.Header != "" || r.Recursive {
+                        errors = append(errors, "Real IP options require the trusted proxy networks (--real-ip-from)")
+                }
+                return errors
+        }
+        if r.Header == "proxy_protocol" {
+                if !r.ProxyProtocol {
+                        errors = append(errors, "Real IP header proxy_protocol requires --accept-proxy-protocol")
+                }
+        } else if !realIPHeaderPattern.MatchString(r.Header) {
+                errors = append(errors, fmt.Sprintf("Invalid real IP header %s; use proxy_protocol or a header name such as X-Forwarded-For", r.Header))
+        }
+        return errors
+}
+
+// validateAccess checks the access control of the server or of a location; context
+// prefixes the messages, e.g. "Location /admin: ".
+func validateAccess(a Access, context string) []string {
+        var errors []string
+        for _, network := range a.Allow {
+                if name, ok := strings.CutPrefix(network, "@"); ok {
+                        if !aclPattern.MatchString(name) {
+                                errors = append(errors, fmt.Sprintf("%sInvalid access list name %s", context, name))
+                        } else if _, err := os.Stat(a.aclFile(name)); err != nil {
+                                errors = append(errors, fmt.Sprintf("%sAccess list %s not found; create it with nx2 acl set %s <network>...", context, name, name))
+                        }
+                } else if err := validateNetwork(network); err != nil {
+                        errors = append(errors, fmt.Sprintf("%sInvalid allow rule: %v", context, err))
+                }
+        }
+        for _, network := range a.Deny {
+                if err := validateNetwork(network); err != nil {
+                        errors = append(errors, fmt.Sprintf("%sInvalid deny rule: %v", context, err))
+                }
+        }
+
+        if a.BasicAuth {
+                if strings.ContainsAny(a.AuthRealm, "\"\\\n") {
+                        errors = append(errors, fmt.Sprintf("%sAuth realm must not contain quotes, backslashes or newlines", context))
+                }
+                if info, err := os.Stat(a.AuthFile); err != nil || info.IsDir() {
+                        errors = append(errors, fmt.Sprintf("%sHtpasswd file %s does not exist; create it with nx2 htpasswd add %s <user>", context, a.AuthFile, a.AuthFile))
+                }
+        }
+
+        switch a.Satisfy {
+        case "", "all":
+        case "any":
+                if len(a.Allow) == 0 || !a.BasicAuth {
+                        errors = append(errors, fmt.Sprintf("%sSatisfy any requires both allowed networks and basic auth", context))
+                }
+        default:
+                errors = append(errors, fmt.Sprintf("%sSatisfy must be 'all' or 'any'", context))
+        }
+        return errors
+}
+
+// Limits holds the request rate and connection limits of the HTTPS server or of a location,
+// using the zones that nx2 zones declares in conf.d/nx2-zones.conf.
+type Limits struct {
+        Req       string `json:"limit_req,omitempty"`    // zone[:burst=N][:nodelay|:delay=N]
+        Conn      string `json:"limit_conn,omitempty"`   // zone:N
+        Status    int    `json:"limit_status,omitempty"` // status of rejected requests (nginx default: 503)
+        zonesFile string
+}
+
+// parseLimitReq splits a limit_req value into the zone and the limit_req parameters.
+func parseLimitReq(value string) (zone string, params []string, err error) {
+        fields := strings.Split(value, ":")
+        zone = fields[0]
+        delay := false
+        for _, option := range fields[1:] {
+                key, arg, _ := strings.Cut(option, "=")
+                switch key {
+                case "burst", "delay":
+                        if n, err := strconv.Atoi(arg); err != nil || n < 0 || (key == "burst" && n == 0) {
+                                return zone, nil, fmt.Errorf("%s must be a positive number in %s", key, value)
+                        }
+                case "nodelay":
+                        if arg != "" {
+                                return zone, nil, fmt.Errorf("nodelay takes no value in %s", value)
+                        }
+                default:
+                        return zone, nil, fmt.Errorf("unknown option %s in %s (use burst=, delay= or nodelay)", option, value)
+                }
+                if key != "burst" {
+                        if delay {
+                                return zone, nil, fmt.Errorf("delay and nodelay cannot be combined in %s", value)
+                        }
+                        delay = true
+                }
+                params = append(params, option)
+        }
+        return zone, params, nil
+}
+
+// parseLimitConn splits a limit_conn value into the zone and the number of connections.
+func parseLimitConn(value string) (zone string, count int, err error) {
+        zone, arg, _ := strings.Cut(value, ":")
+        count, err = strconv.Atoi(arg)
+        if err != nil || count < 1 {
+                return zone, 0, fmt.Errorf("%s must be zone:connections, e.g. perip:10", value)
+        }
+        return zone, count, nil
+}
+
+// Directives returns the limit directives; rejected requests get Status when it is set.
+func (l Limits) Directives() []string {
+        var directives []string
+        if zone, params, err := parseLimitReq(l.Req); l.Req != "" && err == nil {
+                directives = append(directives, strings.Join(append([]string{"limit_req zone=" + zone}, params...), " "))
+                if l.Status != 0 {
+                        directives = append(directives, fmt.Sprintf("limit_req_status %d", l.Status))
+                }
+        }
+        if zone, count, err := parseLimitConn(l.Conn); l.Conn != "" && err == nil {
+                directives = append(directives, fmt.Sprintf("limit_conn %s %d", zone, count))
+                if l.Status != 0 {
+                        directives = append(directives, fmt.Sprintf("limit_conn_status %d", l.Status))
+                }
+        }
+        return directives
+}
+
+// resolve sets the zones file, which depends on the configuration directory.
+func (l *Limits) resolve(configDir string) {
+        l.zonesFile = filepath.Join(configDir, "conf.d", "nx2-zones.conf")
+}
+
+// validateLimits checks the limits of the server or of a location against the zones
+// declared by nx2 zones; context prefixes the messages, e.g. "Location /login: ".
+func validateLimits(l Limits, context string) []string {
+        var errors []string
+        zones := map[string]string{}
+        if f, err := nginxconf.ParseFile(l.zonesFile); err == nil {
+                for _, d := range f.Directives {
+                        for _, arg := range d.Values() {
+                                if value, ok := strings.CutPrefix(arg, "zone="); ok {
+                                        name, _, _ := strings.Cut(value, ":")
+                                        zones[name] = d.Name
+                                }
+                        }
+                }
+        }
+
+        if l.Req != "" {
+                zone, _, err := parseLimitReq(l.Req)
+                switch {
+                case err != nil:
+                        errors = append(errors, fmt.Sprintf("%sInvalid rate limit: %v", context, err))
+                case zones[zone] == "limit_conn_zone":
+                        errors = append(errors, fmt.Sprintf("%sZone %s is a connection zone; use it with --limit-conn", context, zone))
+                case zones[zone] == "":
+                        errors = append(errors, fmt.Sprintf("%sRate limit zone %s not found; create it with nx2 zones --rate=10r/s req %s", context, zone, zone))
+                }
+        }
+        if l.Conn != "" {
+                zone, _, err := parseLimitConn(l.Conn)
+                switch {
+                case err != nil:
+                        errors = append(errors, fmt.Sprintf("%sInvalid connection limit: %v", context, err))
+                case zones[zone] == "limit_req_zone":
+                        errors = append(errors, fmt.Sprintf("%sZone %s is a rate zone; use it with --limit-req", context, zone))
+                case zones[zone] == "":
+                        errors = append(errors, fmt.Sprintf("%sConnection limit zone %s not found; create it with nx2 zones conn %s", context, zone, zone))
+                }
+        }
+        if l.Status != 0 {
+                if l.Status < 400 || l.Status > 599 {
+                        errors = append(errors, fmt.Sprintf("%sLimit status must be between 400 and 599", context))
+                } else if l.Req == "" && l.Conn == "" {
+                        errors = append(errors, fmt.Sprintf("%sLimit status requires a rate or connection limit", context))
+                }
+        }
+        return errors
+}
+
+// Cache holds the proxy cache of a site: a cache zone named after the site, declared at the
+// top of the site file, and the caching rules of the HTTPS server.
+type Cache struct {
+        Enabled  bool
+        Zone     string
+        Path     string
+        MaxSize  string
+        Inactive string
+        Key      string
+        Valid    []string // "200 302=10m" entries
+        Bypass   []string // cookie:<name>, header:<name> or arg:<name> rules
+        UseStale string   // proxy_cache_use_stale conditions, or off
+}
+
+var (
+        cacheSizePattern = regexp.MustCompile(`^[1-9][0-9]*[kKmMgG]?$`)
+        durationPattern  = regexp.MustCompile(`^([0-9]+(ms|[smhdwMy])?)+$`)
+        cacheNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// cacheStaleConditions lists the values accepted by proxy_cache_use_stale.
+var cacheStaleConditions = []string{
+        "error", "timeout", "invalid_header", "updating", "http_500", "http_502", "http_503",
+        "http_504", "http_403", "http_404", "http_429",
+}
+
+// bypassVariable returns the variable of a cache bypass rule, e.g. $cookie_session for
+// cookie:session and $http_authorization for header:Authorization.
+func bypassVariable(rule string) (string, bool) {
+        kind, name, _ := strings.Cut(rule, ":")
+        if !cacheNamePattern.MatchString(name) {
+                return "", false
+        }
+        switch kind {
+        case "cookie", "arg":
+                return "$" + kind + "_" + name, true
+        case "header":
+                return "$http_" + strings.ReplaceAll(strings.ToLower(name), "-", "_"), true
+        }
+        return "", false
+}
+
+// PathDirective returns the proxy_cache_path directive declaring the cache zone.
+func (c Cache) PathDirective() string {
+        if !c.Enabled {
+                return ""
+        }
+        return fmt.Sprintf("proxy_cache_path %s levels=1:2 keys_zone=%s:10m max_size=%s inactive=%s use_temp_path=off", c.Path, c.Zone, c.MaxSize, c.Inactive)
+}
+
+// Directives returns the caching rules of the HTTPS server. Requests with an Authorization
+// header always bypass the cache, so private responses are never shared.
+func (c Cache) Directives() []string {
+        if !c.Enabled {
+                return nil
+        }
+        directives := []string{"proxy_cache " + c.Zone, fmt.Sprintf("proxy_cache_key \"%s\"", c.Key)}
+        for _, entry := range c.Valid {
+                codes, duration, _ := strings.Cut(entry, "=")
+                directives = append(directives, "proxy_cache_valid "+strings.Join(strings.Fields(codes), " ")+" "+duration)
+        }
+        bypass := []string{"$http_authorization"}
+        for _, rule := range c.Bypass {
+                if variable, ok := bypassVariable(rule); ok && variable != "$http_authorization" {
+                        bypass = append(bypass, variable)
+                }
+        }
+        directives = append(directives,
+                "proxy_cache_bypass "+strings.Join(bypass, " "),
+                "proxy_no_cache "+strings.Join(bypass, " "))
+        if c.UseStale != "off" {
+                directives = append(directives, "proxy_cache_use_stale "+c.UseStale)
+                if strings.Contains(c.UseStale, "updating") {
+                        directives = append(directives, "proxy_cache_background_update on")
+                }
+                directives = append(directives, "proxy_cache_lock on")
+        }
+        return directives
+}
+
+// validateCache checks the cache options; caching needs a proxy site or upstream locations
+// passed with proxy_pass, counted in proxied.
+func validateCache(c Cache, proxied int) []string {
+        if !c.Enabled {
+                return nil
+        }
+        var errors []string
+        if proxied == 0 {
+                errors = append(errors, "Caching requires a proxy site or upstream locations using http or https")
+        }
+        if !filepath.IsAbs(c.Path) || strings.ContainsAny(c.Path, " \t;{}\"'") {
+                errors = append(errors, fmt.Sprintf("Cache path %s must be an absolute path without spaces or quotes", c.Path))
+        } else if c.Path == "/" || filepath.Dir(c.Path) == "/" {
+                errors = append(errors, fmt.Sprintf("Cache path %s must be a dedicated directory, e.g. /var/cache/nginx/<site>", c.Path))
+        }
+        if !cacheSizePattern.MatchString(c.MaxSize) {
+                errors = append(errors, fmt.Sprintf("Invalid cache size %s; use a number with an optional k, m or g suffix", c.MaxSize))
+        }
+        if !durationPattern.MatchString(c.Inactive) {
+                errors = append(errors, fmt.Sprintf("Invalid cache inactive time %s; use a duration such as 60m or 1d", c.Inactive))
+        }
+        if c.Key == "" || strings.ContainsAny(c.Key, "\"\\\n") {
+                errors = append(errors, "Cache key must not be empty or contain quotes, backslashes or newlines")
+        }
+        for _, entry := range c.Valid {
+                codes, duration, found := strings.Cut(entry, "=")
+                valid := found && durationPattern.MatchString(duration) && len(strings.Fields(codes)) > 0
+                for _, code := range strings.Fields(codes) {
+                        n, err := strconv.Atoi(code)
+                        valid = valid && (code == "any" || err == nil && n >= 100 && n <= 599)
+                }
+                if !valid {
+                        errors = append(errors, fmt.Sprintf("Invalid cache valid entry %s; use \"<status> [status...]=<duration>\", e.g. \"200 302=10m\" or \"any=1m\"", entry))
+                }
+        }
+        for _, rule := range c.Bypass {
+                if _, ok := bypassVariable(rule); !ok {
+                        errors = append(errors, fmt.Sprintf("Invalid cache bypass rule %s (use cookie:<name>, header:<name> or arg:<name>)", rule))
+                }
+        }
+        if c.UseStale != "off" {
+                for _, condition := range strings.Fields(c.UseStale) {
+                        valid := false
+                        for _, known := range cacheStaleConditions {
+                                valid = valid || condition == known
+                        }
+                        if !valid {
+                                errors = append(errors, fmt.Sprintf("Unknown cache use-stale condition %s (use off or %s)", condition, strings.Join(cacheStaleConditions, ", ")))
+                        }
+                }
+        }
+        return errors
+}
+
+// Compression holds the response compression of the HTTPS server. Brotli and zstd come
+// from third-party modules, so they are only accepted when nginx was built with them.
+type Compression struct {
+        Gzip    bool
+        Brotli  bool
+        Zstd    bool
+        Static  bool // serve precompressed .gz, .br and .zst files
+        Types   []string
+        modules string // output of nginx -V and the enabled dynamic modules
+}
+
+// defaultCompressTypes lists the MIME types compressed besides text/html, which nginx
+// always compresses.
+var defaultCompressTypes = []string{
+        "text/plain", "text/css", "text/xml", "text/javascript", "application/javascript",
+        "application/json", "application/xml", "application/rss+xml", "application/wasm",
+        "image/svg+xml", "font/ttf", "font/otf",
+}
+
+var mimeTypePattern = regexp.MustCompile(`^([a-z0-9.+-]+/[a-z0-9.+*-]+|\*)$`)
+
+// Directives returns the compression directives of each enabled encoder.
+func (c Compression) Directives() []string {
+        var directives []string
+        types := strings.Join(c.Types, " ")
+        if c.Gzip {
+                directives = append(directives, "gzip on", "gzip_vary on", "gzip_proxied any", "gzip_comp_level 5",
+                        "gzip_min_length 256", "gzip_types "+types)
+        }
+        if c.Static {
+                directives = append(directives, "gzip_static on")
+        }
+        if c.Brotli {
+                directives = append(directives, "brotli on", "brotli_comp_level 5", "brotli_min_length 256", "brotli_types "+types)
+                if c.Static {
+                        directives = append(directives, "brotli_static on")
+                }
+        }
+        if c.Zstd {
+                directives = append(directives, "zstd on", "zstd_comp_level 3", "zstd_min_length 256", "zstd_types "+types)
+                if c.Static {
+                        directives = append(directives, "zstd_static on")
+                }
+        }
+        return directives
+}
+
+// nginxModules returns the output of nginx -V and the load_module lines of the enabled
+// dynamic modules, which packaged brotli and zstd modules use instead of build flags.
+func nginxModules(configDir string) string {
+        var b strings.Builder
+        cmd := exec.Command("nginx", "-V")
+        cmd.Stderr = &b
+        cmd.Run()
+        paths, _ := filepath.Glob(filepath.Join(configDir, "modules-enabled", "*.conf"))
+        for _, path := range append(paths, filepath.Join(configDir, "nginx.conf")) {
+                content, _ := os.ReadFile(path)
+                for _, line := range strings.Split(string(content), "\n") {
+                        if strings.HasPrefix(strings.TrimSpace(line), "load_module") {
+                                b.WriteString(line + "\n")
+                        }
+                }
+        }
+        return b.String()
+}
+
+// validateCompression checks the MIME types and that nginx has the needed modules.
+func validateCompression(c Compression) []string {
+        var errors []string
+        for _, t := range c.Types {
+                if t == "text/html" {
+                        errors = append(errors, "Compression types must not include text/html, which is always compressed")
+                } else if !mimeTypePattern.MatchString(t) {
+                        errors = append(errors, fmt.Sprintf("Invalid compression MIME type %s", t))
+                }
+        }
+        if c.Static && !strings.Contains(c.modules, "http_gzip_static_module") {
+                errors = append(errors, "Precompressed files require the gzip_static module, which nginx -V does not show")
+        }
+        if c.Brotli && !strings.Contains(c.modules, "brotli") {
+                errors = append(errors, "Brotli requires the ngx_brotli module, which nginx -V and modules-enabled do not show")
+        }
+        if c.Zstd && !strings.Contains(c.modules, "zstd") {
+                errors = append(errors, "Zstd requires the zstd-nginx-module, which nginx -V and modules-enabled do not show")
+        }
+        return errors
+}
+
+// AssetCache sets Cache-Control by URI through a map declared at the top of the site file:
+// fingerprinted assets are cached for a year and index.html is revalidated on every load.
+// A server-level add_header keeps the security headers, which a location would drop.
+type AssetCache struct {
+        Enabled  bool
+        Pattern  string // regular expression matching fingerprinted assets
+        Variable string // map variable, unique per site
+}
+
+// defaultAssetPattern matches the hex hashes of webpack, Angular and Create React App
+// bundles, e.g. main.3f2a9c1b.js.
+const defaultAssetPattern = `[.-][0-9a-f]{8,}\.(css|js|mjs|map|woff2?|ttf|otf|eot|png|jpe?g|gif|svg|webp|avif|ico)$`
+
+// validateAssetCache checks the asset pattern; the rules only fit files served from disk.
+func validateAssetCache(a AssetCache, siteType string, locations []Location) []string {
+        if !a.Enabled {
+                return nil
+        }
+        var errors []string
+        static := siteType == "local" || siteType == "php"
+        for _, loc := range locations {
+                static = static || loc.Target == "static"
+        }
+        if !static {
+                errors = append(errors, "Asset caching requires a local or php site, or static locations")
+        }
+        if _, err := regexp.Compile(a.Pattern); err != nil || a.Pattern == "" || strings.ContainsAny(a.Pattern, "\"\n") {
+                errors = append(errors, fmt.Sprintf("Invalid asset pattern %s", a.Pattern))
+        }
+        return errors
+}
+
+// PHP holds the FastCGI backend of php sites.
+type PHP struct {
+        FPM        string   // unix socket path or host:port of PHP-FPM
+        DenyDirs   []string // directories where .php files are never executed, e.g. /uploads
+        paramsFile string   // fastcgi_params of the configuration directory
+}
+
+var denyDirPattern = regexp.MustCompile(`^/[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// Pass returns the fastcgi_pass address.
+func (p PHP) Pass() string {
+        if strings.HasPrefix(p.FPM, "/") {
+                return "unix:" + p.FPM
+        }
+        return p.FPM
+}
+
+// DenyPattern returns the regex matching .php files under the upload directories. It is
+// rendered before the .php location, since nginx uses the first matching regex.
+func (p PHP) DenyPattern() string {
+        if len(p.DenyDirs) == 0 {
+                return ""
+        }
+        var dirs []string
+        for _, dir := range p.DenyDirs {
+                dirs = append(dirs, regexp.QuoteMeta(strings.TrimPrefix(strings.TrimSuffix(dir, "/"), "/")))
+        }
+        return "^/(" + strings.Join(dirs, "|") + ")/.*\\.php$"
+}
+
+// validatePHP checks the FPM address, which must be an existing socket when it is a path.
+func validatePHP(p PHP) []string {
+        var errors []string
+        socket := strings.TrimPrefix(p.FPM, "unix:")
+        switch {
+        case p.FPM == "":
+                errors = append(errors, "PHP-FPM socket or host:port is empty")
+        case strings.HasPrefix(socket, "/"):
+                errors = append(errors, validateSocket("PHP-FPM socket", socket)...)
+        default:
+                host, port, found := strings.Cut(p.FPM, ":")
+                if !found || host == "" || strings.ContainsAny(host, " ;{}") {
+                        errors = append(errors, "PHP-FPM address must be a socket path or host:port")
+                } else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+                        errors = append(errors, "PHP-FPM port must be a number between 1 and 65535")
+                }
+        }
+        for _, dir := range p.DenyDirs {
+                if !denyDirPattern.MatchString(strings.TrimSuffix(dir, "/")) {
+                        errors = append(errors, fmt.Sprintf("Invalid PHP deny directory %s; use absolute URI paths such as /uploads", dir))
+                }
+        }
+        if _, err := os.Stat(p.paramsFile); err != nil {
+                errors = append(errors, fmt.Sprintf("FastCGI parameters file %s does not exist", p.paramsFile))
+        }
+        return errors
+}
+
+// Stream holds the TCP or UDP proxy of stream sites, rendered in the stream context from
+// streams-available instead of sites-available.
+type Stream struct {
+        Port           int
+        Protocol       string   // tcp or udp
+        Servers        []string // host:port or unix:<socket> of the upstream servers
+        Balance        string   // least_conn, hash or random (default: round robin)
+        ConnectTimeout string
+        Timeout        string     // idle time between two reads or writes before the session is closed
+        Responses      int        // datagrams expected back for each UDP datagram, -1 to wait for the timeout
+        TLS            string     // terminate or passthrough
+        Routes         []SNIRoute // upstreams chosen by the TLS server name
+        Variable       string     // variable set by the SNI routing map
+        upstream       string     // upstream used without SNI routes
+        modules        string     // nginx -V output and enabled dynamic modules
+}
+
+// SNIRoute sends the connections for a TLS server name to its own upstream.
+type SNIRoute struct {
+        Name         string
+        Upstream     string
+        UpstreamName string
+}
+
+// streamBalancers maps --stream-balance to the upstream balancing directive.
+var streamBalancers = map[string]string{
+        "least_conn": "least_conn",
+        "hash":       "hash $remote_addr consistent",
+        "random":     "random two least_conn",
+}
+
+// parseSNIRoutes parses --sni-route entries of the form <server name>=<host:port>.
+func parseSNIRoutes(entries []string) ([]SNIRoute, error) {
+        var routes []SNIRoute
+        for _, entry := range entries {
+                name, upstream, found := strings.Cut(entry, "=")
+                if !found || name == "" || upstream == "" {
+                        return nil, fmt.Errorf("invalid SNI route %s; use <server name>=<host:port>", entry)
+                }
+                routes = append(routes, SNIRoute{Name: toASCIIName(strings.TrimSpace(name)), Upstream: strings.TrimSpace(upstream)})
+        }
+        return routes, nil
+}
+
+// BalanceDirective returns the balancing method of the upstream, empty for round robin.
+func (s Stream) BalanceDirective() string {
+        return streamBalancers[s.Balance]
+}
+
+// RouteVariable returns the variable holding the TLS server name: read from the ClientHello
+// when the TLS is passed through, or from the handshake when nginx terminates it.
+func (s Stream) RouteVariable() string {
+        if s.TLS == "terminate" {
+                return "$ssl_server_name"
+        }
+        return "$ssl_preread_server_name"
+}
+
+// Directives returns the timeouts and proxy_pass of the stream server.
+func (s Stream) Directives() []string {
+        directives := []string{"proxy_connect_timeout " + s.ConnectTimeout, "proxy_timeout " + s.Timeout}
+        if s.Protocol == "udp" && s.Responses >= 0 {
+                directives = append(directives, fmt.Sprintf("proxy_responses %d", s.Responses))
+        }
+        pass := s.upstream
+        if len(s.Routes) > 0 {
+                pass = "$" + s.Variable
+        }
+        return append(directives, "proxy_pass "+pass)
+}
+
+// validateStreamServer checks an upstream server of a stream site, host:port or a unix socket.
+func validateStreamServer(label, server string) []string {
+        if socket, ok := strings.CutPrefix(server, "unix:"); ok {
+                return validateSocket(label+" socket", socket)
+        }
+        host, port, err := net.SplitHostPort(server)
+        if err != nil || host == "" || strings.ContainsAny(host, " ;{}\"'") {
+                return []string{fmt.Sprintf("%s %s must be host:port or unix:<socket>", label, server)}
+        }
+        if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+                return []string{fmt.Sprintf("%s %s: port must be a number between 1 and 65535", label, server)}
+        }
+        return nil
+}
+
+// validateStream checks the stream proxy and rejects the HTTP options that have no
+// equivalent in the stream context.
+func validateStream(data ConfigData) []string {
+        var errors []string
+        s := data.Stream
+        if s.Port < 1 || s.Port > 65535 {
+                errors = append(errors, "Stream port must be a number between 1 and 65535")
+        }
+        if s.Protocol != "tcp" && s.Protocol != "udp" {
+                errors = append(errors, "Stream protocol must be 'tcp' or 'udp'")
+        }
+        if len(s.Servers) == 0 {
+                errors = append(errors, "Stream upstream servers are empty")
+        }
+        for _, server := range s.Servers {
+                errors = append(errors, validateStreamServer("Stream upstream", server)...)
+        }
+        if _, ok := streamBalancers[s.Balance]; s.Balance != "" && !ok {
+                errors = append(errors, "Stream balancing must be 'least_conn', 'hash' or 'random'")
+        }
+        for _, value := range []string{s.ConnectTimeout, s.Timeout} {
+                if !durationPattern.MatchString(value) {
+                        errors = append(errors, fmt.Sprintf("Invalid stream timeout %s; use an nginx time such as 10s or 5m", value))
+                }
+        }
+        if s.Responses < -1 {
+                errors = append(errors, "Stream responses must be 0 or more")
+        } else if s.Responses >= 0 && s.Protocol != "udp" {
+                errors = append(errors, "--stream-responses only applies to udp streams")
+        }
+
+        switch s.TLS {
+        case "", "terminate", "passthrough":
+        default:
+                errors = append(errors, "Stream TLS must be 'terminate' or 'passthrough'")
+        }
+        if s.TLS != "" && s.Protocol == "udp" {
+                errors = append(errors, "TLS is not supported on udp streams")
+        }
+        if s.TLS == "passthrough" && len(s.Routes) == 0 {
+                errors = append(errors, "TLS passthrough without --sni-route forwards connections like a plain tcp stream; add SNI routes or omit --stream-tls")
+        }
+        if len(s.Routes) > 0 && s.TLS == "" {
+                errors = append(errors, "SNI routes need --stream-tls=passthrough or --stream-tls=terminate")
+        }
+        if !strings.Contains(s.modules, "--with-stream") && !strings.Contains(s.modules, "ngx_stream_module") {
+                errors = append(errors, "Stream sites require the stream module, which nginx -V and modules-enabled do not show")
+        }
+        if s.TLS == "passthrough" && !strings.Contains(s.modules, "stream_ssl_preread_module") {
+                errors = append(errors, "TLS passthrough requires the stream_ssl_preread module, which nginx -V does not show")
+        }
+        if s.TLS == "terminate" && !strings.Contains(s.modules, "stream_ssl_module") {
+                errors = append(errors, "TLS termination requires the stream_ssl module, which nginx -V does not show")
+        }
+        seen := map[string]bool{}
+        for _, route := range s.Routes {
+                if err := validateServerName(route.Name, false); err != nil {
+                        errors = append(errors, fmt.Sprintf("Invalid SNI route name %s: %v", route.Name, err))
+                } else if seen[route.Name] {
+                        errors = append(errors, fmt.Sprintf("SNI route %s is listed more than once", route.Name))
+                }
+                seen[route.Name] = true
+                errors = append(errors, validateStreamServer("SNI route "+route.Name+" upstream", route.Upstream)...)
+        }
+
+        if len(data.Locations) > 0 || len(data.Aliases) > 0 {
+                errors = append(errors, "Locations and aliases do not apply to stream sites")
+        }
+        if data.Access.BasicAuth || data.Access.Satisfy != "" {
+                errors = append(errors, "Basic auth is not available for stream sites; use --allow and --deny")
+        }
+        if data.Limits.Req != "" || data.Limits.Conn != "" {
+                errors = append(errors, "Rate and connection limits are not available for stream sites")
+        }
+        if data.Listen.HTTPOnly || data.Listen.DefaultServer || data.RealIP.ProxyProtocol || len(data.RealIP.From) > 0 {
+                errors = append(errors, "--http-only, --default-server and the real IP options do not apply to stream sites")
+        }
+        return errors
+}
+
+// cspPresets maps --csp preset names to Content-Security-Policy values.
+var cspPresets = map[string]string{
+        "strict":  "default-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'self'",
+        "relaxed": "default-src 'self' https: data: 'unsafe-inline'; object-src 'none'; frame-ancestors 'self'",
+}
+
+// referrerPolicies lists the values accepted by the Referrer-Policy header.
+var referrerPolicies = []string{
+        "no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+        "same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+}
+
+// Headers returns the security headers, X-Cache-Status on cached sites and the asset
+// Cache-Control, in the order they are rendered.
+func (d ConfigData) Headers() []Header {
+        s := d.Security
+        var headers []Header
+        if s.HSTS {
+                value := fmt.Sprintf("max-age=%d", s.HSTSMaxAge)
+                if s.HSTSIncludeSubdomains {
+                        value += "; includeSubDomains"
+                }
+                if s.HSTSPreload {
+                        value += "; preload"
+                }
+                headers = append(headers, Header{"Strict-Transport-Security", value})
+        }
+        if s.CSP != "" {
+                headers = append(headers, Header{"Content-Security-Policy", s.CSP})
+        }
+        if s.FrameOptions != "" {
+                headers = append(headers, Header{"X-Frame-Options", s.FrameOptions})
+        }
+        if s.NoSniff {
+                headers = append(headers, Header{"X-Content-Type-Options", "nosniff"})
+        }
+        if s.ReferrerPolicy != "" {
+                headers = append(headers, Header{"Referrer-Policy", s.ReferrerPolicy})
+        }
+        if s.PermissionsPolicy != "" {
+                headers = append(headers, Header{"Permissions-Policy", s.PermissionsPolicy})
+        }
+        if d.Cache.Enabled {
+                headers = append(headers, Header{"X-Cache-Status", "$upstream_cache_status"})
+        }
+        if d.AssetCache.Enabled {
+                headers = append(headers, Header{"Cache-Control", "$" + d.AssetCache.Variable})
+        }
+        return headers
+}
+
+// backends counts the http and https backends passed with proxy_pass, by the site or its
+// upstream locations, and returns the uwsgi and scgi protocols in use.
+func (d ConfigData) backends(siteType string) (proxied int, gateways map[string]bool) {
+        gateways = map[string]bool{}
+        if siteType == "proxy" {
+                if d.IsGateway(d.Protocol) {
+                        gateways[d.Protocol] = true
+                } else {
+                        proxied++
+                }
+        }
+        for _, loc := range d.Locations {
+                if loc.Target != "upstream" {
+                        continue
+                }
+                if d.IsGateway(loc.Protocol) {
+                        gateways[loc.Protocol] = true
+                } else {
+                        proxied++
+                }
+        }
+        return proxied, gateways
+}
+
+// ProxyBuffering returns the proxy_buffering value of upstream locations; responses are
+// only cached when they are buffered.
+func (d ConfigData) ProxyBuffering() string {
+        if d.Cache.Enabled {
+                return "on"
+        }
+        return "off"
+}
+
+// HTTPListens returns the listen arguments of the server redirecting HTTP to HTTPS, none
+// when the site has no such server.
+func (d ConfigData) HTTPListens() []string {
+        if d.Listen.HTTPOnly || d.Listen.NoRedirect {
+                return nil
+        }
+        return d.listens(d.Listen.HTTPPort, "")
+}
+
+// SiteListens returns the listen arguments of the server of the site.
+func (d ConfigData) SiteListens() []string {
+        if d.Listen.HTTPOnly {
+                return d.listens(d.Listen.HTTPPort, "")
+        }
+        return d.listens(d.Listen.HTTPSPort, " ssl")
+}
+
+func (d ConfigData) listens(port int, params string) []string {
+        if d.Listen.DefaultServer {
+                params += " default_server"
+        }
+        if d.Listen.ReusePort {
+                params += " reuseport"
+        }
+        if d.RealIP.ProxyProtocol {
+                params += " proxy_protocol"
+        }
+        var listens []string
+        for _, socket := range d.Listen.sockets(port) {
+                listens = append(listens, socket+params)
+        }
+        return listens
+}
+
+// StreamListens returns the listen arguments of the server of a stream site.
+func (d ConfigData) StreamListens() []string {
+        params := ""
+        if d.Stream.Protocol == "udp" {
+                params += " udp"
+        }
+        if d.Stream.TLS == "terminate" {
+                params += " ssl"
+        }
+        if d.Listen.ReusePort {
+                params += " reuseport"
+        }
+        var listens []string
+        for _, socket := range d.Listen.sockets(d.Stream.Port) {
+                listens = append(listens, socket+params)
+        }
+        return listens
+}
+
+// HTTPSRedirect returns the target of the HTTP to HTTPS redirect, with the HTTPS port
+// when it is not 443.
+func (d ConfigData) HTTPSRedirect() string {
+        if d.Listen.HTTPSPort != 443 {
+                return fmt.Sprintf("https://$host:%d$request_uri", d.Listen.HTTPSPort)
+        }
+        return "https://$host$request_uri"
+}
+
+// UpstreamServer returns the server of the main proxy upstream, host:port or a unix: socket.
+func (d ConfigData) UpstreamServer() string {
+        if strings.HasPrefix(d.IPHostName, "unix:") {
+                return d.IPHostName
+        }
+        return d.IPHostName + ":" + d.PortUpstream
+}
+
+// IsGateway reports whether a backend protocol is passed with its own module, uwsgi_pass or
+// scgi_pass, instead of proxy_pass. Those backends take the request headers as HTTP_*
+// parameters, so the forwarded headers are set with <protocol>_param.
+func (d ConfigData) IsGateway(protocol string) bool {
+        return protocol == "uwsgi" || protocol == "scgi"
+}
+
+// ServerNames returns the site name followed by its aliases, as used in server_name.
+func (d ConfigData) ServerNames() string {
+        return strings.Join(append([]string{d.SiteName}, d.Aliases...), " ")
+}
+
+// Upstream is a named upstream block shared by every location proxying to the same backend.
+type Upstream struct {
+        Name    string
+        Address string
+}
+
+// Location describes an extra location block rendered in the HTTPS server.
+type Location struct {
+        Match        string   `json:"match"`              // prefix, exact, regex, iregex or priority (^~)
+        Path         string   `json:"path"`               // URI prefix, exact URI or regular expression
+        Target       string   `json:"target"`             // upstream, static, redirect or return
+        Upstream     string   `json:"upstream,omitempty"` // host:port or unix:<socket> for upstream targets
+        Protocol     string   `json:"protocol,omitempty"` // http, https, uwsgi or scgi for upstream targets
+        Root         string   `json:"root,omitempty"`     // directory for static targets
+        URL          string   `json:"url,omitempty"`      // destination for redirect targets
+        Code         int      `json:"code,omitempty"`     // status code for redirect and return targets
+        Text         string   `json:"text,omitempty"`     // optional body for return targets
+        Options      []string `json:"options,omitempty"`  // extra directives, e.g. "client_max_body_size 50m"
+        UpstreamName string   `json:"-"`
+        Access
+        Limits
+}
+
+// SiteSpec describes a site in a JSON file given with --spec. Flags override its values.
+type SiteSpec struct {
+        SiteName      string      `json:"site_name"`
+        SiteType      string      `json:"site_type"`
+        UpstreamHost  string      `json:"upstream_host"`
+        UpstreamPort  json.Number `json:"upstream_port"`
+        ProxyProtocol string      `json:"proxy_protocol"`
+        FullchainPath string      `json:"fullchain_path"`
+        PrivkeyPath   string      `json:"privkey_path"`
+        Locations     []Location  `json:"locations"`
+        Aliases       []string    `json:"aliases"`
+        DocumentRoot  string      `json:"document_root"`
+        FPM           string      `json:"fpm"`
+        PHPDenyDirs   []string    `json:"php_deny_dirs"`
+        RedirectTo    string      `json:"redirect_to"`
+        RedirectCode  int         `json:"redirect_code"`
+        PreservePath  *bool       `json:"preserve_path"`
+        PreserveQuery *bool       `json:"preserve_query"`
+
+        HSTS                  *bool  `json:"hsts"`
+        HSTSMaxAge            int    `json:"hsts_max_age"`
+        HSTSIncludeSubdomains *bool  `json:"hsts_include_subdomains"`
+        HSTSPreload           *bool  `json:"hsts_preload"`
+        CSP                   string `json:"csp"`
+        FrameOptions          string `json:"frame_options"`
+        ReferrerPolicy        string `json:"referrer_policy"`
+        PermissionsPolicy     string `json:"permissions_policy"`
+        NoSniff               *bool  `json:"nosniff"`
+
+        ClientCA          string `json:"client_ca"`
+        VerifyClient      string `json:"verify_client"`
+        VerifyDepth       int    `json:"verify_depth"`
+        ClientCRL         string `json:"client_crl"`
+        ForwardClientCert *bool  `json:"forward_client_cert"`
+
+        UpstreamSNIName     string `json:"upstream_sni_name"`
+        UpstreamVerify      *bool  `json:"upstream_verify"`
+        UpstreamCA          string `json:"upstream_ca"`
+        UpstreamVerifyDepth int    `json:"upstream_verify_depth"`
+        UpstreamClientCert  string `json:"upstream_client_cert"`
+        UpstreamClientKey   string `json:"upstream_client_key"`
+
+        Cache         *bool    `json:"cache"`
+        CachePath     string   `json:"cache_path"`
+        CacheSize     string   `json:"cache_size"`
+        CacheInactive string   `json:"cache_inactive"`
+        CacheKey      string   `json:"cache_key"`
+        CacheValid    []string `json:"cache_valid"`
+        CacheBypass   []string `json:"cache_bypass"`
+        CacheUseStale string   `json:"cache_use_stale"`
+
+        Gzip          *bool    `json:"gzip"`
+        Brotli        *bool    `json:"brotli"`
+        Zstd          *bool    `json:"zstd"`
+        CompressTypes []string `json:"compress_types"`
+        GzipStatic    *bool    `json:"gzip_static"`
+        AssetCache    *bool    `json:"asset_cache"`
+        AssetPattern  string   `json:"asset_pattern"`
+
+        ListenAddresses []string `json:"listen_addresses"`
+        IPv6            *bool    `json:"ipv6"`
+        HTTPPort        int      `json:"http_port"`
+        HTTPSPort       int      `json:"https_port"`
+        DefaultServer   *bool    `json:"default_server"`
+        ReusePort       *bool    `json:"reuseport"`
+        HTTPOnly        *bool    `json:"http_only"`
+        NoHTTPRedirect  *bool    `json:"no_http_redirect"`
+
+        AcceptProxyProtocol *bool    `json:"accept_proxy_protocol"`
+        RealIPFrom          []string `json:"real_ip_from"`
+        RealIPHeader        string   `json:"real_ip_header"`
+        RealIPRecursive     *bool    `json:"real_ip_recursive"`
+
+        StreamPort           int      `json:"stream_port"`
+        StreamProtocol       string   `json:"stream_protocol"`
+        StreamUpstreams      []string `json:"stream_upstreams"`
+        StreamBalance        string   `json:"stream_balance"`
+        StreamConnectTimeout string   `json:"stream_connect_timeout"`
+        StreamTimeout        string   `json:"stream_timeout"`
+        StreamResponses      *int     `json:"stream_responses"`
+        StreamTLS            string   `json:"stream_tls"`
+        SNIRoutes            []string `json:"sni_routes"`
+
+        Access
+        Limits
+}
+
+// locationFlags collects repeated --location flags.
+type locationFlags []Location
+
+func (l *locationFlags) String() string {
+        return fmt.Sprint(len(*l))
+}
+
+func (l *locationFlags) Set(value string) error {
+        loc, err := parseLocation(value)
+        if err != nil {
+                return err
+        }
+        *l = append(*l, loc)
+        return nil
+}
+
+// matchModifiers maps location match types to nginx modifiers.
+var matchModifiers = map[string]string{
+        "prefix":   "",
+        "exact":    "=",
+        "regex":    "~",
+        "iregex":   "~*",
+        "priority": "^~",
+}
+
+// Header returns the location arguments, e.g. "= /health" or "~* \.php$".
+func (l Location) Header() string {
+        path := l.Path
+        if strings.ContainsAny(path, " {};\"'") {
+                path = strconv.Quote(path)
+        }
+        if mod := matchModifiers[l.Match]; mod != "" {
+                return mod + " " + path
+        }
+        return path
+}
+
+// RootDirective returns alias for prefix and exact matches and root for regex matches,
+// since alias cannot be used in a regex location without captures.
+func (l Location) RootDirective() string {
+        if l.isRegex() {
+                return "root"
+        }
+        return "alias"
+}
+
+// UpstreamHost returns the host of an upstream target, used as its TLS server name.
+func (l Location) UpstreamHost() string {
+        if strings.HasPrefix(l.Upstream, "unix:") {
+                return ""
+        }
+        host, _, err := net.SplitHostPort(l.Upstream)
+        if err != nil {
+                return ""
+        }
+        return host
+}
+
+func (l Location) isRegex() bool {
+        return l.Match == "regex" || l.Match == "iregex"
+}
+
+// parseLocation parses a --location value of the form "[modifier] path target [option...]",
+// where modifier is one of =, ~, ~*, ^~ and target is one of:
+//
+//	upstream:[protocol://]host:port or upstream:[protocol://]unix:/socket
+//	static:/directory
+//	redirect:[code:]url
+//	return:code[:text]
+//
+// and options are allow=<networks>, deny=<networks>, auth[=<realm>], satisfy=any,
+// limit-req=<zone>[:burst=N][:nodelay], limit-conn=<zone>:N and limit-status=<code>.
+func parseLocation(value string) (Location, error) {
+        loc := Location{Match: "prefix"}
+        fields := strings.Fields(value)
+        for match, mod := range matchModifiers {
+                if len(fields) > 0 && mod != "" && mod == fields[0] {
+                        loc.Match = match
+                }
+        }
+        if loc.Match != "prefix" {
+                fields = fields[1:]
+        }
+        if len(fields) < 2 {
+                return loc, fmt.Errorf("invalid location %q (expected \"[modifier] path target\")", value)
+        }
+        if strings.HasPrefix(fields[1], "/") || strings.HasPrefix(fields[1], "\\") {
+                return loc, fmt.Errorf("unknown location modifier %q (use =, ~, ~* or ^~)", fields[0])
+        }
+        loc.Path = fields[0]
+
+        for _, option := range fields[2:] {
+                key, arg, _ := strings.Cut(option, "=")
+                switch key {
+                case "allow":
+                        loc.Allow = append(loc.Allow, splitList(arg)...)
+                case "deny":
+                        loc.Deny = append(loc.Deny, splitList(arg)...)
+                case "auth":
+                        loc.BasicAuth = true
+                        loc.AuthRealm = arg
+                case "satisfy":
+                        loc.Satisfy = arg
+                case "limit-req":
+                        loc.Req = arg
+                case "limit-conn":
+                        loc.Conn = arg
+                case "limit-status":
+                        n, err := strconv.Atoi(arg)
+                        if err != nil {
+                                return loc, fmt.Errorf("invalid limit status %q in location %q", arg, value)
+                        }
+                        loc.Status = n
+                default:
+                        return loc, fmt.Errorf("unknown location option %q (use allow=, deny=, auth, satisfy=, limit-req=, limit-conn= or limit-status=)", option)
+                }
+        }
+
+        target, arg, _ := strings.Cut(fields[1], ":")
+        loc.Target = target
+        switch target {
+        case "upstream":
+                loc.Protocol = "http"
+                if scheme, rest, ok := strings.Cut(arg, "://"); ok {
+                        loc.Protocol = scheme
+                        arg = rest
+                }
+                loc.Upstream = arg
+        case "static":
+                loc.Root = arg
+        case "redirect":
+                loc.Code = 301
+                if code, rest, ok := strings.Cut(arg, ":"); ok {
+                        if n, err := strconv.Atoi(code); err == nil {
+                                loc.Code = n
+                                arg = rest
+                        }
+                }
+                loc.URL = arg
+        case "return":
+                code, text, _ := strings.Cut(arg, ":")
+                n, err := strconv.Atoi(code)
+                if err != nil {
+                        return loc, fmt.Errorf("invalid return code %q in location %q", code, value)
+                }
+                loc.Code = n
+                loc.Text = text
+        default:
+                return loc, fmt.Errorf("unknown location target %q (use upstream, static, redirect or return)", target)
+        }
+        return loc, nil
+}
+
+// loadSpec reads a JSON site spec.
+func loadSpec(path string) (SiteSpec, error) {
+        var spec SiteSpec
+        content, err := os.ReadFile(path)
+        if err != nil {
+                return spec, err
+        }
+        decoder := json.NewDecoder(bytes.NewReader(content))
+        decoder.DisallowUnknownFields()
+        if err := decoder.Decode(&spec); err != nil {
+                return spec, fmt.Errorf("invalid spec %s: %v", path, err)
+        }
+        return spec, nil
+}
+
+// upstreamName builds a stable upstream name for a backend address, e.g. teste_10_0_0_5_8080.
+func upstreamName(siteHostName, address string) string {
+        name := []byte(siteHostName + "_" + address)
+        for i, c := range name {
+                if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+                        name[i] = '_'
+                }
+        }
+        return string(name)
+}
+
+// buildUpstreams names the upstream of every upstream location and SNI route, declaring one
+// upstream block per distinct backend. Locations pointing to the main proxy backend reuse its
+// upstream.
+func buildUpstreams(data *ConfigData, siteType string) {
+        data.Upstreams = nil
+        names := map[string]string{}
+        if siteType == "proxy" {
+                names[data.UpstreamServer()] = data.SiteHostName
+        }
+        for i := range data.Locations {
+                loc := &data.Locations[i]
+                if loc.Target != "upstream" {
+                        continue
+                }
+                if loc.Protocol == "" {
+                        loc.Protocol = "http"
+                }
+                name, ok := names[loc.Upstream]
+                if !ok {
+                        name = upstreamName(data.SiteHostName, loc.Upstream)
+                        names[loc.Upstream] = name
+                        data.Upstreams = append(data.Upstreams, Upstream{Name: name, Address: loc.Upstream})
+                }
+                loc.UpstreamName = name
+        }
+        for i := range data.Stream.Routes {
+                route := &data.Stream.Routes[i]
+                name, ok := names[route.Upstream]
+                if !ok {
+                        name = upstreamName(data.SiteHostName, route.Upstream)
+                        names[route.Upstream] = name
+                        data.Upstreams = append(data.Upstreams, Upstream{Name: name, Address: route.Upstream})
+                }
+                route.UpstreamName = name
+        }
+}
+
+// backendProtocols are the protocols nginx can speak to upstream backends.
+var backendProtocols = map[string]bool{"http": true, "https": true, "uwsgi": true, "scgi": true}
+
+// validateSocket checks that path is an existing unix socket; label starts the messages,
+// e.g. "Upstream socket /run/app.sock does not exist".
+func validateSocket(label, path string) []string {
+        if !filepath.IsAbs(path) || strings.ContainsAny(path, " \t;{}\"'") {
+                return []string{fmt.Sprintf("%s %s must be an absolute path without spaces or quotes", label, path)}
+        }
+        info, err := os.Stat(path)
+        if os.IsNotExist(err) {
+                return []string{fmt.Sprintf("%s %s does not exist (is the backend running?)", label, path)}
+        }
+        if err != nil || info.Mode()&os.ModeSocket == 0 {
+                return []string{fmt.Sprintf("%s %s is not a unix socket", label, path)}
+        }
+        return nil
+}
+
+// validateLocations checks each extra location and reports locations that conflict with each
+// other or with the "location /" generated by the site template.
+func validateLocations(locations []Location) []string {
+        var errors []string
+        seen := map[string]bool{"prefix /": true}
+        for _, loc := range locations {
+                if _, ok := matchModifiers[loc.Match]; !ok {
+                        errors = append(errors, fmt.Sprintf("Location %s: match must be 'prefix', 'exact', 'regex', 'iregex' or 'priority'", loc.Path))
+                        continue
+                }
+
+                // Prefix and ^~ locations share the same tree in nginx, so they clash on the same path
+                key := loc.Match + " " + loc.Path
+                switch loc.Match {
+                case "priority":
+                        key = "prefix " + loc.Path
+                case "iregex":
+                        key = "regex " + strings.ToLower(loc.Path)
+                }
+                if loc.Path == "" {
+                        errors = append(errors, "Location path is empty")
+                } else if !loc.isRegex() && !strings.HasPrefix(loc.Path, "/") {
+                        errors = append(errors, fmt.Sprintf("Location %s: path must start with /", loc.Header()))
+                } else if seen[key] {
+                        if key == "prefix /" {
+                                errors = append(errors, "Location / is generated by the site type and cannot be redefined")
+                        } else {
+                                errors = append(errors, fmt.Sprintf("Location %s is defined more than once", loc.Header()))
+                        }
+                }
+                seen[key] = true
+
+                switch loc.Target {
+                case "upstream":
+                        if socket, ok := strings.CutPrefix(loc.Upstream, "unix:"); ok {
+                                for _, err := range validateSocket("upstream socket", socket) {
+                                        errors = append(errors, fmt.Sprintf("Location %s: %s", loc.Header(), err))
+                                }
+                                if loc.Protocol == "https" {
+                                        errors = append(errors, fmt.Sprintf("Location %s: unix socket upstreams do not support https", loc.Header()))
+                                }
+                        } else if host, port, err := net.SplitHostPort(loc.Upstream); err != nil || host == "" || strings.ContainsAny(host, " ;{}\"'") {
+                                errors = append(errors, fmt.Sprintf("Location %s: upstream must be host:port, [ipv6]:port or unix:<socket>", loc.Header()))
+                        } else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+                                errors = append(errors, fmt.Sprintf("Location %s: upstream port must be a number between 1 and 65535", loc.Header()))
+                        }
+                        if !backendProtocols[loc.Protocol] {
+                                errors = append(errors, fmt.Sprintf("Location %s: protocol must be 'http', 'https', 'uwsgi' or 'scgi'", loc.Header()))
+                        }
+                case "static":
+                        if !filepath.IsAbs(loc.Root) {
+                                errors = append(errors, fmt.Sprintf("Location %s: static root must be an absolute path", loc.Header()))
+                        }
+                case "redirect":
+                        if loc.URL == "" {
+                                errors = append(errors, fmt.Sprintf("Location %s: redirect URL is empty", loc.Header()))
+                        }
+                        if loc.Code != 301 && loc.Code != 302 && loc.Code != 303 && loc.Code != 307 && loc.Code != 308 {
+                                errors = append(errors, fmt.Sprintf("Location %s: redirect code must be 301, 302, 303, 307 or 308", loc.Header()))
+                        }
+                case "return":
+                        if loc.Code < 100 || loc.Code > 599 {
+                                errors = append(errors, fmt.Sprintf("Location %s: return code must be between 100 and 599", loc.Header()))
+                        }
+                        if strings.ContainsAny(loc.Text, "\"\n") {
+                                errors = append(errors, fmt.Sprintf("Location %s: return text must not contain quotes or newlines", loc.Header()))
+                        }
+                default:
+                        errors = append(errors, fmt.Sprintf("Location %s: target must be 'upstream', 'static', 'redirect' or 'return'", loc.Header()))
+                }
+
+                // Options are written as directives of the location, one per line
+                for _, option := range loc.Options {
+                        if option == "" || strings.ContainsAny(option, ";{}\n") {
+                                errors = append(errors, fmt.Sprintf("Location %s: invalid option %q; give one directive without ; { or }", loc.Header(), option))
+                        }
+                }
+        }
+        return errors
+}
+
+// locationOverlaps warns about regex locations that take precedence over prefix locations.
+// nginx checks regexes after finding the longest prefix, so a matching regex wins unless
+// the prefix location uses ^~.
+func locationOverlaps(locations []Location) []string {
+        var warnings []string
+        var prefixes []Location
+        for _, loc := range locations {
+                if loc.Match == "prefix" {
+                        prefixes = append(prefixes, loc)
+                }
+        }
+        for _, loc := range locations {
+                if !loc.isRegex() {
+                        continue
+                }
+                pattern := loc.Path
+                if loc.Match == "iregex" {
+                        pattern = "(?i)" + pattern
+                }
+                re, err := regexp.Compile(pattern)
+                if err != nil {
+                        warnings = append(warnings, fmt.Sprintf("Location %s could not be checked for overlaps: %v", loc.Header(), err))
+                        continue
+                }
+                for _, prefix := range prefixes {
+                        if re.MatchString(prefix.Path) {
+                                warnings = append(warnings, fmt.Sprintf("Location %s overrides prefix location %s for matching requests; use ^~ on the prefix location if it should win", loc.Header(), prefix.Path))
+                        }
+                }
+        }
+        return warnings
+}
+
+// redirectURL builds the return target of a redirect site. A bare host is redirected over
+// https, and the request path and query string are appended when preserved. The path
+// alone comes from pathVariable, mapped from $request_uri: $uri is decoded, so an encoded
+// CRLF in the request would end up in the Location header.
+func redirectURL(target string, preservePath, preserveQuery bool, pathVariable string) (string, error) {
+        if !strings.Contains(target, "://") {
+                target = "https://" + target
+        }
+        u, err := url.Parse(target)
+        if err != nil {
+                return "", err
+        }
+        if u.Scheme != "http" && u.Scheme != "https" {
+                return "", fmt.Errorf("scheme must be http or https")
+        }
+        if u.Host == "" {
+                return "", fmt.Errorf("host is empty")
+        }
+        if (preservePath || preserveQuery) && (u.RawQuery != "" || u.Fragment != "") {
+                return "", fmt.Errorf("query string and fragment cannot be combined with path or query preservation")
+        }
+
+        switch {
+        case preservePath && preserveQuery:
+                return strings.TrimSuffix(target, "/") + "$request_uri", nil
+        case preservePath:
+                return strings.TrimSuffix(target, "/") + "$" + pathVariable, nil
+        case preserveQuery:
+                return target + "$is_args$args", nil
+        }
+        return target, nil
 }
 
-server {
-    listen 80;
-    server_name {{.SiteName}};
-    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
-    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+// redirectHost returns the lowercase host, without port, that a redirect URL points to.
+func redirectHost(redirect string) string {
+        u, err := url.Parse(strings.Split(redirect, "$")[0])
+        if err != nil {
+                return ""
+        }
+        return strings.ToLower(u.Hostname())
+}
 
-    location / {
-        return 301 https://$host$request_uri;
-    }
+// newTemplate parses the template for the given site type.
+func newTemplate(siteType string) (*template.Template, error) {
+        tmplContent := localTemplate
+        switch siteType {
+        case "proxy":
+                tmplContent = proxyTemplate
+        case "php":
+                tmplContent = phpTemplate
+        case "redirect":
+                tmplContent = redirectTemplate
+        case "stream":
+                tmplContent = streamTemplate
+        }
+        tmpl, err := template.New("nginx").Parse(sharedTemplates)
+        if err != nil {
+                return nil, err
+        }
+        return tmpl.Parse(tmplContent)
 }
 
-server {
-    listen 443 ssl;
-    server_name {{.SiteName}};
-    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
-    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+// toASCIIName lowercases a server name and converts its internationalized labels to
+// punycode (e.g. café.example.com becomes xn--caf-dma.example.com). Regex names are
+// returned unchanged.
+func toASCIIName(name string) string {
+        if strings.HasPrefix(name, "~") {
+                return name
+        }
+        // Labels are converted one by one, since the IDNA profile rejects the * wildcard; a
+        // label it cannot convert is kept and then rejected by validateServerName
+        labels := strings.Split(strings.ToLower(name), ".")
+        for i, label := range labels {
+                for _, r := range label {
+                        if r >= 0x80 {
+                                if ascii, err := idna.Lookup.ToASCII(label); err == nil {
+                                        labels[i] = ascii
+                                }
+                                break
+                        }
+                }
+        }
+        return strings.Join(labels, ".")
+}
 
-    ssl_certificate "{{.FullchainPath}}";
-    ssl_certificate_key "{{.PrivkeyPath}}";
-    ssl_session_timeout 10m;
-    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
-    ssl_prefer_server_ciphers on;
-    ssl_dhparam /etc/nginx/dhparam.pem;
+var (
+        domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+        topLevelPattern    = regexp.MustCompile(`^([a-z]{2,63}|xn--[a-z0-9-]{1,59})$`)
+)
 
-    location / {
-        proxy_pass {{.Protocol}}://{{.SiteHostName}};
-        proxy_redirect off;
-        proxy_buffering off;
-        proxy_set_header Host $host;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-        proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-Proto $scheme;
-    }
-}`
+// validateServerName checks a server name in ASCII form. Besides plain domains, nginx accepts
+// wildcards in the first or last label (*.example.com, www.example.*), the .example.com form
+// and, when allowRegex is set, regular expressions prefixed with ~.
+func validateServerName(name string, allowRegex bool) error {
+        if strings.HasPrefix(name, "~") {
+                if !allowRegex {
+                        return fmt.Errorf("regex server names can only be used as aliases")
+                }
+                if _, err := regexp.Compile(name[1:]); err != nil {
+                        return fmt.Errorf("invalid regex: %v", err)
+                }
+                return nil
+        }
+        if len(name) > 253 {
+                return fmt.Errorf("name is longer than 253 characters")
+        }
 
-const localTemplate = `server {
-    listen 80;
-    server_name {{.SiteName}};
-    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
-    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+        labels := strings.Split(strings.TrimPrefix(name, "."), ".")
+        if len(labels) < 2 {
+                return fmt.Errorf("name must have at least two labels")
+        }
+        last := len(labels) - 1
+        for i, label := range labels {
+                switch {
+                case label == "*" && (i == 0 || i == last) && !strings.HasPrefix(name, "."):
+                case i == last && !topLevelPattern.MatchString(label):
+                        return fmt.Errorf("invalid top-level domain %q", label)
+                case !domainLabelPattern.MatchString(label):
+                        return fmt.Errorf("invalid label %q", label)
+                }
+        }
+        if labels[0] == "*" && labels[last] == "*" {
+                return fmt.Errorf("only one wildcard is allowed")
+        }
+        return nil
+}
 
-    location / {
-        return 301 https://$host$request_uri;
-    }
+// serverNameMatches reports whether a host would be served by a server name: the exact
+// name, a wildcard such as *.example.com, .example.com or www.example.*, or a ~regex.
+func serverNameMatches(name, host string) bool {
+        name, host = strings.ToLower(name), strings.ToLower(host)
+        switch {
+        case strings.HasPrefix(name, "~"):
+                re, err := regexp.Compile(name[1:])
+                return err == nil && re.MatchString(host)
+        case strings.HasPrefix(name, "*."):
+                return strings.HasSuffix(host, name[1:])
+        case strings.HasPrefix(name, "."):
+                return host == name[1:] || strings.HasSuffix(host, name)
+        case strings.HasSuffix(name, ".*"):
+                return strings.HasPrefix(host, name[:len(name)-1])
+        }
+        return name == host
 }
 
-server {
-    listen 443 ssl;
-    server_name {{.SiteName}};
-    access_log /var/log/nginx/{{.SiteHostName}}_access.log;
-    error_log /var/log/nginx/{{.SiteHostName}}_error.log;
+// siteHostName extracts the config name from a site name (e.g. teste from teste.tjap.jus.br).
+// Wildcard sites get a _. prefix (e.g. _.apps for *.apps.tjap.jus.br), which no host name
+// can have, so that they do not share the file, upstream and htpasswd of apps.tjap.jus.br.
+func siteHostName(siteName string) string {
+        trimmed := strings.TrimPrefix(strings.TrimPrefix(siteName, "*"), ".")
+        parts := strings.Split(trimmed, ".")
+        if len(parts) < 2 {
+                return ""
+        }
+        if trimmed != siteName {
+                return "_." + parts[0]
+        }
+        return parts[0]
+}
 
-    ssl_certificate "{{.FullchainPath}}";
-    ssl_certificate_key "{{.PrivkeyPath}}";
-    ssl_session_timeout 10m;
-    ssl_ciphers 'ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA256';
-    ssl_prefer_server_ciphers on;
-    ssl_dhparam /etc/nginx/dhparam.pem;
+// siteVariable returns the prefix of the map variables of a site, e.g. nx2_teste.
+func siteVariable(siteHostName string) string {
+        return "nx2_" + strings.Map(func(r rune) rune {
+                if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+                        return r
+                }
+                return '_'
+        }, strings.ToLower(siteHostName))
+}
 
-    root /var/www/{{.SiteHostName}};
-    index index.html index.htm;
+// findServerNames returns the server names declared in a config file.
+func findServerNames(path string) ([]string, error) {
+        f, err := nginxconf.ParseFile(path)
+        if err != nil {
+                return nil, err
+        }
+        var names []string
+        nginxconf.Walk(f.Directives, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+                if d.Name == "server_name" {
+                        for _, name := range d.Values() {
+                                names = append(names, strings.ToLower(name))
+                        }
+                }
+                return true
+        })
+        return names, nil
+}
 
-    location / {
-        try_files $uri $uri/ /index.html;
-    }
-}`
+// checkClaimedNames looks for the given server names in the other sites of sites-available and
+// sites-enabled. Names claimed by an enabled site are errors, since nginx would silently ignore
+// one of the servers; names only claimed by a disabled site are warnings.
+func checkClaimedNames(configDir, siteHostName string, names []string) (errors, warnings []string) {
+        wanted := map[string]bool{}
+        for _, name := range names {
+                wanted[strings.ToLower(name)] = true
+        }
 
-// ConfigData holds template variables.
-type ConfigData struct {
-        SiteName      string
-        SiteHostName  string
-        IPHostName    string
-        PortUpstream  string
-        FullchainPath string
-        PrivkeyPath   string
-        Protocol      string
+        for _, dir := range []string{"sites-enabled", "sites-available"} {
+                files, _ := filepath.Glob(filepath.Join(configDir, dir, "*"))
+                for _, file := range files {
+                        if filepath.Base(file) == siteHostName+".conf" {
+                                continue
+                        }
+                        claimed, err := findServerNames(file)
+                        if err != nil {
+                                continue
+                        }
+                        reported := map[string]bool{}
+                        for _, name := range claimed {
+                                if !wanted[name] || reported[name] {
+                                        continue
+                                }
+                                reported[name] = true
+                                if dir == "sites-enabled" {
+                                        errors = append(errors, fmt.Sprintf("Server name %s is already used by enabled site %s", name, file))
+                                } else if _, err := os.Lstat(filepath.Join(configDir, "sites-enabled", filepath.Base(file))); os.IsNotExist(err) {
+                                        warnings = append(warnings, fmt.Sprintf("Server name %s is also used by disabled site %s", name, file))
+                                }
+                        }
+                }
+        }
+        return errors, warnings
+}
+
+// streamsIncluded reports whether nginx.conf includes streams-enabled, assuming it does when
+// nginx.conf cannot be read.
+func streamsIncluded(configDir string) bool {
+        f, err := nginxconf.ParseFile(filepath.Join(configDir, "nginx.conf"))
+        if err != nil {
+                return true
+        }
+        included := false
+        nginxconf.Walk(f.Directives, func(d *nginxconf.Directive, parents []*nginxconf.Directive) bool {
+                included = included || d.Name == "include" && strings.Contains(d.Arg(0), "streams-enabled")
+                return true
+        })
+        return included
 }
 
 // isIPAddress checks if the input is an IP address (IPv4 or IPv6).
@@ -105,15 +2224,50 @@ func isIPAddress(input string) bool {
         return regexp.MustCompile(ipv4Pattern).MatchString(input) || regexp.MustCompile(ipv6Pattern).MatchString(input)
 }
 
+// validateSecurityHeaders checks the security header options. HSTS preload follows the
+// requirements of the browser preload lists.
+func validateSecurityHeaders(s SecurityHeaders) []string {
+        var errors []string
+        if s.HSTS {
+                if s.HSTSMaxAge < 0 {
+                        errors = append(errors, "HSTS max-age must not be negative")
+                }
+                if s.HSTSPreload && (!s.HSTSIncludeSubdomains || s.HSTSMaxAge < 31536000) {
+                        errors = append(errors, "HSTS preload requires includeSubDomains and a max-age of at least 31536000 (one year)")
+                }
+        }
+        if s.FrameOptions != "" && s.FrameOptions != "DENY" && s.FrameOptions != "SAMEORIGIN" {
+                errors = append(errors, "Frame options must be DENY or SAMEORIGIN")
+        }
+        if s.ReferrerPolicy != "" {
+                valid := false
+                for _, policy := range referrerPolicies {
+                        if s.ReferrerPolicy == policy {
+                                valid = true
+                        }
+                }
+                if !valid {
+                        errors = append(errors, fmt.Sprintf("Referrer policy must be one of: %s", strings.Join(referrerPolicies, ", ")))
+                }
+        }
+        if strings.ContainsAny(s.CSP, "\"\\\n\r") {
+                errors = append(errors, "CSP must not contain double quotes, backslashes or line breaks")
+        }
+        if strings.ContainsAny(s.PermissionsPolicy, "\"\\\n\r") {
+                errors = append(errors, "Permissions policy must not contain double quotes, backslashes or line breaks")
+        }
+        return errors
+}
+
 // validateParams checks if all parameters are valid for Nginx.
 func validateParams(data ConfigData, siteType string) []string {
         var errors []string
 
-        // Validate site name (basic domain format: at least one dot, no spaces)
+        // Validate site name (domain or wildcard, already converted to punycode)
         if data.SiteName == "" {
                 errors = append(errors, "Site name is empty")
-        } else if !regexp.MustCompile(`^[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`).MatchString(data.SiteName) {
-                errors = append(errors, "Invalid site name format (must be a valid domain, e.g., www.example.com)")
+        } else if err := validateServerName(data.SiteName, false); err != nil {
+                errors = append(errors, fmt.Sprintf("Invalid site name format (must be a valid domain, e.g., www.example.com or *.example.com): %v", err))
         }
 
         // Validate site hostname (must not be empty)
@@ -122,60 +2276,248 @@ func validateParams(data ConfigData, siteType string) []string {
         }
 
         // Validate site type
-        if siteType != "proxy" && siteType != "local" {
-                errors = append(errors, "Site type must be 'proxy' or 'local'")
+        if siteType != "proxy" && siteType != "local" && siteType != "php" && siteType != "redirect" && siteType != "stream" {
+                errors = append(errors, "Site type must be 'proxy', 'local', 'php', 'redirect' or 'stream'")
+        }
+        if siteType == "stream" {
+                errors = append(errors, validateStream(data)...)
+        }
+
+        // Validate the document root and FastCGI backend of local and php sites
+        if (siteType == "local" || siteType == "php") && (!filepath.IsAbs(data.DocumentRoot) || strings.ContainsAny(data.DocumentRoot, " \t;{}\"'")) {
+                errors = append(errors, fmt.Sprintf("Document root %s must be an absolute path without spaces or quotes", data.DocumentRoot))
+        }
+        if siteType == "php" {
+                errors = append(errors, validatePHP(data.PHP)...)
+        }
+
+        // Validate redirect-specific parameters
+        if siteType == "redirect" {
+                if data.RedirectURL == "" {
+                        errors = append(errors, "Redirect target is empty")
+                } else if host := redirectHost(data.RedirectURL); host != "" {
+                        for _, name := range append([]string{data.SiteName}, data.Aliases...) {
+                                if serverNameMatches(name, host) {
+                                        errors = append(errors, fmt.Sprintf("Redirect target %s points back to %s (redirect loop)", host, name))
+                                }
+                        }
+                }
+
+                switch data.RedirectCode {
+                case 301, 302, 307, 308:
+                default:
+                        errors = append(errors, "Redirect code must be 301, 302, 307 or 308")
+                }
+        }
+
+        // Validate aliases
+        seen := map[string]bool{data.SiteName: true}
+        for _, alias := range data.Aliases {
+                if err := validateServerName(alias, true); err != nil {
+                        errors = append(errors, fmt.Sprintf("Invalid alias %s: %v", alias, err))
+                } else if seen[alias] {
+                        errors = append(errors, fmt.Sprintf("Server name %s is listed more than once", alias))
+                }
+                seen[alias] = true
         }
 
         // Validate proxy-specific parameters
         if siteType == "proxy" {
-                if data.IPHostName == "" {
-                        errors = append(errors, "Upstream hostname or IP is empty")
-                } else if strings.Contains(data.IPHostName, " ") {
-                        errors = append(errors, "Upstream hostname or IP contains invalid characters (spaces)")
+                if socket, ok := strings.CutPrefix(data.IPHostName, "unix:"); ok {
+                        errors = append(errors, validateSocket("Upstream socket", socket)...)
+                        if data.PortUpstream != "" {
+                                errors = append(errors, "Upstream port must be empty for unix socket upstreams")
+                        }
+                        if data.Protocol == "https" {
+                                errors = append(errors, "Unix socket upstreams do not support https")
+                        }
+                } else {
+                        if data.IPHostName == "" {
+                                errors = append(errors, "Upstream hostname or IP is empty")
+                        } else if strings.Contains(data.IPHostName, " ") {
+                                errors = append(errors, "Upstream hostname or IP contains invalid characters (spaces)")
+                        }
+
+                        if data.PortUpstream == "" {
+                                errors = append(errors, "Upstream port is empty")
+                        } else if port, err := strconv.Atoi(data.PortUpstream); err != nil || port < 1 || port > 65535 {
+                                errors = append(errors, "Upstream port must be a number between 1 and 65535")
+                        }
+                }
+
+                if !backendProtocols[data.Protocol] {
+                        errors = append(errors, "Protocol must be 'http', 'https', 'uwsgi' or 'scgi'")
                 }
+        }
 
-                if data.PortUpstream == "" {
-                        errors = append(errors, "Upstream port is empty")
-                } else if port, err := strconv.Atoi(data.PortUpstream); err != nil || port < 1 || port > 65535 {
-                        errors = append(errors, "Upstream port must be a number between 1 and 65535")
+        // Caching and client certificate forwarding only apply to proxy_pass backends, and
+        // uwsgi and scgi backends need the parameters file of their module
+        proxied, gateways := data.backends(siteType)
+        for _, protocol := range []string{"uwsgi", "scgi"} {
+                params := filepath.Join(data.configDir, protocol+"_params")
+                if _, err := os.Stat(params); gateways[protocol] && err != nil {
+                        errors = append(errors, fmt.Sprintf("%s parameters file %s does not exist", strings.ToUpper(protocol), params))
                 }
+        }
 
-                if data.Protocol != "http" && data.Protocol != "https" {
-                        errors = append(errors, "Protocol must be 'http' or 'https'")
+        // Validate extra locations and security headers
+        errors = append(errors, validateLocations(data.Locations)...)
+        errors = append(errors, validateSecurityHeaders(data.Security)...)
+        errors = append(errors, validateClientTLS(data.ClientTLS, proxied)...)
+        errors = append(errors, validateCache(data.Cache, proxied)...)
+        errors = append(errors, validateCompression(data.Compression)...)
+        errors = append(errors, validateAssetCache(data.AssetCache, siteType, data.Locations)...)
+        errors = append(errors, validateRealIP(data.RealIP)...)
+        errors = append(errors, validateAccess(data.Access, "")...)
+        errors = append(errors, validateLimits(data.Limits, "")...)
+        for _, loc := range data.Locations {
+                context := fmt.Sprintf("Location %s: ", loc.Header())
+                errors = append(errors, validateAccess(loc.Access, context)...)
+                errors = append(errors, validateLimits(loc.Limits, context)...)
+                // return runs in the rewrite phase, before nginx checks limits and access
+                if loc.Target == "return" || loc.Target == "redirect" {
+                        if len(loc.Access.Directives()) > 0 {
+                                errors = append(errors, context+"Access control has no effect on return and redirect targets")
+                        }
+                        if loc.Limits.Req != "" || loc.Limits.Conn != "" {
+                                errors = append(errors, context+"Rate and connection limits have no effect on return and redirect targets")
+                        }
                 }
         }
 
-        // Check certificate files
-        if data.FullchainPath == "" {
-                errors = append(errors, "Certificate path is empty")
-        } else if _, err := os.Stat(data.FullchainPath); os.IsNotExist(err) {
-                errors = append(errors, fmt.Sprintf("Certificate file %s does not exist", data.FullchainPath))
-        } else if info, err := os.Stat(data.FullchainPath); err != nil || info.IsDir() {
-                errors = append(errors, fmt.Sprintf("Certificate path %s is not a valid file", data.FullchainPath))
+        // Validate the TLS connections to https upstreams
+        var httpsHosts []string
+        if siteType == "proxy" && data.Protocol == "https" {
+                httpsHosts = append(httpsHosts, data.IPHostName)
+        }
+        for _, loc := range data.Locations {
+                if loc.Target == "upstream" && loc.Protocol == "https" {
+                        httpsHosts = append(httpsHosts, loc.UpstreamHost())
+                }
         }
+        errors = append(errors, validateUpstreamTLS(data.UpstreamTLS, httpsHosts)...)
 
-        if data.PrivkeyPath == "" {
-                errors = append(errors, "Private key path is empty")
-        } else if _, err := os.Stat(data.PrivkeyPath); os.IsNotExist(err) {
-                errors = append(errors, fmt.Sprintf("Private key file %s does not exist", data.PrivkeyPath))
-        } else if info, err := os.Stat(data.PrivkeyPath); err != nil || info.IsDir() {
-                errors = append(errors, fmt.Sprintf("Private key path %s is not a valid file", data.PrivkeyPath))
+        // Check certificate files; plain HTTP sites and streams without TLS termination have
+        // none, so HTTPS-only options are errors
+        errors = append(errors, validateListen(data.Listen)...)
+        if data.Listen.HTTPOnly {
+                if data.ClientTLS.CA != "" {
+                        errors = append(errors, "Client certificates require HTTPS and cannot be used with --http-only")
+                }
+                if data.Security.HSTS {
+                        errors = append(errors, "HSTS requires HTTPS and cannot be used with --http-only")
+                }
+        } else if siteType != "stream" || data.Stream.TLS == "terminate" {
+                errors = append(errors, validateFile("Certificate", data.FullchainPath)...)
+                errors = append(errors, validateFile("Private key", data.PrivkeyPath)...)
         }
 
         return errors
 }
 
+// validateFile checks that a certificate or key path names an existing file; label starts
+// the messages, e.g. "Certificate path is empty".
+func validateFile(label, path string) []string {
+        if path == "" {
+                return []string{label + " path is empty"}
+        }
+        info, err := os.Stat(path)
+        if os.IsNotExist(err) {
+                return []string{fmt.Sprintf("%s file %s does not exist", label, path)}
+        }
+        if err != nil || info.IsDir() {
+                return []string{fmt.Sprintf("%s path %s is not a valid file", label, path)}
+        }
+        return nil
+}
+
 func main() {
         // Define flags
         help := flag.Bool("help", false, "Display usage information")
         configDir := flag.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
         siteNameFlag := flag.String("site-name", "", "Full site name (e.g., www.example.com)")
-        siteTypeFlag := flag.String("site-type", "", "Site type (proxy or local)")
-        upstreamHostFlag := flag.String("upstream-host", "", "Upstream hostname or IP for proxy")
+        siteTypeFlag := flag.String("site-type", "", "Site type (proxy, local, php, redirect or stream)")
+        upstreamHostFlag := flag.String("upstream-host", "", "Upstream hostname, IP or unix:<socket> for proxy")
         upstreamPortFlag := flag.String("upstream-port", "", "Upstream port for proxy")
-        proxyProtocolFlag := flag.String("proxy-protocol", "", "Proxy protocol for proxy (http or https)")
+        proxyProtocolFlag := flag.String("proxy-protocol", "", "Proxy protocol for proxy (http, https, uwsgi or scgi)")
         fullchainPathFlag := flag.String("fullchain-path", "", "Path to fullchain certificate")
         privkeyPathFlag := flag.String("privkey-path", "", "Path to private key")
+        aliasesFlag := flag.String("aliases", "", "Comma-separated extra server names")
+        redirectToFlag := flag.String("redirect-to", "", "Redirect target URL or host for redirect sites")
+        redirectCodeFlag := flag.Int("redirect-code", 301, "Redirect status code (301, 302, 307 or 308)")
+        documentRootFlag := flag.String("document-root", "", "Document root of local and php sites (default: /var/www/<site>)")
+        fpmFlag := flag.String("fpm", "", "PHP-FPM socket path or host:port for php sites")
+        phpDenyDirsFlag := flag.String("php-deny-dirs", "/uploads", "Comma-separated directories where .php files are never executed")
+        streamPortFlag := flag.Int("stream-port", 0, "Listen port of stream sites")
+        streamProtocolFlag := flag.String("stream-protocol", "tcp", "Transport of stream sites (tcp or udp)")
+        streamUpstreamsFlag := flag.String("stream-upstreams", "", "Comma-separated host:port or unix:<socket> upstream servers of stream sites")
+        streamBalanceFlag := flag.String("stream-balance", "", "Balancing of the stream upstream servers (least_conn, hash or random)")
+        streamConnectTimeoutFlag := flag.String("stream-connect-timeout", "10s", "Timeout for connecting to a stream upstream server")
+        streamTimeoutFlag := flag.String("stream-timeout", "", "Idle timeout of stream sessions (default: 10m for tcp, 30s for udp)")
+        streamResponsesFlag := flag.Int("stream-responses", -1, "Datagrams expected back for each udp datagram (default: wait for the timeout)")
+        streamTLSFlag := flag.String("stream-tls", "", "TLS handling of stream sites (terminate or passthrough)")
+        sniRouteFlag := flag.String("sni-route", "", "Comma-separated <server name>=<host:port> routes of TLS stream sites")
+        preservePathFlag := flag.Bool("preserve-path", true, "Append the request path to the redirect target")
+        preserveQueryFlag := flag.Bool("preserve-query", true, "Append the query string to the redirect target")
+        hstsFlag := flag.Bool("hsts", false, "Send Strict-Transport-Security")
+        hstsMaxAgeFlag := flag.Int("hsts-max-age", 31536000, "HSTS max-age in seconds")
+        hstsIncludeSubdomainsFlag := flag.Bool("hsts-include-subdomains", false, "Add includeSubDomains to HSTS")
+        hstsPreloadFlag := flag.Bool("hsts-preload", false, "Add preload to HSTS")
+        cspFlag := flag.String("csp", "", "Content-Security-Policy value or preset (strict or relaxed)")
+        frameOptionsFlag := flag.String("frame-options", "", "X-Frame-Options value (DENY or SAMEORIGIN)")
+        referrerPolicyFlag := flag.String("referrer-policy", "", "Referrer-Policy value")
+        permissionsPolicyFlag := flag.String("permissions-policy", "", "Permissions-Policy value")
+        noSniffFlag := flag.Bool("nosniff", false, "Send X-Content-Type-Options: nosniff")
+        allowFlag := flag.String("allow", "", "Comma-separated addresses, CIDR ranges or @name access lists allowed")
+        denyFlag := flag.String("deny", "", "Comma-separated addresses or CIDR ranges denied")
+        basicAuthFlag := flag.Bool("basic-auth", false, "Require a user of the htpasswd file")
+        authRealmFlag := flag.String("auth-realm", "", "Basic auth realm (default: Restricted)")
+        authFileFlag := flag.String("auth-file", "", "Htpasswd file (default: <config-dir>/htpasswd/<site>)")
+        satisfyFlag := flag.String("satisfy", "", "all (default) or any: whether clients must pass both IP rules and basic auth")
+        clientCAFlag := flag.String("client-ca", "", "PEM bundle of the CAs trusted for client certificates (enables mutual TLS)")
+        verifyClientFlag := flag.String("verify-client", "", "Client certificate verification (on or optional; default: on)")
+        verifyDepthFlag := flag.Int("verify-depth", 1, "Maximum client certificate chain depth")
+        clientCRLFlag := flag.String("client-crl", "", "CRL file checked for revoked client certificates")
+        limitReqFlag := flag.String("limit-req", "", "Request rate limit as zone[:burst=N][:nodelay|:delay=N] (zones from nx2 zones)")
+        limitConnFlag := flag.String("limit-conn", "", "Connection limit as zone:N (zones from nx2 zones)")
+        limitStatusFlag := flag.Int("limit-status", 0, "Status of requests rejected by the limits, e.g. 429 (default: 503)")
+        cacheFlag := flag.Bool("cache", false, "Cache upstream responses (implied by the other --cache-* options)")
+        cachePathFlag := flag.String("cache-path", "", "Cache directory (default: /var/cache/nginx/<site>)")
+        cacheSizeFlag := flag.String("cache-size", "1g", "Maximum cache size")
+        cacheInactiveFlag := flag.String("cache-inactive", "60m", "Remove cached responses not requested for this long")
+        cacheKeyFlag := flag.String("cache-key", "$scheme$request_method$host$request_uri", "Cache key")
+        cacheValidFlag := flag.String("cache-valid", "200 301 302=10m,404=1m", "Comma-separated \"<status>...=<duration>\" cache times")
+        cacheBypassFlag := flag.String("cache-bypass", "", "Comma-separated cookie:<name>, header:<name> or arg:<name> rules that skip the cache")
+        cacheUseStaleFlag := flag.String("cache-use-stale", "error timeout updating http_500 http_502 http_503 http_504", "proxy_cache_use_stale conditions, or off")
+        gzipFlag := flag.Bool("gzip", false, "Compress responses with gzip")
+        brotliFlag := flag.Bool("brotli", false, "Compress responses with brotli (requires ngx_brotli)")
+        zstdFlag := flag.Bool("zstd", false, "Compress responses with zstd (requires zstd-nginx-module)")
+        compressTypesFlag := flag.String("compress-types", strings.Join(defaultCompressTypes, ","), "Comma-separated MIME types to compress besides text/html")
+        gzipStaticFlag := flag.Bool("gzip-static", false, "Serve precompressed .gz files (and .br and .zst with --brotli and --zstd)")
+        assetCacheFlag := flag.Bool("asset-cache", false, "Cache fingerprinted assets for a year and revalidate index.html")
+        assetPatternFlag := flag.String("asset-pattern", defaultAssetPattern, "Regular expression matching fingerprinted assets")
+        acceptProxyProtocolFlag := flag.Bool("accept-proxy-protocol", false, "Accept the PROXY protocol from an L4 load balancer on the listen sockets")
+        realIPFromFlag := flag.String("real-ip-from", "", "Comma-separated networks of the trusted load balancers or proxies")
+        realIPHeaderFlag := flag.String("real-ip-header", "", "Header with the client address (default: proxy_protocol with --accept-proxy-protocol, else X-Forwarded-For)")
+        listenAddressFlag := flag.String("listen-address", "", "Comma-separated IP addresses to listen on (default: every IPv4 address)")
+        ipv6Flag := flag.Bool("ipv6", false, "Also listen on every IPv6 address ([::])")
+        httpPortFlag := flag.Int("http-port", 80, "HTTP port")
+        httpsPortFlag := flag.Int("https-port", 443, "HTTPS port")
+        defaultServerFlag := flag.Bool("default-server", false, "Make the site the default server of its listen sockets")
+        reusePortFlag := flag.Bool("reuseport", false, "Open a listen socket per worker process (reuseport)")
+        httpOnlyFlag := flag.Bool("http-only", false, "Serve the site over plain HTTP only, without certificates")
+        noHTTPRedirectFlag := flag.Bool("no-http-redirect", false, "Do not create the server redirecting HTTP to HTTPS")
+        realIPRecursiveFlag := flag.Bool("real-ip-recursive", false, "Skip every trusted address in the header instead of only the last one")
+        upstreamSNINameFlag := flag.String("upstream-sni-name", "", "Server name sent to and verified on https upstreams (default: the upstream host)")
+        upstreamVerifyFlag := flag.Bool("upstream-verify", false, "Verify the certificate of https upstreams (implied by --upstream-ca)")
+        upstreamCAFlag := flag.String("upstream-ca", "", "PEM bundle of the CAs trusted for https upstreams")
+        upstreamVerifyDepthFlag := flag.Int("upstream-verify-depth", 1, "Maximum upstream certificate chain depth")
+        upstreamCertFlag := flag.String("upstream-client-cert", "", "Client certificate presented to https upstreams")
+        upstreamKeyFlag := flag.String("upstream-client-key", "", "Private key of the upstream client certificate")
+        forwardClientCertFlag := flag.Bool("forward-client-cert", false, "Forward the client certificate verification result, subject and fingerprint upstream")
+        specFlag := flag.String("spec", "", "Path to a JSON site spec")
+        var locations locationFlags
+        flag.Var(&locations, "location", "Extra location as \"[modifier] path target\" (repeatable)")
         flag.Parse()
 
         // Display help if --help is passed
@@ -184,13 +2526,98 @@ func main() {
                 fmt.Println("Create an Nginx site configuration in sites-available using the hostname (e.g., teste.conf for teste.tjap.jus.br).")
                 fmt.Println("\nOptions:")
                 fmt.Println("  --config-dir=<path>      Specify the Nginx configuration directory (default: /etc/nginx)")
-                fmt.Println("  --site-name=<name>      Full site name (e.g., www.example.com)")
-                fmt.Println("  --site-type=<type>      Site type (proxy or local)")
-                fmt.Println("  --upstream-host=<host>  Upstream hostname or IP for proxy sites")
-                fmt.Println("  --upstream-port=<port>  Upstream port for proxy sites")
-                fmt.Println("  --proxy-protocol=<protocol>  Proxy protocol for proxy sites (http or https)")
+                fmt.Println("  --site-name=<name>      Full site name (e.g., www.example.com, *.example.com or an IDN such as café.example.com)")
+                fmt.Println("  --site-type=<type>      Site type (proxy, local, php, redirect or stream)")
+                fmt.Println("  --upstream-host=<host>  Upstream hostname or IP for proxy sites, or unix:<socket> for a unix socket")
+                fmt.Println("  --upstream-port=<port>  Upstream port for proxy sites (omitted for unix sockets)")
+                fmt.Println("  --proxy-protocol=<protocol>  Proxy protocol for proxy sites (http, https, uwsgi or scgi)")
                 fmt.Println("  --fullchain-path=<path> Path to fullchain certificate file (default: /opt/certs/fullchain.pem)")
                 fmt.Println("  --privkey-path=<path>   Path to private key file (default: /opt/certs/privkey.pem)")
+                fmt.Println("  --aliases=<names>       Comma-separated extra server names: domains, wildcards (*.example.com) or regexes (~^api\\d+\\.example\\.com$)")
+                fmt.Println("  --document-root=<path>  Document root of local and php sites (default: /var/www/<site>)")
+                fmt.Println("  --fpm=<address>         PHP-FPM socket path or host:port for php sites (default: /run/php/php-fpm.sock)")
+                fmt.Println("  --php-deny-dirs=<dirs>  Comma-separated upload directories where .php files are never executed (default: /uploads)")
+                fmt.Println("  --stream-port=<port>    Listen port of stream sites, which proxy TCP or UDP in the stream context")
+                fmt.Println("  --stream-protocol=<protocol>  tcp (default) or udp")
+                fmt.Println("  --stream-upstreams=<servers>  Comma-separated host:port or unix:<socket> upstream servers of stream sites")
+                fmt.Println("  --stream-balance=<method>  least_conn, hash (by client address) or random (default: round robin)")
+                fmt.Println("  --stream-connect-timeout=<time>  Timeout for connecting to an upstream server (default: 10s)")
+                fmt.Println("  --stream-timeout=<time> Close sessions idle for this long (default: 10m for tcp, 30s for udp)")
+                fmt.Println("  --stream-responses=<n>  Datagrams expected back for each udp datagram, e.g. 0 for syslog (default: wait for the timeout)")
+                fmt.Println("  --stream-tls=<mode>     terminate: decrypt TLS with the site certificate; passthrough: route TLS by server name")
+                fmt.Println("                          without decrypting it")
+                fmt.Println("  --sni-route=<routes>    Comma-separated <server name>=<host:port> routes by TLS server name (wildcards allowed);")
+                fmt.Println("                          other names go to --stream-upstreams")
+                fmt.Println("  --redirect-to=<target>  Redirect target URL or host for redirect sites (e.g., https://www.example.com)")
+                fmt.Println("  --redirect-code=<code>  Redirect status code: 301, 302, 307 or 308 (default: 301)")
+                fmt.Println("  --preserve-path=<bool>  Keep the request path when redirecting (default: true)")
+                fmt.Println("  --preserve-query=<bool> Keep the query string when redirecting (default: true)")
+                fmt.Println("  --location=<location>   Extra location \"[modifier] path target\" (repeatable), where modifier is =, ~, ~* or ^~ and target is")
+                fmt.Println("                          upstream:[protocol://]host:port or unix:<socket>, static:/dir, redirect:[code:]url or return:code[:text],")
+                fmt.Println("                          followed by optional allow=<networks>, deny=<networks>, auth[=<realm>], satisfy=any,")
+                fmt.Println("                          limit-req=<limit>, limit-conn=<limit> and limit-status=<code>")
+                fmt.Println("  --hsts                  Send Strict-Transport-Security (implied by the other --hsts-* options)")
+                fmt.Println("  --hsts-max-age=<secs>   HSTS max-age (default: 31536000)")
+                fmt.Println("  --hsts-include-subdomains  Add includeSubDomains to HSTS")
+                fmt.Println("  --hsts-preload          Add preload to HSTS (requires includeSubDomains and a max-age of one year or more)")
+                fmt.Println("  --csp=<policy>          Content-Security-Policy value, or a preset: strict or relaxed")
+                fmt.Println("  --frame-options=<value> X-Frame-Options: DENY or SAMEORIGIN")
+                fmt.Println("  --referrer-policy=<value>  Referrer-Policy, e.g. strict-origin-when-cross-origin")
+                fmt.Println("  --permissions-policy=<value>  Permissions-Policy, e.g. \"camera=(), microphone=()\"")
+                fmt.Println("  --nosniff               Send X-Content-Type-Options: nosniff")
+                fmt.Println("  --allow=<networks>      Comma-separated addresses, CIDR ranges or @name lists (see nx2 acl) allowed; others are denied")
+                fmt.Println("  --deny=<networks>       Comma-separated addresses or CIDR ranges denied")
+                fmt.Println("  --basic-auth            Require a user of the htpasswd file (create users with nx2 htpasswd add <site> <user>)")
+                fmt.Println("  --auth-realm=<realm>    Basic auth realm (default: Restricted)")
+                fmt.Println("  --auth-file=<path>      Htpasswd file (default: <config-dir>/htpasswd/<site>)")
+                fmt.Println("  --satisfy=<mode>        all (default): clients need an allowed address and a user; any: either is enough")
+                fmt.Println("  --client-ca=<path>      PEM bundle of the CAs that issue client certificates; enables mutual TLS")
+                fmt.Println("  --verify-client=<mode>  on (default): reject clients without a valid certificate; optional: let the upstream decide")
+                fmt.Println("  --verify-depth=<n>      Maximum client certificate chain depth (default: 1; use 2 with an intermediate CA)")
+                fmt.Println("  --client-crl=<path>     CRL file (PEM or DER) checked for revoked client certificates")
+                fmt.Println("  --forward-client-cert   Send X-SSL-Client-Verify, -S-DN, -I-DN, -Serial and -Fingerprint to the upstreams")
+                fmt.Println("  --limit-req=<limit>     Request rate limit zone[:burst=N][:nodelay|:delay=N], using a zone created with nx2 zones req")
+                fmt.Println("  --limit-conn=<limit>    Connection limit zone:N, using a zone created with nx2 zones conn")
+                fmt.Println("  --limit-status=<code>   Status of requests rejected by the limits, e.g. 429 (default: 503)")
+                fmt.Println("  --cache                 Cache upstream responses and send X-Cache-Status (implied by the other --cache-* options)")
+                fmt.Println("  --cache-path=<path>     Cache directory (default: /var/cache/nginx/<site>)")
+                fmt.Println("  --cache-size=<size>     Maximum cache size (default: 1g)")
+                fmt.Println("  --cache-inactive=<time> Remove responses not requested for this long (default: 60m)")
+                fmt.Println("  --cache-key=<key>       Cache key (default: $scheme$request_method$host$request_uri)")
+                fmt.Println("  --cache-valid=<times>   Comma-separated \"<status>...=<duration>\" entries (default: \"200 301 302=10m,404=1m\")")
+                fmt.Println("  --cache-bypass=<rules>  Comma-separated cookie:<name>, header:<name> or arg:<name> rules that skip the cache;")
+                fmt.Println("                          requests with an Authorization header always skip it")
+                fmt.Println("  --cache-use-stale=<conditions>  Serve stale responses on these conditions, or off")
+                fmt.Println("                          (default: \"error timeout updating http_500 http_502 http_503 http_504\")")
+                fmt.Println("  --gzip                  Compress responses with gzip")
+                fmt.Println("  --brotli                Compress responses with brotli, when nginx -V or modules-enabled shows ngx_brotli")
+                fmt.Println("  --zstd                  Compress responses with zstd, when nginx -V or modules-enabled shows zstd-nginx-module")
+                fmt.Println("  --compress-types=<types>  Comma-separated MIME types compressed besides text/html (default: text, CSS, JS, JSON,")
+                fmt.Println("                          XML, SVG, WebAssembly and fonts)")
+                fmt.Println("  --gzip-static           Serve precompressed .gz files, and .br and .zst with --brotli and --zstd")
+                fmt.Println("  --asset-cache           Cache fingerprinted assets (e.g. main.3f2a9c1b.js) for a year and revalidate index.html")
+                fmt.Println("  --asset-pattern=<regex> Regular expression matching fingerprinted assets (default: an 8+ digit hex hash before the")
+                fmt.Println("                          extension)")
+                fmt.Println("  --listen-address=<ips>  Comma-separated IPv4 or IPv6 addresses to listen on (default: every IPv4 address)")
+                fmt.Println("  --ipv6                  Also listen on every IPv6 address ([::]) when no --listen-address is given")
+                fmt.Println("  --http-port=<port>      HTTP port (default: 80)")
+                fmt.Println("  --https-port=<port>     HTTPS port (default: 443)")
+                fmt.Println("  --default-server        Make the site the default server of its listen sockets")
+                fmt.Println("  --reuseport             Open a listen socket per worker process; only one site per socket may set it")
+                fmt.Println("  --http-only             Serve the site over plain HTTP only, for internal sites without certificates")
+                fmt.Println("  --no-http-redirect      Do not create the server redirecting HTTP to HTTPS")
+                fmt.Println("  --accept-proxy-protocol Accept the PROXY protocol on the listen sockets; every client must then send it")
+                fmt.Println("  --real-ip-from=<networks>  Comma-separated networks of the trusted load balancers; replaces the list of nx2 realip")
+                fmt.Println("  --real-ip-header=<name> Header with the client address: proxy_protocol, X-Forwarded-For, X-Real-IP, ... (default:")
+                fmt.Println("                          proxy_protocol with --accept-proxy-protocol, else X-Forwarded-For)")
+                fmt.Println("  --real-ip-recursive     Skip every trusted address in X-Forwarded-For instead of only the last one")
+                fmt.Println("  --upstream-sni-name=<name>  Name sent as SNI to every https upstream and checked on its certificate (default: each upstream host)")
+                fmt.Println("  --upstream-verify       Verify the certificate of https upstreams (implied by --upstream-ca; disable with --upstream-verify=false)")
+                fmt.Println("  --upstream-ca=<path>    PEM bundle of the CAs trusted for https upstreams, e.g. /etc/ssl/certs/ca-certificates.crt")
+                fmt.Println("  --upstream-verify-depth=<n>  Maximum upstream certificate chain depth (default: 1)")
+                fmt.Println("  --upstream-client-cert=<path>  Client certificate presented to https upstreams (with --upstream-client-key)")
+                fmt.Println("  --upstream-client-key=<path>   Private key of the upstream client certificate")
+                fmt.Println("  --spec=<path>           JSON site spec with the fields above and a list of locations; flags override it")
                 fmt.Println("  --help                  Display this help message")
                 fmt.Println("\nInteractive Mode Example:")
                 fmt.Println("  nx2createsite --config-dir=/custom/nginx")
@@ -200,12 +2627,55 @@ func main() {
                 fmt.Println("  nx2createsite --site-name=teste.tjap.jus.br --site-type=proxy --upstream-host=192.168.1.100 --upstream-port=8080 --proxy-protocol=https --fullchain-path=/opt/certs/teste.pem --privkey-path=/opt/certs/teste.key")
                 fmt.Println("  # Local site with defaults for certs:")
                 fmt.Println("  nx2createsite --site-name=local.tjap.jus.br --site-type=local")
+                fmt.Println("  # Laravel app served by PHP-FPM from its public directory:")
+                fmt.Println("  nx2createsite --site-name=php.tjap.jus.br --site-type=php --fpm=/run/php/php8.2-fpm.sock --document-root=/var/www/php/public --php-deny-dirs=/storage,/uploads")
+                fmt.Println("  # Redirect an old domain and its apex to the new one:")
+                fmt.Println("  nx2createsite --site-name=www.old.example.com --site-type=redirect --aliases=old.example.com --redirect-to=www.new.example.com")
+                fmt.Println("  # Proxy site routing /api to another backend and serving /static from disk:")
+                fmt.Println("  nx2createsite --site-name=app.tjap.jus.br --site-type=proxy --upstream-host=10.0.0.10 --upstream-port=3000 \\")
+                fmt.Println("    --location='/api upstream:10.0.0.20:8080' --location='/static static:/var/www/app/static' --location='= /health return:200:ok'")
+                fmt.Println("  # Local site with HSTS and the strict CSP preset:")
+                fmt.Println("  nx2createsite --site-name=www.tjap.jus.br --site-type=local --hsts --hsts-include-subdomains --csp=strict --frame-options=DENY --nosniff")
+                fmt.Println("  # Internal tool reachable from the office network, or from anywhere with a password:")
+                fmt.Println("  nx2createsite --site-name=intranet.tjap.jus.br --site-type=proxy --upstream-host=10.0.0.30 --upstream-port=8080 \\")
+                fmt.Println("    --allow=@office,10.20.0.0/16 --basic-auth --satisfy=any --location='/admin upstream:10.0.0.31:8080 allow=10.20.1.0/24'")
+                fmt.Println("  # API that only accepts clients with certificates from the internal CA:")
+                fmt.Println("  nx2createsite --site-name=api.tjap.jus.br --site-type=proxy --upstream-host=10.0.0.40 --upstream-port=8443 --proxy-protocol=https \\")
+                fmt.Println("    --client-ca=/opt/certs/internal-ca.pem --verify-depth=2 --client-crl=/opt/certs/internal-ca.crl --forward-client-cert")
+                fmt.Println("  # API limited to 10 requests per second per client, with a stricter limit on /login:")
+                fmt.Println("  nx2 zones --rate=10r/s req api && nx2 zones --rate=5r/m req login")
+                fmt.Println("  nx2createsite --site-name=api.tjap.jus.br --site-type=proxy --upstream-host=10.0.0.60 --upstream-port=8080 \\")
+                fmt.Println("    --limit-req=api:burst=20:nodelay --limit-status=429 --location='= /login upstream:10.0.0.60:8080 limit-req=login:burst=3 limit-status=429'")
+                fmt.Println("  # Single-page app with precompressed, long-cached bundles:")
+                fmt.Println("  nx2createsite --site-name=app.tjap.jus.br --site-type=local --gzip --gzip-static --asset-cache")
+                fmt.Println("  # Read-mostly app with a one second microcache, skipped for logged-in users:")
+                fmt.Println("  nx2createsite --site-name=news.tjap.jus.br --site-type=proxy --upstream-host=10.0.0.70 --upstream-port=8080 --proxy-protocol=http \\")
+                fmt.Println("    --cache-valid='200=1s' --cache-bypass=cookie:sessionid")
+                fmt.Println("  # Proxy to an https backend by IP, verifying its certificate against the internal CA:")
+                fmt.Println("  nx2createsite --site-name=erp.tjap.jus.br --site-type=proxy --upstream-host=10.0.0.50 --upstream-port=443 --proxy-protocol=https \\")
+                fmt.Println("    --upstream-ca=/opt/certs/internal-ca.pem --upstream-sni-name=erp.internal.tjap.jus.br")
+                fmt.Println("  # Django app served by uWSGI on a unix socket, with a gunicorn API on another socket:")
+                fmt.Println("  nx2createsite --site-name=django.tjap.jus.br --site-type=proxy --upstream-host=unix:/run/uwsgi/django.sock --proxy-protocol=uwsgi \\")
+                fmt.Println("    --location='/api/ upstream:unix:/run/gunicorn/api.sock'")
+                fmt.Println("  # PostgreSQL replicas behind a TCP proxy, and syslog over UDP:")
+                fmt.Println("  nx2createsite --site-name=pg.tjap.jus.br --site-type=stream --stream-port=5432 --stream-upstreams=10.0.1.10:5432,10.0.1.11:5432 \\")
+                fmt.Println("    --stream-balance=least_conn --stream-timeout=1h --allow=10.0.0.0/16")
+                fmt.Println("  nx2createsite --site-name=syslog.tjap.jus.br --site-type=stream --stream-port=514 --stream-protocol=udp --stream-upstreams=10.0.1.20:514 --stream-responses=0")
+                fmt.Println("  # TLS passthrough on 8443, routing by server name without decrypting:")
+                fmt.Println("  nx2createsite --site-name=tls.tjap.jus.br --site-type=stream --stream-port=8443 --stream-tls=passthrough \\")
+                fmt.Println("    --stream-upstreams=10.0.1.30:443 --sni-route=git.tjap.jus.br=10.0.1.31:443,*.apps.tjap.jus.br=10.0.1.32:443")
                 fmt.Println("\nNotes:")
                 fmt.Println("  - Config file uses hostname (e.g., teste.conf for teste.tjap.jus.br).")
                 fmt.Println("  - For proxy sites, ensure upstream hostname is resolvable via /etc/hosts or DNS.")
                 fmt.Println("  - Reload only occurs if all parameters are valid and certificates exist, followed by nx2ensite.")
                 fmt.Println("  - If the config file already exists, interactive mode prompts to overwrite; non-interactive mode fails.")
                 fmt.Println("  - In interactive mode, press Enter to use default certificate paths.")
+                fmt.Println("  - Security headers are sent with 'always' by the HTTPS server, so error responses carry them too.")
+                fmt.Println("  - https upstreams always get SNI; without --upstream-sni-name, the upstream host is used, so IP upstreams send none.")
+                fmt.Println("  - Stream sites are written to streams-available and enabled with nx2ensite --stream; nginx.conf must include")
+                fmt.Println("    streams-enabled/*.conf in a top-level stream block. Of the HTTP options, only --allow, --deny, --listen-address,")
+                fmt.Println("    --ipv6 and --reuseport apply to them.")
+                fmt.Println("  - With --verify-client=optional, requests without a valid certificate reach the upstream, which must check X-SSL-Client-Verify.")
                 os.Exit(0)
         }
 
@@ -215,9 +2685,290 @@ func main() {
                 os.Exit(1)
         }
 
+        // Load the site spec; values given as flags take precedence
+        var spec SiteSpec
+        if *specFlag != "" {
+                var err error
+                spec, err = loadSpec(*specFlag)
+                if err != nil {
+                        fmt.Printf("Error: Failed to load site spec: %v\n", err)
+                        os.Exit(1)
+                }
+                setFlags := map[string]bool{}
+                flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+                if !setFlags["redirect-code"] && spec.RedirectCode != 0 {
+                        *redirectCodeFlag = spec.RedirectCode
+                }
+                if !setFlags["preserve-path"] && spec.PreservePath != nil {
+                        *preservePathFlag = *spec.PreservePath
+                }
+                if !setFlags["preserve-query"] && spec.PreserveQuery != nil {
+                        *preserveQueryFlag = *spec.PreserveQuery
+                }
+                for name, value := range map[string]*bool{
+                        "hsts":                    spec.HSTS,
+                        "hsts-include-subdomains": spec.HSTSIncludeSubdomains,
+                        "hsts-preload":            spec.HSTSPreload,
+                        "nosniff":                 spec.NoSniff,
+                } {
+                        if !setFlags[name] && value != nil {
+                                flag.Set(name, strconv.FormatBool(*value))
+                        }
+                }
+                if !setFlags["forward-client-cert"] && spec.ForwardClientCert != nil {
+                        *forwardClientCertFlag = *spec.ForwardClientCert
+                }
+                if !setFlags["verify-depth"] && spec.VerifyDepth != 0 {
+                        *verifyDepthFlag = spec.VerifyDepth
+                }
+                if !setFlags["upstream-verify"] && spec.UpstreamVerify != nil {
+                        flag.Set("upstream-verify", strconv.FormatBool(*spec.UpstreamVerify))
+                }
+                for name, value := range map[string]*bool{
+                        "cache":                 spec.Cache,
+                        "gzip":                  spec.Gzip,
+                        "brotli":                spec.Brotli,
+                        "zstd":                  spec.Zstd,
+                        "gzip-static":           spec.GzipStatic,
+                        "asset-cache":           spec.AssetCache,
+                        "accept-proxy-protocol": spec.AcceptProxyProtocol,
+                        "real-ip-recursive":     spec.RealIPRecursive,
+                        "ipv6":                  spec.IPv6,
+                        "default-server":        spec.DefaultServer,
+                        "reuseport":             spec.ReusePort,
+                        "http-only":             spec.HTTPOnly,
+                        "no-http-redirect":      spec.NoHTTPRedirect,
+                } {
+                        if !setFlags[name] && value != nil {
+                                flag.Set(name, strconv.FormatBool(*value))
+                        }
+                }
+                for name, value := range map[string]string{
+                        "cache-path":             spec.CachePath,
+                        "cache-size":             spec.CacheSize,
+                        "cache-inactive":         spec.CacheInactive,
+                        "cache-key":              spec.CacheKey,
+                        "cache-valid":            strings.Join(spec.CacheValid, ","),
+                        "cache-bypass":           strings.Join(spec.CacheBypass, ","),
+                        "cache-use-stale":        spec.CacheUseStale,
+                        "compress-types":         strings.Join(spec.CompressTypes, ","),
+                        "asset-pattern":          spec.AssetPattern,
+                        "php-deny-dirs":          strings.Join(spec.PHPDenyDirs, ","),
+                        "real-ip-from":           strings.Join(spec.RealIPFrom, ","),
+                        "real-ip-header":         spec.RealIPHeader,
+                        "listen-address":         strings.Join(spec.ListenAddresses, ","),
+                        "stream-protocol":        spec.StreamProtocol,
+                        "stream-upstreams":       strings.Join(spec.StreamUpstreams, ","),
+                        "stream-balance":         spec.StreamBalance,
+                        "stream-connect-timeout": spec.StreamConnectTimeout,
+                        "stream-timeout":         spec.StreamTimeout,
+                        "stream-tls":             spec.StreamTLS,
+                        "sni-route":              strings.Join(spec.SNIRoutes, ","),
+                } {
+                        if !setFlags[name] && value != "" {
+                                flag.Set(name, value)
+                        }
+                }
+                if !setFlags["stream-port"] && spec.StreamPort != 0 {
+                        *streamPortFlag = spec.StreamPort
+                }
+                if !setFlags["stream-responses"] && spec.StreamResponses != nil {
+                        *streamResponsesFlag = *spec.StreamResponses
+                }
+                if !setFlags["http-port"] && spec.HTTPPort != 0 {
+                        *httpPortFlag = spec.HTTPPort
+                }
+                if !setFlags["https-port"] && spec.HTTPSPort != 0 {
+                        *httpsPortFlag = spec.HTTPSPort
+                }
+                if !setFlags["limit-status"] && spec.Status != 0 {
+                        *limitStatusFlag = spec.Status
+                }
+                if !setFlags["upstream-verify-depth"] && spec.UpstreamVerifyDepth != 0 {
+                        *upstreamVerifyDepthFlag = spec.UpstreamVerifyDepth
+                }
+                if !setFlags["basic-auth"] && spec.BasicAuth {
+                        *basicAuthFlag = true
+                }
+                if *allowFlag == "" {
+                        *allowFlag = strings.Join(spec.Allow, ",")
+                }
+                if *denyFlag == "" {
+                        *denyFlag = strings.Join(spec.Deny, ",")
+                }
+                if !setFlags["hsts-max-age"] && spec.HSTSMaxAge != 0 {
+                        flag.Set("hsts-max-age", strconv.Itoa(spec.HSTSMaxAge))
+                }
+                if *aliasesFlag == "" {
+                        *aliasesFlag = strings.Join(spec.Aliases, ",")
+                }
+                for flagValue, specValue := range map[*string]string{
+                        siteNameFlag:          spec.SiteName,
+                        siteTypeFlag:          spec.SiteType,
+                        upstreamHostFlag:      spec.UpstreamHost,
+                        upstreamPortFlag:      spec.UpstreamPort.String(),
+                        proxyProtocolFlag:     spec.ProxyProtocol,
+                        fullchainPathFlag:     spec.FullchainPath,
+                        privkeyPathFlag:       spec.PrivkeyPath,
+                        redirectToFlag:        spec.RedirectTo,
+                        documentRootFlag:      spec.DocumentRoot,
+                        fpmFlag:               spec.FPM,
+                        cspFlag:               spec.CSP,
+                        frameOptionsFlag:      spec.FrameOptions,
+                        referrerPolicyFlag:    spec.ReferrerPolicy,
+                        permissionsPolicyFlag: spec.PermissionsPolicy,
+                        authRealmFlag:         spec.AuthRealm,
+                        authFileFlag:          spec.AuthFile,
+                        satisfyFlag:           spec.Satisfy,
+                        clientCAFlag:          spec.ClientCA,
+                        verifyClientFlag:      spec.VerifyClient,
+                        clientCRLFlag:         spec.ClientCRL,
+                        limitReqFlag:          spec.Req,
+                        limitConnFlag:         spec.Conn,
+                        upstreamSNINameFlag:   spec.UpstreamSNIName,
+                        upstreamCAFlag:        spec.UpstreamCA,
+                        upstreamCertFlag:      spec.UpstreamClientCert,
+                        upstreamKeyFlag:       spec.UpstreamClientKey,
+                } {
+                        if *flagValue == "" {
+                                *flagValue = specValue
+                        }
+                }
+        }
+
         // Initialize config data
         data := ConfigData{
-                Protocol: "http", // Default for proxy
+                Protocol:     "http", // Default for proxy
+                configDir:    *configDir,
+                Locations:    append(spec.Locations, locations...),
+                RedirectCode: *redirectCodeFlag,
+        }
+        // Security headers; the other HSTS options imply --hsts
+        data.Security = SecurityHeaders{
+                HSTS:                  *hstsFlag || *hstsIncludeSubdomainsFlag || *hstsPreloadFlag,
+                HSTSMaxAge:            *hstsMaxAgeFlag,
+                HSTSIncludeSubdomains: *hstsIncludeSubdomainsFlag,
+                HSTSPreload:           *hstsPreloadFlag,
+                CSP:                   *cspFlag,
+                FrameOptions:          strings.ToUpper(*frameOptionsFlag),
+                ReferrerPolicy:        strings.ToLower(*referrerPolicyFlag),
+                PermissionsPolicy:     *permissionsPolicyFlag,
+                NoSniff:               *noSniffFlag,
+        }
+        flag.Visit(func(f *flag.Flag) {
+                if f.Name == "hsts-max-age" {
+                        data.Security.HSTS = true
+                }
+        })
+        if preset, ok := cspPresets[strings.ToLower(data.Security.CSP)]; ok {
+                data.Security.CSP = preset
+        }
+
+        // Access control and limits of the HTTPS server
+        data.Access = Access{
+                Allow:     splitList(*allowFlag),
+                Deny:      splitList(*denyFlag),
+                BasicAuth: *basicAuthFlag,
+                AuthRealm: *authRealmFlag,
+                AuthFile:  *authFileFlag,
+                Satisfy:   strings.ToLower(*satisfyFlag),
+        }
+        data.Limits = Limits{Req: *limitReqFlag, Conn: *limitConnFlag, Status: *limitStatusFlag}
+
+        // Proxy cache; the other --cache-* options imply --cache
+        data.Cache = Cache{
+                Enabled:  *cacheFlag,
+                Path:     *cachePathFlag,
+                MaxSize:  *cacheSizeFlag,
+                Inactive: *cacheInactiveFlag,
+                Key:      *cacheKeyFlag,
+                Valid:    splitList(*cacheValidFlag),
+                Bypass:   splitList(*cacheBypassFlag),
+                UseStale: strings.Join(strings.Fields(*cacheUseStaleFlag), " "),
+        }
+        flag.Visit(func(f *flag.Flag) {
+                if strings.HasPrefix(f.Name, "cache-") {
+                        data.Cache.Enabled = true
+                }
+        })
+
+        // Compression and asset caching; brotli and zstd depend on the nginx build
+        data.Compression = Compression{
+                Gzip:   *gzipFlag,
+                Brotli: *brotliFlag,
+                Zstd:   *zstdFlag,
+                Static: *gzipStaticFlag,
+                Types:  splitList(*compressTypesFlag),
+        }
+        if *brotliFlag || *zstdFlag || *gzipStaticFlag {
+                data.Compression.modules = nginxModules(*configDir)
+        }
+        data.AssetCache = AssetCache{Enabled: *assetCacheFlag, Pattern: *assetPatternFlag}
+
+        // Listen sockets
+        data.Listen = Listen{
+                Addresses:     splitList(*listenAddressFlag),
+                IPv6:          *ipv6Flag,
+                HTTPPort:      *httpPortFlag,
+                HTTPSPort:     *httpsPortFlag,
+                DefaultServer: *defaultServerFlag,
+                ReusePort:     *reusePortFlag,
+                HTTPOnly:      *httpOnlyFlag,
+                NoRedirect:    *noHTTPRedirectFlag,
+        }
+
+        // Client address behind load balancers; the PROXY protocol carries it when accepted
+        data.RealIP = RealIP{
+                ProxyProtocol: *acceptProxyProtocolFlag,
+                From:          splitList(*realIPFromFlag),
+                Header:        *realIPHeaderFlag,
+                Recursive:     *realIPRecursiveFlag,
+        }
+        if data.RealIP.Header == "" && len(data.RealIP.From) > 0 {
+                data.RealIP.Header = "X-Forwarded-For"
+                if data.RealIP.ProxyProtocol {
+                        data.RealIP.Header = "proxy_protocol"
+                }
+        }
+        if _, err := os.Stat(filepath.Join(*configDir, "conf.d", "nx2-realip.conf")); data.RealIP.ProxyProtocol && len(data.RealIP.From) == 0 && err != nil {
+                fmt.Println("Warning: --accept-proxy-protocol without --real-ip-from or nx2 realip logs the load balancer address; the client address is only in $proxy_protocol_addr.")
+        }
+
+        // Client certificate authentication; verification defaults to on with a CA bundle
+        data.ClientTLS = ClientTLS{
+                CA:      *clientCAFlag,
+                Verify:  strings.ToLower(*verifyClientFlag),
+                Depth:   *verifyDepthFlag,
+                CRL:     *clientCRLFlag,
+                Forward: *forwardClientCertFlag,
+        }
+        if data.ClientTLS.CA != "" && data.ClientTLS.Verify == "" {
+                data.ClientTLS.Verify = "on"
+        }
+
+        // TLS to https upstreams; a CA bundle implies verification unless --upstream-verify=false
+        data.UpstreamTLS = UpstreamTLS{
+                Name:   toASCIIName(*upstreamSNINameFlag),
+                Verify: *upstreamVerifyFlag || *upstreamCAFlag != "",
+                CA:     *upstreamCAFlag,
+                Depth:  *upstreamVerifyDepthFlag,
+                Cert:   *upstreamCertFlag,
+                Key:    *upstreamKeyFlag,
+        }
+        flag.Visit(func(f *flag.Flag) {
+                if f.Name == "upstream-verify" {
+                        data.UpstreamTLS.Verify = *upstreamVerifyFlag
+                }
+        })
+        for _, alias := range strings.Split(*aliasesFlag, ",") {
+                if alias = strings.TrimSpace(alias); alias != "" {
+                        data.Aliases = append(data.Aliases, toASCIIName(alias))
+                }
+        }
+        for i := range data.Locations {
+                for j, option := range data.Locations[i].Options {
+                        data.Locations[i].Options[j] = strings.TrimSuffix(strings.TrimSpace(option), ";")
+                }
         }
 
         // Use flags if provided, otherwise prompt
@@ -231,19 +2982,52 @@ func main() {
                 data.SiteName = strings.TrimSpace(scanner.Text())
         }
 
-        // Extract hostname (e.g., teste from teste.tjap.jus.br)
-        if data.SiteName != "" {
-                parts := strings.Split(data.SiteName, ".")
-                if len(parts) >= 2 {
-                        data.SiteHostName = parts[0] // Use first part as hostname
+        // Convert internationalized names to punycode (e.g., café.example.com to xn--caf-dma.example.com)
+        if ascii := toASCIIName(data.SiteName); ascii != data.SiteName {
+                if strings.ToLower(data.SiteName) != ascii {
+                        fmt.Printf("Site name %s converted to %s.\n", data.SiteName, ascii)
                 }
+                data.SiteName = ascii
+        }
+
+        // Extract hostname (e.g., teste from teste.tjap.jus.br)
+        data.SiteHostName = siteHostName(data.SiteName)
+
+        // Default htpasswd files, access list and zone paths depend on the site and config directory
+        data.Access.resolve(*configDir, data.SiteHostName)
+        data.Limits.resolve(*configDir)
+        data.Cache.Zone = data.SiteHostName + "_cache"
+        data.AssetCache.Variable = siteVariable(data.SiteHostName) + "_cache_control"
+        if data.Cache.Path == "" {
+                data.Cache.Path = filepath.Join("/var/cache/nginx", data.SiteHostName)
+        }
+        for i := range data.Locations {
+                data.Locations[i].Access.resolve(*configDir, data.SiteHostName)
+                data.Locations[i].Access.inheritSatisfy(data.Access)
+                data.Locations[i].Limits.resolve(*configDir)
+        }
+
+        if *siteTypeFlag != "" {
+                siteType = strings.ToLower(*siteTypeFlag)
+        } else {
+                fmt.Print("Is this a proxy, local, php, redirect or stream site? (proxy/local/php/redirect/stream): ")
+                scanner.Scan()
+                siteType = strings.ToLower(strings.TrimSpace(scanner.Text()))
         }
 
-        // Check if config file already exists
-        configPath := filepath.Join(*configDir, "sites-available", data.SiteHostName+".conf")
+        // Check if config file already exists; stream sites live in streams-available
+        availableDir, ensite := "sites-available", "nx2ensite"
+        if siteType == "stream" {
+                availableDir, ensite = "streams-available", "nx2ensite --stream"
+                if err := os.MkdirAll(filepath.Join(*configDir, availableDir), 0755); err != nil {
+                        fmt.Printf("Error: Failed to create %s: %v\n", filepath.Join(*configDir, availableDir), err)
+                        os.Exit(4)
+                }
+        }
+        configPath := filepath.Join(*configDir, availableDir, data.SiteHostName+".conf")
         if _, err := os.Stat(configPath); err == nil {
                 // File exists, check if non-interactive mode
-                nonInteractive := *siteNameFlag != "" && *siteTypeFlag != "" && (*fullchainPathFlag != "" || *siteTypeFlag != "proxy") && (*privkeyPathFlag != "" || *siteTypeFlag != "proxy")
+                nonInteractive := *siteNameFlag != "" && *siteTypeFlag != "" && (*fullchainPathFlag != "" || *siteTypeFlag != "proxy" || *httpOnlyFlag) && (*privkeyPathFlag != "" || *siteTypeFlag != "proxy" || *httpOnlyFlag)
                 if nonInteractive {
                         fmt.Printf("Error: Configuration file %s already exists. Remove it or choose a different site name.\n", configPath)
                         os.Exit(2)
@@ -258,14 +3042,6 @@ func main() {
                 }
         }
 
-        if *siteTypeFlag != "" {
-                siteType = strings.ToLower(*siteTypeFlag)
-        } else {
-                fmt.Print("Is this a proxy or local site? (proxy/local): ")
-                scanner.Scan()
-                siteType = strings.ToLower(strings.TrimSpace(scanner.Text()))
-        }
-
         if siteType == "proxy" {
                 if *upstreamHostFlag != "" {
                         data.IPHostName = *upstreamHostFlag
@@ -275,12 +3051,13 @@ func main() {
                         data.IPHostName = strings.TrimSpace(scanner.Text())
                 }
 
-                // Check if IPHostName is a hostname (not an IP)
-                if data.IPHostName != "" && !isIPAddress(data.IPHostName) {
+                // Check if IPHostName is a hostname (not an IP or unix socket)
+                unixSocket := strings.HasPrefix(data.IPHostName, "unix:")
+                if data.IPHostName != "" && !unixSocket && !isIPAddress(data.IPHostName) {
                         fmt.Printf("Warning: Upstream hostname %s must be resolvable. Update /etc/hosts or configure DNS for the site to function properly.\n", data.IPHostName)
                 }
 
-                if *upstreamPortFlag != "" {
+                if *upstreamPortFlag != "" || unixSocket {
                         data.PortUpstream = *upstreamPortFlag
                 } else {
                         fmt.Print("Enter the upstream port: ")
@@ -291,13 +3068,96 @@ func main() {
                 if *proxyProtocolFlag != "" {
                         data.Protocol = strings.ToLower(*proxyProtocolFlag)
                 } else {
-                        fmt.Print("Use http or https for proxy_pass? (http/https): ")
+                        fmt.Print("Which protocol does the upstream speak? (http/https/uwsgi/scgi): ")
                         scanner.Scan()
                         data.Protocol = strings.ToLower(strings.TrimSpace(scanner.Text()))
                 }
         }
 
-        if *fullchainPathFlag != "" {
+        if siteType == "local" || siteType == "php" {
+                data.DocumentRoot = *documentRootFlag
+                if data.DocumentRoot == "" {
+                        data.DocumentRoot = filepath.Join("/var/www", data.SiteHostName)
+                }
+        }
+
+        if siteType == "php" {
+                data.PHP = PHP{
+                        FPM:        *fpmFlag,
+                        DenyDirs:   splitList(*phpDenyDirsFlag),
+                        paramsFile: filepath.Join(*configDir, "fastcgi_params"),
+                }
+                if data.PHP.FPM == "" {
+                        fmt.Print("Enter the PHP-FPM socket path or host:port (default: /run/php/php-fpm.sock): ")
+                        scanner.Scan()
+                        data.PHP.FPM = strings.TrimSpace(scanner.Text())
+                        if data.PHP.FPM == "" {
+                                data.PHP.FPM = "/run/php/php-fpm.sock"
+                        }
+                }
+        }
+
+        if siteType == "redirect" {
+                target := *redirectToFlag
+                if target == "" {
+                        fmt.Print("Enter the redirect target URL or host (e.g., https://www.example.com): ")
+                        scanner.Scan()
+                        target = strings.TrimSpace(scanner.Text())
+                }
+                if target != "" {
+                        if *preservePathFlag && !*preserveQueryFlag {
+                                data.RedirectPath = siteVariable(data.SiteHostName) + "_path"
+                        }
+                        redirect, err := redirectURL(target, *preservePathFlag, *preserveQueryFlag, data.RedirectPath)
+                        if err != nil {
+                                fmt.Printf("Error: Invalid redirect target %s: %v\n", target, err)
+                                os.Exit(1)
+                        }
+                        data.RedirectURL = redirect
+                }
+        }
+
+        if siteType == "stream" {
+                data.Stream = Stream{
+                        Port:           *streamPortFlag,
+                        Protocol:       strings.ToLower(*streamProtocolFlag),
+                        Servers:        splitList(*streamUpstreamsFlag),
+                        Balance:        strings.ToLower(*streamBalanceFlag),
+                        ConnectTimeout: *streamConnectTimeoutFlag,
+                        Timeout:        *streamTimeoutFlag,
+                        Responses:      *streamResponsesFlag,
+                        TLS:            strings.ToLower(*streamTLSFlag),
+                        Variable:       siteVariable(data.SiteHostName) + "_upstream",
+                        upstream:       data.SiteHostName,
+                        modules:        nginxModules(*configDir),
+                }
+                if data.Stream.Port == 0 {
+                        fmt.Print("Enter the port to listen on: ")
+                        scanner.Scan()
+                        data.Stream.Port, _ = strconv.Atoi(strings.TrimSpace(scanner.Text()))
+                }
+                if len(data.Stream.Servers) == 0 {
+                        fmt.Print("Enter the comma-separated upstream servers (host:port): ")
+                        scanner.Scan()
+                        data.Stream.Servers = splitList(scanner.Text())
+                }
+                if data.Stream.Timeout == "" {
+                        data.Stream.Timeout = "10m"
+                        if data.Stream.Protocol == "udp" {
+                                data.Stream.Timeout = "30s"
+                        }
+                }
+                routes, err := parseSNIRoutes(splitList(*sniRouteFlag))
+                if err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        os.Exit(1)
+                }
+                data.Stream.Routes = routes
+        }
+
+        // Certificates are only needed for HTTPS and for streams terminating TLS
+        noCertificates := data.Listen.HTTPOnly || siteType == "stream" && data.Stream.TLS != "terminate"
+        if *fullchainPathFlag != "" || noCertificates {
                 data.FullchainPath = *fullchainPathFlag
         } else {
                 fmt.Print("Enter the fullchain certificate path (default: /opt/certs/fullchain.pem): ")
@@ -308,7 +3168,7 @@ func main() {
                 }
         }
 
-        if *privkeyPathFlag != "" {
+        if *privkeyPathFlag != "" || noCertificates {
                 data.PrivkeyPath = *privkeyPathFlag
         } else {
                 fmt.Print("Enter the private key path (default: /opt/certs/privkey.pem): ")
@@ -319,16 +3179,34 @@ func main() {
                 }
         }
 
+        // Name the upstreams of extra locations and warn about overlapping locations
+        buildUpstreams(&data, siteType)
+        for _, warning := range locationOverlaps(data.Locations) {
+                fmt.Printf("Warning: %s\n", warning)
+        }
+
         // Validate parameters
         errors := validateParams(data, siteType)
+
+        // The cache only applies to proxy_pass backends; without them validation reports the
+        // option and the site is written without the cache
+        if proxied, _ := data.backends(siteType); proxied == 0 {
+                data.Cache.Enabled = false
+        }
+
+        // Check if other sites already claim the server names; streams have none
+        if siteType != "stream" {
+                claimErrors, claimWarnings := checkClaimedNames(*configDir, data.SiteHostName, append([]string{data.SiteName}, data.Aliases...))
+                for _, warning := range claimWarnings {
+                        fmt.Printf("Warning: %s\n", warning)
+                }
+                errors = append(errors, claimErrors...)
+        } else if !streamsIncluded(*configDir) {
+                fmt.Println("Warning: nginx.conf does not include streams-enabled; add \"stream { include streams-enabled/*.conf; }\" at its top level.")
+        }
         if len(errors) > 0 {
                 // Write config file even if there are errors
-                tmplContent := localTemplate
-                if siteType == "proxy" {
-                        tmplContent = proxyTemplate
-                }
-
-                tmpl, err := template.New("nginx").Parse(tmplContent)
+                tmpl, err := newTemplate(siteType)
                 if err != nil {
                         fmt.Printf("Error: Failed to parse template: %v\n", err)
                         os.Exit(3)
@@ -351,17 +3229,12 @@ func main() {
                 for _, err := range errors {
                         fmt.Printf("- %s\n", err)
                 }
-                fmt.Println("Please fix the parameters and use nx2ensite to enable the site.")
+                fmt.Printf("Please fix the parameters and use %s to enable the site.\n", ensite)
                 os.Exit(0)
         }
 
         // Write config file
-        tmplContent := localTemplate
-        if siteType == "proxy" {
-                tmplContent = proxyTemplate
-        }
-
-        tmpl, err := template.New("nginx").Parse(tmplContent)
+        tmpl, err := newTemplate(siteType)
         if err != nil {
                 fmt.Printf("Error: Failed to parse template: %v\n", err)
                 os.Exit(3)
@@ -381,30 +3254,34 @@ func main() {
         fmt.Printf("Configuration file created: %s\n", configPath)
 
         // Prompt for reload (only in interactive mode)
-        nonInteractive := *siteNameFlag != "" && *siteTypeFlag != "" && (*fullchainPathFlag != "" || siteType != "proxy") && (*privkeyPathFlag != "" || siteType != "proxy")
+        nonInteractive := *siteNameFlag != "" && *siteTypeFlag != "" && (*fullchainPathFlag != "" || siteType != "proxy" || *httpOnlyFlag) && (*privkeyPathFlag != "" || siteType != "proxy" || *httpOnlyFlag)
         if !nonInteractive {
                 fmt.Print("Do you want to enable the site and reload Nginx? (y/n): ")
                 scanner.Scan()
                 if strings.ToLower(strings.TrimSpace(scanner.Text())) != "y" {
-                        fmt.Println("Nginx reload skipped. Use nx2ensite to enable the site.")
+                        fmt.Printf("Nginx reload skipped. Use %s to enable the site.\n", ensite)
                         os.Exit(0)
                 }
         }
 
-        // Run nx2ensite to enable the site
-        cmd := exec.Command("nx2ensite", data.SiteHostName)
-        var stderr bytes.Buffer
-        cmd.Stderr = &stderr
+        // Run nx2ensite to enable the site in the same configuration directory; it checks the
+        // site with nx2 conflicts first and prints the conflicts on stdout. -f reloads without
+        // prompting when the site was already enabled
+        ensiteArgs := append(strings.Fields(ensite), "--config-dir="+*configDir, "-f", data.SiteHostName)
+        cmd := exec.Command(ensiteArgs[0], ensiteArgs[1:]...)
+        var output bytes.Buffer
+        cmd.Stdout = &output
+        cmd.Stderr = &output
         if err := cmd.Run(); err != nil {
                 fmt.Printf("Error: Failed to enable site with nx2ensite: %v\n", err)
-                fmt.Println(stderr.String())
+                fmt.Println(output.String())
                 os.Exit(5)
         }
         fmt.Printf("Site %s enabled successfully.\n", data.SiteHostName)
 
         // Test Nginx configuration
         cmd = exec.Command("nginx", "-t")
-        stderr.Reset()
+        var stderr bytes.Buffer
         cmd.Stderr = &stderr
         if err := cmd.Run(); err != nil {
                 fmt.Println("Error: Nginx configuration test failed. Details:")
@@ -0,0 +1,69 @@
+package main
+
+import (
+        "strings"
+        "testing"
+)
+
+func TestToASCIIName(t *testing.T) {
+        tests := []struct{ name, want string }{
+                {"Example.COM", "example.com"},
+                {"café.example.com", "xn--caf-dma.example.com"},
+                {"*.bücher.example", "*.xn--bcher-kva.example"},
+                {"münchen.de", "xn--mnchen-3ya.de"},
+                // RFC 3492 section 7.1 samples (A) Arabic and (L) Japanese
+                {"ليهمابتكلموشعربي؟.example", "xn--egbpdaj6bu4bxfgehfvwxn.example"},
+                {"3年b組金八先生.jp", "xn--3b-ww4c5e180e575a65lsy2b.jp"},
+                {"~^café\\.example$", "~^café\\.example$"},
+        }
+        for _, tt := range tests {
+                if got := toASCIIName(tt.name); got != tt.want {
+                        t.Errorf("toASCIIName(%q) = %q, want %q", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestSiteHostName(t *testing.T) {
+        tests := []struct{ name, want string }{
+                {"teste.tjap.jus.br", "teste"},
+                {"*.apps.example.com", "_.apps"},
+                {".apps.example.com", "_.apps"},
+                {"www.example.*", "www"},
+                {"localhost", ""},
+        }
+        for _, tt := range tests {
+                if got := siteHostName(tt.name); got != tt.want {
+                        t.Errorf("siteHostName(%q) = %q, want %q", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestLocationSatisfy(t *testing.T) {
+        server := Access{Allow: []string{"10.20.0.0/16"}, BasicAuth: true, Satisfy: "any"}
+        tests := []struct {
+                name     string
+                location Access
+                want     string
+        }{
+                {"own allow under satisfy any", Access{Allow: []string{"10.20.1.0/24"}}, "allow 10.20.1.0/24,deny all,satisfy all"},
+                {"own auth under satisfy any", Access{BasicAuth: true, AuthRealm: "Admin", AuthFile: "/etc/nginx/htpasswd/admin"},
+                        `auth_basic "Admin",auth_basic_user_file /etc/nginx/htpasswd/admin,satisfy all`},
+                {"explicit satisfy any", Access{Allow: []string{"10.20.1.0/24"}, BasicAuth: true, AuthRealm: "Admin", AuthFile: "/a", Satisfy: "any"},
+                        `allow 10.20.1.0/24,deny all,auth_basic "Admin",auth_basic_user_file /a,satisfy any`},
+                {"no access rules", Access{}, ""},
+        }
+        for _, tt := range tests {
+                loc := tt.location
+                loc.inheritSatisfy(server)
+                if got := strings.Join(loc.Directives(), ","); got != tt.want {
+                        t.Errorf("%s: directives %q, want %q", tt.name, got, tt.want)
+                }
+        }
+
+        // An explicit satisfy all is written even when the server does not use any
+        loc := Access{Allow: []string{"10.0.0.0/8"}, Satisfy: "all"}
+        loc.inheritSatisfy(Access{})
+        if got := strings.Join(loc.Directives(), ","); got != "allow 10.0.0.0/8,deny all,satisfy all" {
+                t.Errorf("explicit satisfy all: directives %q", got)
+        }
+}
@@ -2,6 +2,7 @@ package main
 
 import (
         "bytes"
+        "errors"
         "flag"
         "fmt"
         "os"
@@ -20,30 +21,71 @@ func checkSiteEnabled(sitesEnabled string) (bool, error) {
         return true, nil
 }
 
+// schedule records an enable or disable of the site with nx2 schedule, which runs it later
+// with the same checks as a manual run. With dryRun, nx2 schedule only checks the options.
+func schedule(configDir string, stream, dryRun bool, at, duration, action, site string) error {
+        args := []string{"schedule", "--config-dir=" + configDir}
+        if stream {
+                args = append(args, "--stream")
+        }
+        if dryRun {
+                args = append(args, "--dry-run")
+        }
+        if at != "" {
+                args = append(args, "--at="+at)
+        }
+        if duration != "" {
+                args = append(args, "--for="+duration)
+        }
+        cmd := exec.Command("nx2", append(args, "add", action, site)...)
+        cmd.Stdout = os.Stdout
+        cmd.Stderr = os.Stderr
+        if err := cmd.Run(); errors.Is(err, exec.ErrNotFound) {
+                return fmt.Errorf("nx2 not found in PATH, it is required by --at and --for")
+        } else if err != nil {
+                return fmt.Errorf("nx2 schedule failed: %v", err)
+        }
+        return nil
+}
+
 func main() {
         // Define flags
         help := flag.Bool("help", false, "Display usage information")
         configDir := flag.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
+        stream := flag.Bool("stream", false, "Disable a stream site from streams-enabled")
+        at := flag.String("at", "", "Disable the site at this time instead of now")
+        duration := flag.String("for", "", "Enable the site again after this long")
         flag.Parse()
 
         // Display help if --help is passed or no arguments are provided
         if *help || len(flag.Args()) == 0 {
-                fmt.Println("Usage: nx2dissite2 [--config-dir=<path>] <site_name>")
-                fmt.Println("Disable a site in Nginx by removing its symbolic link from sites-enabled.")
+                fmt.Println("Usage: nx2dissite2 [--config-dir=<path>] [--stream] [--at=<time>] [--for=<duration>] <site_name>")
+                fmt.Println("Disable a site in Nginx by removing its symbolic link from sites-enabled, or from streams-enabled with --stream.")
+                fmt.Println("When the configuration test fails after removing the link, the link is restored.")
                 fmt.Println("\nOptions:")
                 fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
+                fmt.Println("  --stream             Disable a stream site created with nx2create --site-type=stream")
+                fmt.Println("  --at=<time>          Schedule the disable with 'nx2 schedule' instead of disabling now: a time of day")
+                fmt.Println("                       (02:00), a date and time (\"2026-11-01 08:00\") or a delay (+2h)")
+                fmt.Println("  --for=<duration>     Enable the site again after this long, e.g. 90m, 2h or 7d")
                 fmt.Println("  --help               Display this help message")
                 fmt.Println("\nExample:")
                 fmt.Println("  nx2dissite2 example")
                 fmt.Println("  nx2dissite2 --config-dir=/custom/nginx example")
+                fmt.Println("  nx2dissite2 --stream pg")
+                fmt.Println("  nx2dissite2 --at=02:00 --for=2h erp")
                 os.Exit(0)
         }
 
         // Get site name from arguments
         site := flag.Args()[0]
 
-        // Construct paths
-        sitesEnabled := filepath.Join(*configDir, "sites-enabled", site+".conf")
+        // Construct paths; stream sites live in streams-enabled
+        enabledDir := "sites-enabled"
+        if *stream {
+                enabledDir = "streams-enabled"
+        }
+        sitesEnabled := filepath.Join(*configDir, enabledDir, site+".conf")
 
         // Check if configuration directory exists
         if _, err := os.Stat(*configDir); os.IsNotExist(err) {
@@ -51,6 +93,16 @@ func main() {
                 os.Exit(1)
         }
 
+        // With --at, only record the schedule, also for a site that is not enabled yet; nx2
+        // schedule run checks the state of the site when the schedule is due
+        if *at != "" {
+                if err := schedule(*configDir, *stream, false, *at, *duration, "disable", site); err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        os.Exit(6)
+                }
+                os.Exit(0)
+        }
+
         // Check if site is enabled
         isEnabled, err := checkSiteEnabled(sitesEnabled)
         if err != nil {
@@ -62,7 +114,20 @@ func main() {
                 os.Exit(2)
         }
 
-        // Remove the symbolic link
+        // With --for, let nx2 schedule check the duration before the site is disabled
+        if *duration != "" {
+                if err := schedule(*configDir, *stream, true, "", *duration, "disable", site); err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        os.Exit(6)
+                }
+        }
+
+        // Remove the symbolic link, keeping its target to restore it if the test fails
+        target, err := os.Readlink(sitesEnabled)
+        if err != nil {
+                fmt.Printf("Error: Failed to read symbolic link: %v\n", err)
+                os.Exit(3)
+        }
         if err := os.Remove(sitesEnabled); err != nil {
                 fmt.Printf("Error: Failed to remove symbolic link: %v\n", err)
                 os.Exit(3)
@@ -76,6 +141,11 @@ func main() {
         if err := cmd.Run(); err != nil {
                 fmt.Println("Error: Nginx configuration test failed. Details:")
                 fmt.Println(stderr.String())
+                if err := os.Symlink(target, sitesEnabled); err != nil {
+                        fmt.Printf("Error: Failed to restore symbolic link %s: %v\n", sitesEnabled, err)
+                } else {
+                        fmt.Printf("Site %s enabled again.\n", site)
+                }
                 os.Exit(4)
         }
 
@@ -87,4 +157,12 @@ func main() {
         }
 
         fmt.Println("Nginx reloaded successfully.")
+
+        // With --for, record the enable of the site after the duration
+        if *duration != "" {
+                if err := schedule(*configDir, *stream, false, "", *duration, "disable", site); err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        os.Exit(6)
+                }
+        }
 }
\ No newline at end of file
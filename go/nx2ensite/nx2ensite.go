@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -28,6 +29,58 @@ func checkSiteEnabled(sitesAvailable, sitesEnabled string) (bool, error) {
 	return filepath.Clean(target) == filepath.Clean(sitesAvailable), nil
 }
 
+// checkConflicts runs nx2 conflicts to find server_name, default_server and ssl conflicts
+// between the site and the enabled sites. It returns an error when the check cannot run,
+// for instance because nx2 is not installed.
+func checkConflicts(configDir, sitesAvailable string) ([]string, error) {
+	out, err := exec.Command("nx2", "conflicts", "--config-dir="+configDir, "--with="+sitesAvailable).Output()
+	var exitErr *exec.ExitError
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("nx2 not found in PATH, cannot check the site for conflicts")
+	} else if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 3) {
+		message := strings.TrimSpace(string(out))
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("conflict check failed: %s", message)
+	}
+
+	var conflicts []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "- ") {
+			conflicts = append(conflicts, strings.TrimPrefix(line, "- "))
+		}
+	}
+	return conflicts, nil
+}
+
+// schedule records an enable or disable of the site with nx2 schedule, which runs it later
+// with the same checks as a manual run. With dryRun, nx2 schedule only checks the options.
+func schedule(configDir string, stream, dryRun bool, at, duration, action, site string) error {
+	args := []string{"schedule", "--config-dir=" + configDir}
+	if stream {
+		args = append(args, "--stream")
+	}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	if at != "" {
+		args = append(args, "--at="+at)
+	}
+	if duration != "" {
+		args = append(args, "--for="+duration)
+	}
+	cmd := exec.Command("nx2", append(args, "add", action, site)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("nx2 not found in PATH, it is required by --at and --for")
+	} else if err != nil {
+		return fmt.Errorf("nx2 schedule failed: %v", err)
+	}
+	return nil
+}
+
 // promptReload asks the user if they want to reload Nginx.
 func promptReload(site string) bool {
 	fmt.Printf("Site %s is already enabled. Do you want to reload Nginx? (y/n): ", site)
@@ -42,28 +95,47 @@ func main() {
 	help := flag.Bool("help", false, "Display usage information")
 	configDir := flag.String("config-dir", "/etc/nginx", "Path to Nginx configuration directory")
 	force := flag.Bool("f", false, "Force Nginx reload without prompting if site is already enabled")
+	stream := flag.Bool("stream", false, "Enable a stream site from streams-available")
+	skipConflicts := flag.Bool("skip-conflicts", false, "Enable the site without checking it with nx2 conflicts")
+	at := flag.String("at", "", "Enable the site at this time instead of now")
+	duration := flag.String("for", "", "Disable the site again after this long")
 	flag.Parse()
 
 	// Display help if --help is passed or no arguments are provided
 	if *help || len(flag.Args()) == 0 {
-		fmt.Println("Usage: nx2ensite [--config-dir=<path>] [-f] <site_name>")
+		fmt.Println("Usage: nx2ensite [--config-dir=<path>] [-f] [--stream] [--skip-conflicts] [--at=<time>] [--for=<duration>] <site_name>")
 		fmt.Println("Enable a site in Nginx by creating a symbolic link from sites-available to sites-enabled.")
+		fmt.Println("Before enabling, the site is checked with 'nx2 conflicts' for server names, default_server flags")
+		fmt.Println("and ssl settings that clash with the enabled sites. With --stream, the TCP/UDP proxy is linked from")
+		fmt.Println("streams-available to streams-enabled instead. When the configuration test fails after linking, the")
+		fmt.Println("link is removed again.")
 		fmt.Println("\nOptions:")
 		fmt.Println("  --config-dir=<path>  Specify the Nginx configuration directory (default: /etc/nginx)")
 		fmt.Println("  -f                   Force Nginx reload without prompting if site is already enabled")
+		fmt.Println("  --stream             Enable a stream site created with nx2create --site-type=stream")
+		fmt.Println("  --skip-conflicts     Enable the site without 'nx2 conflicts', e.g. when nx2 is not installed")
+		fmt.Println("  --at=<time>          Schedule the enable with 'nx2 schedule' instead of enabling now: a time of day")
+		fmt.Println("                       (02:00), a date and time (\"2026-11-01 08:00\") or a delay (+2h)")
+		fmt.Println("  --for=<duration>     Disable the site again after this long, e.g. 90m, 2h or 7d")
 		fmt.Println("  --help               Display this help message")
 		fmt.Println("\nExample:")
 		fmt.Println("  nx2ensite example")
 		fmt.Println("  nx2ensite --config-dir=/custom/nginx -f example")
+		fmt.Println("  nx2ensite --stream pg")
+		fmt.Println("  nx2ensite --at=\"2026-11-01 08:00\" --for=7d campaign")
 		os.Exit(0)
 	}
 
 	// Get site name from arguments
 	site := flag.Args()[0]
 
-	// Construct paths
-	sitesAvailable := filepath.Join(*configDir, "sites-available", site+".conf")
-	sitesEnabled := filepath.Join(*configDir, "sites-enabled", site+".conf")
+	// Construct paths; stream sites live in streams-available and streams-enabled
+	availableDir, enabledDir := "sites-available", "sites-enabled"
+	if *stream {
+		availableDir, enabledDir = "streams-available", "streams-enabled"
+	}
+	sitesAvailable := filepath.Join(*configDir, availableDir, site+".conf")
+	sitesEnabled := filepath.Join(*configDir, enabledDir, site+".conf")
 
 	// Check if configuration directory exists
 	if _, err := os.Stat(*configDir); os.IsNotExist(err) {
@@ -77,6 +149,22 @@ func main() {
 		os.Exit(2)
 	}
 
+	// With --at, only record the schedule; nx2 schedule run enables the site when it is due
+	if *at != "" {
+		if err := schedule(*configDir, *stream, false, *at, *duration, "enable", site); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(8)
+		}
+		os.Exit(0)
+	}
+	// With --for, let nx2 schedule check the duration before the site is enabled
+	if *duration != "" {
+		if err := schedule(*configDir, *stream, true, "", *duration, "enable", site); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(8)
+		}
+	}
+
 	// Test Nginx configuration
 	cmd := exec.Command("nginx", "-t")
 	var stderr bytes.Buffer
@@ -94,8 +182,9 @@ func main() {
 		os.Exit(4)
 	}
 
+	linked := false
 	if isEnabled {
-		fmt.Printf("Warning: Site %s is already enabled in sites-enabled.\n", site)
+		fmt.Printf("Warning: Site %s is already enabled in %s.\n", site, enabledDir)
 		if !*force {
 			if !promptReload(site) {
 				fmt.Println("Nginx reload skipped.")
@@ -103,11 +192,33 @@ func main() {
 			}
 		}
 	} else {
+		// Check listen and server_name conflicts with the enabled sites; nx2 conflicts only
+		// knows http servers, so streams rely on the nginx -t below
+		var conflicts []string
+		if !*stream && !*skipConflicts {
+			if conflicts, err = checkConflicts(*configDir, sitesAvailable); err != nil {
+				fmt.Printf("Error: %v. Use --skip-conflicts to enable the site without the check.\n", err)
+				os.Exit(7)
+			}
+		}
+		if len(conflicts) > 0 {
+			fmt.Printf("Error: Site %s conflicts with enabled sites:\n", site)
+			for _, conflict := range conflicts {
+				fmt.Printf("- %s\n", conflict)
+			}
+			os.Exit(7)
+		}
+
 		// Create symbolic link
+		if err := os.MkdirAll(filepath.Dir(sitesEnabled), 0755); err != nil {
+			fmt.Printf("Error: Failed to create %s: %v\n", filepath.Dir(sitesEnabled), err)
+			os.Exit(4)
+		}
 		if err := os.Symlink(sitesAvailable, sitesEnabled); err != nil {
 			fmt.Printf("Error: Failed to create symbolic link: %v\n", err)
 			os.Exit(4)
 		}
+		linked = true
 		fmt.Printf("Site %s enabled successfully.\n", site)
 	}
 
@@ -118,6 +229,13 @@ func main() {
 	if err := cmd.Run(); err != nil {
 		fmt.Println("Error: Nginx configuration test failed after enabling site. Details:")
 		fmt.Println(stderr.String())
+		if linked {
+			if err := os.Remove(sitesEnabled); err != nil {
+				fmt.Printf("Error: Failed to remove symbolic link %s: %v\n", sitesEnabled, err)
+			} else {
+				fmt.Printf("Site %s disabled again.\n", site)
+			}
+		}
 		os.Exit(5)
 	}
 
@@ -129,4 +247,12 @@ func main() {
 	}
 
 	fmt.Println("Nginx reloaded successfully.")
+
+	// With --for, record the disable of the site after the duration
+	if *duration != "" {
+		if err := schedule(*configDir, *stream, false, "", *duration, "enable", site); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(8)
+		}
+	}
 }
\ No newline at end of file